@@ -3,6 +3,7 @@ module github.com/basecamp/thruster
 go 1.26.4
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/klauspost/compress v1.18.6
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/crypto v0.53.0
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const defaultAdminTopEntries = 10
+
+// AdminHandler serves the administrative API. It should only be exposed on a
+// private listener, since it allows the cache to be modified.
+type AdminHandler struct {
+	cache        Cache
+	requestStats *CacheRequestStats
+	keyRules     CacheKeyRules
+	mux          *http.ServeMux
+}
+
+func NewAdminHandler(cache Cache, requestStats *CacheRequestStats) *AdminHandler {
+	h := &AdminHandler{
+		cache:        cache,
+		requestStats: requestStats,
+		mux:          http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("POST /cache/purge", h.purge)
+	h.mux.HandleFunc("GET /cache/stats", h.stats)
+
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Private
+
+// purge removes items from the cache. Exactly one of the following parameters
+// selects what to remove:
+//
+//   - url: the response for a single URL, including its host and query, which
+//     is normalized using the cache key rules
+//   - prefix: all responses with a path starting with the prefix, optionally
+//     limited to a single host with the host parameter
+//   - tag: all responses tagged with the given surrogate key
+//   - all: every item in the cache
+func (h *AdminHandler) purge(w http.ResponseWriter, r *http.Request) {
+	var purged int
+
+	switch {
+	case r.FormValue("url") != "":
+		u, err := url.Parse(r.FormValue("url"))
+		if err != nil || u.Host == "" {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		purged = h.cache.DeleteTagged(matchURL(u.Host, h.keyRules.normalizeURL(u)))
+
+	case r.FormValue("prefix") != "":
+		purged = h.cache.DeleteTagged(matchPathPrefix(r.FormValue("host"), r.FormValue("prefix")))
+
+	case r.FormValue("tag") != "":
+		purged = h.cache.DeleteTagged(matchSurrogateKey(r.FormValue("tag")))
+
+	case r.FormValue("all") == "true":
+		purged = h.cache.Clear()
+
+	default:
+		http.Error(w, "Missing purge parameter: url, prefix, tag or all", http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("Cache: purged items", "url", r.FormValue("url"), "host", r.FormValue("host"), "prefix", r.FormValue("prefix"), "tag", r.FormValue("tag"), "all", r.FormValue("all"), "count", purged)
+
+	h.writeJSON(w, map[string]int{"purged": purged})
+}
+
+type adminCacheStats struct {
+	Requests map[string]int64 `json:"requests"`
+	HitRatio float64          `json:"hit_ratio"`
+	CacheStats
+	Largest []adminCacheEntry `json:"largest"`
+	MostHit []adminCacheEntry `json:"most_hit"`
+}
+
+type adminCacheEntry struct {
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	Size      int       `json:"size"`
+	Hits      int64     `json:"hits"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// stats reports on the cache's activity and contents, including the largest
+// and most used items. The number of items listed can be set with the top
+// parameter.
+func (h *AdminHandler) stats(w http.ResponseWriter, r *http.Request) {
+	top, err := strconv.Atoi(cmp.Or(r.FormValue("top"), strconv.Itoa(defaultAdminTopEntries)))
+	if err != nil || top < 0 {
+		http.Error(w, "Invalid top parameter", http.StatusBadRequest)
+		return
+	}
+
+	entries := h.cache.Entries()
+
+	h.writeJSON(w, adminCacheStats{
+		Requests:   h.requestStats.Counts(),
+		HitRatio:   h.requestStats.HitRatio(),
+		CacheStats: h.cache.Stats(),
+		Largest: topCacheEntries(entries, top, func(a, b CacheEntryInfo) int {
+			return cmp.Compare(b.Size, a.Size)
+		}),
+		MostHit: topCacheEntries(entries, top, func(a, b CacheEntryInfo) int {
+			return cmp.Compare(b.Hits, a.Hits)
+		}),
+	})
+}
+
+func (h *AdminHandler) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("Failed to write admin response", "error", err)
+	}
+}
+
+func topCacheEntries(entries []CacheEntryInfo, count int, compare func(a, b CacheEntryInfo) int) []adminCacheEntry {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b CacheEntryInfo) int {
+		return cmp.Or(compare(a, b), cmp.Compare(a.Key, b.Key))
+	})
+
+	result := []adminCacheEntry{}
+	for _, entry := range sorted[:min(count, len(sorted))] {
+		result = append(result, adminCacheEntry{
+			Key:       fmt.Sprintf("%016x", uint64(entry.Key)),
+			URL:       cacheTagURL(entry.Tags),
+			Size:      entry.Size,
+			Hits:      entry.Hits,
+			ExpiresAt: entry.ExpiresAt,
+		})
+	}
+
+	return result
+}
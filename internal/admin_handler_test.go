@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler_purge(t *testing.T) {
+	tests := map[string]struct {
+		params   url.Values
+		expected string
+		retained []CacheKey
+	}{
+		"by url":             {url.Values{"url": {"http://example.com/articles/1"}}, `{"purged":1}`, []CacheKey{2, 3, 4}},
+		"by prefix":          {url.Values{"prefix": {"/articles"}}, `{"purged":3}`, []CacheKey{4}},
+		"by prefix and host": {url.Values{"prefix": {"/articles"}, "host": {"example.com"}}, `{"purged":2}`, []CacheKey{3, 4}},
+		"by tag":             {url.Values{"tag": {"articles"}}, `{"purged":2}`, []CacheKey{3, 4}},
+		"everything":         {url.Values{"all": {"true"}}, `{"purged":4}`, []CacheKey{}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newTestAdminCache()
+			h := NewAdminHandler(cache, NewCacheRequestStats())
+
+			r := httptest.NewRequest("POST", "/cache/purge", strings.NewReader(tc.params.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.JSONEq(t, tc.expected, w.Body.String())
+			assert.ElementsMatch(t, tc.retained, cacheEntryKeys(cache.Entries()))
+		})
+	}
+}
+
+func TestAdminHandler_purge_requires_a_parameter(t *testing.T) {
+	h := NewAdminHandler(newTestAdminCache(), NewCacheRequestStats())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/cache/purge", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/cache/purge?url=/articles", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAdminHandler_purge_requires_post(t *testing.T) {
+	h := NewAdminHandler(newTestAdminCache(), NewCacheRequestStats())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/cache/purge?all=true", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAdminHandler_stats(t *testing.T) {
+	cache := newTestAdminCache()
+	cache.Set(5, make([]byte, 100), time.Now().Add(1*time.Hour), "url:example.com/large")
+	cache.Get(2)
+	cache.Get(2)
+	cache.Get(3)
+
+	requestStats := NewCacheRequestStats()
+	requestStats.Record(cacheStatusHit)
+	requestStats.Record(cacheStatusHit)
+	requestStats.Record(cacheStatusStale)
+	requestStats.Record(cacheStatusMiss)
+	requestStats.Record(cacheStatusBypass)
+
+	h := NewAdminHandler(cache, requestStats)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/cache/stats?top=2", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var stats struct {
+		Requests  map[string]int64   `json:"requests"`
+		HitRatio  float64            `json:"hit_ratio"`
+		Items     int                `json:"items"`
+		SizeBytes int                `json:"size_bytes"`
+		Stores    int64              `json:"stores"`
+		Evictions CacheEvictionStats `json:"evictions"`
+		Largest   []adminCacheEntry  `json:"largest"`
+		MostHit   []adminCacheEntry  `json:"most_hit"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+
+	assert.Equal(t, int64(2), stats.Requests["hit"])
+	assert.Equal(t, int64(1), stats.Requests["bypass"])
+	assert.Equal(t, int64(0), stats.Requests["collapsed"])
+	assert.Equal(t, 0.75, stats.HitRatio)
+
+	assert.Equal(t, 5, stats.Items)
+	assert.Equal(t, 104, stats.SizeBytes)
+	assert.Equal(t, int64(5), stats.Stores)
+
+	assert.Len(t, stats.Largest, 2)
+	assert.Equal(t, "0000000000000005", stats.Largest[0].Key)
+	assert.Equal(t, "example.com/large", stats.Largest[0].URL)
+	assert.Equal(t, 100, stats.Largest[0].Size)
+
+	assert.Len(t, stats.MostHit, 2)
+	assert.Equal(t, "example.com/articles/2", stats.MostHit[0].URL)
+	assert.Equal(t, int64(2), stats.MostHit[0].Hits)
+	assert.Equal(t, "other.com/articles/1", stats.MostHit[1].URL)
+}
+
+func TestAdminHandler_stats_with_invalid_top(t *testing.T) {
+	h := NewAdminHandler(newTestAdminCache(), NewCacheRequestStats())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/cache/stats?top=lots", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Helpers
+
+func cacheEntryKeys(entries []CacheEntryInfo) []CacheKey {
+	keys := make([]CacheKey, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+
+	return keys
+}
+
+func newTestAdminCache() *MemoryCache {
+	c := NewMemoryCache(32*MB, 1*MB)
+	expiresAt := time.Now().Add(1 * time.Hour)
+
+	c.Set(1, []byte("1"), expiresAt, "url:example.com/articles/1", "key:articles")
+	c.Set(2, []byte("2"), expiresAt, "url:example.com/articles/2", "key:articles")
+	c.Set(3, []byte("3"), expiresAt, "url:other.com/articles/1")
+	c.Set(4, []byte("4"), expiresAt, "url:example.com/about")
+
+	return c
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AdminServer listens for administrative requests on the loopback interface
+// only, so that they can't be made from outside the host.
+type AdminServer struct {
+	config     *Config
+	handler    http.Handler
+	httpServer *http.Server
+}
+
+func NewAdminServer(config *Config, handler http.Handler) *AdminServer {
+	return &AdminServer{
+		config:  config,
+		handler: handler,
+	}
+}
+
+func (s *AdminServer) Start() error {
+	address := fmt.Sprintf("127.0.0.1:%d", s.config.AdminPort)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		slog.Error("Failed to start admin listener", "error", err)
+		return err
+	}
+
+	s.httpServer = &http.Server{
+		Handler:     s.handler,
+		IdleTimeout: s.config.HttpIdleTimeout,
+	}
+
+	go func() { _ = s.httpServer.Serve(listener) }()
+
+	slog.Info("Admin server started", "address", listener.Addr().String())
+	return nil
+}
+
+func (s *AdminServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	_ = s.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"bufio"
+	"hash/crc32"
+	"math/bits"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzhttp"
+)
+
+var brotliJitterTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Brotli metadata blocks can hold up to 256 bytes when their length is given
+// in a single byte, which is all we need for padding.
+const brotliMaxMetadataBlockSize = 256
+
+// newBrotliWrapper returns a wrapper that compresses responses with Brotli.
+// It should only be used for requests that have negotiated Brotli, with
+// options that have had their defaults filled in.
+func newBrotliWrapper(options CompressionOptions) func(http.Handler) http.HandlerFunc {
+	pool := &sync.Pool{
+		New: func() any { return brotli.NewWriterLevel(nil, options.brotliLevel) },
+	}
+
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			bw := &brotliResponseWriter{ResponseWriter: w, options: options, pool: pool}
+			defer bw.Close()
+
+			next.ServeHTTP(bw, r)
+		}
+	}
+}
+
+// brotliResponseWriter makes the same decisions as the gzhttp writer used for
+// gzip and zstd. The start of the response is buffered until we know whether
+// it is large enough to be worth compressing, and responses are left alone if
+// they are already encoded, are partial content, have a content type that we
+// don't compress, or have been marked with gzhttp.HeaderNoCompression.
+//
+// Jitter is added as padding in a Brotli metadata block, which decoders skip.
+// Like gzhttp, the amount depends only on the start of the content.
+type brotliResponseWriter struct {
+	http.ResponseWriter
+	options    CompressionOptions
+	pool       *sync.Pool
+	padding    int
+	statusCode int
+	buf        []byte
+	bw         *brotli.Writer
+	ignore     bool
+}
+
+func (w *brotliResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= 100 && statusCode <= 199 {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *brotliResponseWriter) Write(b []byte) (int, error) {
+	if w.bw != nil {
+		return w.bw.Write(b)
+	}
+	if w.ignore {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if len(w.buf)+len(b) < w.bufferSize() && w.compressibleHeaders() {
+		w.buf = append(w.buf, b...)
+		return len(b), nil
+	}
+
+	body := b
+	if len(w.buf) > 0 {
+		w.buf = append(w.buf, b...)
+		body = w.buf
+	}
+
+	err := w.start(body, false)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (w *brotliResponseWriter) Flush() {
+	if w.bw == nil && !w.ignore {
+		if len(w.buf) == 0 {
+			return
+		}
+
+		// We have to decide now, so we assume that the rest of the response
+		// will make it large enough.
+		_ = w.start(w.buf, true)
+	}
+
+	if w.bw != nil {
+		_ = w.bw.Flush()
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *brotliResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *brotliResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close finishes the response, compressing whatever is still buffered if it
+// is large enough.
+func (w *brotliResponseWriter) Close() error {
+	if w.bw == nil && !w.ignore {
+		err := w.start(w.buf, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.bw == nil {
+		return nil
+	}
+
+	if w.padding > 0 {
+		err := w.bw.Flush()
+		if err == nil {
+			err = w.writePadding(w.padding)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.bw.Close()
+	w.pool.Put(w.bw)
+	w.bw = nil
+
+	return err
+}
+
+// Private
+
+func (w *brotliResponseWriter) bufferSize() int {
+	if w.options.jitter > 0 {
+		return max(w.options.minSize, compressionJitterBufferSize)
+	}
+	return w.options.minSize
+}
+
+// compressibleHeaders reports whether the headers set so far allow the
+// response to be compressed.
+func (w *brotliResponseWriter) compressibleHeaders() bool {
+	header := w.Header()
+
+	return len(header[gzhttp.HeaderNoCompression]) == 0 &&
+		header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == ""
+}
+
+func (w *brotliResponseWriter) shouldCompress(body []byte, flushing bool) bool {
+	if !w.compressibleHeaders() || !bodyAllowedForStatus(w.statusCode) {
+		return false
+	}
+
+	if !flushing && len(body) < w.options.minSize {
+		return false
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	if contentType == "" && len(body) > 0 {
+		contentType = http.DetectContentType(body)
+		if _, ok := w.Header()["Content-Type"]; !ok {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+
+	return w.options.contentTypeFilter(contentType)
+}
+
+// start decides whether to compress the response, writes its header, and
+// then writes the body we have so far.
+func (w *brotliResponseWriter) start(body []byte, flushing bool) error {
+	if w.shouldCompress(body, flushing) {
+		w.Header().Set("Content-Encoding", "br")
+		w.Header().Del("Content-Length")
+		w.Header().Del("Accept-Ranges")
+
+		w.padding = jitterSize(body, w.options.jitter)
+		w.bw = w.pool.Get().(*brotli.Writer)
+		w.bw.Reset(w.ResponseWriter)
+	} else {
+		w.Header().Del(gzhttp.HeaderNoCompression)
+		w.ignore = true
+	}
+
+	if w.statusCode != 0 {
+		w.ResponseWriter.WriteHeader(w.statusCode)
+	}
+
+	var err error
+	if len(body) > 0 {
+		if w.bw != nil {
+			_, err = w.bw.Write(body)
+		} else {
+			_, err = w.ResponseWriter.Write(body)
+		}
+	}
+
+	w.buf = nil
+	return err
+}
+
+// jitterSize picks between 1 and jitter bytes of padding, based on a checksum
+// of the start of the body, so that the same content is always padded the
+// same way.
+func jitterSize(body []byte, jitter int) int {
+	if jitter <= 0 {
+		return 0
+	}
+
+	sample := body[:min(len(body), compressionJitterBufferSize)]
+	checksum := bits.RotateLeft32(crc32.Checksum(sample, brotliJitterTable), 19)
+
+	return 1 + int(checksum%uint32(jitter))
+}
+
+// writePadding writes n bytes of padding as metadata blocks. It must only be
+// called when the compressed stream is byte-aligned, which it is after a
+// flush.
+func (w *brotliResponseWriter) writePadding(n int) error {
+	for n > 0 {
+		size := min(n, brotliMaxMetadataBlockSize)
+		n -= size
+
+		// ISLAST = 0, MNIBBLES = 0 (which marks a metadata block), a reserved
+		// zero bit, MSKIPBYTES = 1, then MSKIPLEN - 1 across the byte boundary,
+		// padded with zero bits.
+		block := make([]byte, 2+size)
+		block[0] = 0x16 | byte((size-1)&0x3)<<6
+		block[1] = byte((size - 1) >> 2)
+
+		_, err := w.ResponseWriter.Write(block)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bodyAllowedForStatus reports whether a response with the given status can
+// have a body. A status of 0 means the handler hasn't set one, so it will be
+// 200.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
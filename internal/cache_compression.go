@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/klauspost/compress/gzhttp"
+)
+
+// cacheCompressor keeps compressed copies of cached responses, so that a hit
+// from a client that accepts compression can be served without compressing
+// the same body again.
+//
+// The copies are made with the same wrapper as the CompressionHandler. Its
+// jitter depends only on the content, so clients receive exactly the bytes
+// they would have if the response had been compressed as it was served.
+type cacheCompressor struct {
+	options CompressionOptions
+	wrapper func(http.Handler) http.HandlerFunc
+}
+
+func newCacheCompressor(options CompressionOptions) *cacheCompressor {
+	options = options.withDefaults()
+
+	return &cacheCompressor{
+		options: options,
+		wrapper: newCompressionWrapper(options),
+	}
+}
+
+// encodingFor returns the encoding to serve a cached response with, or an
+// empty string if it should be served as it is.
+func (c *cacheCompressor) encodingFor(w http.ResponseWriter, r *http.Request, cr *CacheableResponse) string {
+	if c == nil || isRangeRequest(r) {
+		return ""
+	}
+
+	// A handler further out may have asked for the response to be left
+	// uncompressed.
+	if w.Header().Get(gzhttp.HeaderNoCompression) != "" {
+		return ""
+	}
+
+	if !c.canCompress(r, cr) {
+		return ""
+	}
+
+	return c.options.negotiateContentEncoding(r)
+}
+
+// canCompress checks the parts of a response that the compression wrapper
+// would, so that we don't try to compress responses that it would leave
+// alone.
+func (c *cacheCompressor) canCompress(r *http.Request, cr *CacheableResponse) bool {
+	header := cr.HttpHeader
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" || header.Get("X-Sendfile") != "" {
+		return false
+	}
+
+	if len(cr.Body) < c.options.minSize || c.options.optedOut(header) {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType != "" && !c.options.contentTypeFilter(contentType) {
+		return false
+	}
+
+	return !c.options.guarded(r, header)
+}
+
+// compress runs a cached response through the compression wrapper, returning
+// the compressed copy. It reports false if the wrapper didn't compress it.
+func (c *cacheCompressor) compress(r *http.Request, cr *CacheableResponse, encoding string, maxBodySize int) (CacheableResponse, bool) {
+	req := r.Clone(r.Context())
+	req.Header.Set("Accept-Encoding", encoding)
+
+	hw := newHeldResponseWriter(newDiscardingResponseWriter(), maxBodySize)
+	c.wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range cr.HttpHeader {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(cr.StatusCode)
+		_, _ = w.Write(cr.Body)
+	})).ServeHTTP(hw, req)
+
+	if hw.released || hw.header.Get("Content-Encoding") != encoding {
+		return CacheableResponse{}, false
+	}
+
+	compressed := *cr
+	compressed.StatusCode = hw.statusCode
+	compressed.HttpHeader = hw.header
+	compressed.HttpHeader.Set("Content-Length", strconv.Itoa(hw.body.Len()))
+	compressed.Body = hw.body.Bytes()
+
+	return compressed, true
+}
+
+// compressedCacheKey is the key for the copy of a response compressed with the
+// given encoding.
+func compressedCacheKey(key CacheKey, encoding string) CacheKey {
+	var b []byte
+	b = binary.BigEndian.AppendUint64(b, uint64(key))
+	b = append(b, encoding...)
+
+	sum := sha256.Sum256(b)
+	return CacheKey(binary.BigEndian.Uint64(sum[:]))
+}
+
+// compressedResponse returns a compressed copy of a cached response, from the
+// cache if we have one, or by compressing it and storing the result.
+func (h *CacheHandler) compressedResponse(r *http.Request, variant *Variant, key CacheKey, cr *CacheableResponse, encoding string) (CacheableResponse, bool) {
+	compressedKey := compressedCacheKey(key, encoding)
+
+	cached, found := h.cache.Get(compressedKey)
+	if found {
+		compressed, err := CacheableResponseFromBuffer(cached)
+
+		// The copy is only current if it was made from this version of the
+		// response.
+		if err == nil && compressed.PrimaryKey == cr.PrimaryKey && compressed.CreatedAt.Equal(cr.CreatedAt) {
+			return compressed, true
+		}
+	}
+
+	compressed, ok := h.compressor.compress(r, cr, encoding, h.maxBodySize)
+	if !ok {
+		return CacheableResponse{}, false
+	}
+
+	encoded, err := compressed.ToBuffer()
+	if err != nil {
+		slog.Error("Failed to encode compressed response for caching", "path", r.URL.Path, "error", err)
+		return compressed, true
+	}
+
+	h.cache.Set(compressedKey, encoded, cr.RetainUntil(), responseCacheTags(r.Host, variant.URL(), cr.HttpHeader)...)
+	slog.Debug("Added compressed response to cache", "path", r.URL.Path, "key", compressedKey, "encoding", encoding, "size", len(encoded))
+
+	return compressed, true
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxDeltaSeconds = 1 << 31
+
+// CacheControl holds the directives of a Cache-Control header, or of a
+// header that uses the same syntax, like Surrogate-Control. Directive names
+// are case-insensitive, so they are stored in lower case. Directives without
+// an argument are stored with an empty value.
+type CacheControl map[string]string
+
+// ParseCacheControl parses the directives from all the given header values.
+// When a directive appears more than once, the first occurrence is used.
+func ParseCacheControl(values []string) CacheControl {
+	cc := CacheControl{}
+
+	for _, value := range values {
+		for len(value) > 0 {
+			var name, arg string
+			name, arg, value = nextCacheDirective(value)
+
+			if name == "" {
+				continue
+			}
+			if _, ok := cc[name]; !ok {
+				cc[name] = arg
+			}
+		}
+	}
+
+	return cc
+}
+
+func (cc CacheControl) Has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// Seconds returns the value of a directive that takes a delta-seconds
+// argument. It reports false if the directive is missing, or if its argument
+// is not a valid number of seconds.
+func (cc CacheControl) Seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+
+	return parseDeltaSeconds(arg)
+}
+
+// Private
+
+// parseDeltaSeconds parses a non-negative number of seconds, as used by
+// Cache-Control directives and the Age header. Values too large to represent
+// are capped, as RFC 9111 requires.
+func parseDeltaSeconds(s string) (time.Duration, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return 0, false
+		}
+	}
+
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
+
+// nextCacheDirective reads a single directive from the start of s, returning
+// its name, its argument, and the rest of the string.
+func nextCacheDirective(s string) (string, string, string) {
+	s = strings.TrimLeft(s, " \t,")
+
+	end := strings.IndexAny(s, "=,")
+	if end < 0 || s[end] == ',' {
+		if end < 0 {
+			end = len(s)
+		}
+		return strings.ToLower(strings.TrimSpace(s[:end])), "", s[end:]
+	}
+
+	name := strings.ToLower(strings.TrimSpace(s[:end]))
+	s = strings.TrimLeft(s[end+1:], " \t")
+
+	if strings.HasPrefix(s, `"`) {
+		arg, rest := readQuotedString(s[1:])
+		return name, arg, rest
+	}
+
+	end = strings.IndexByte(s, ',')
+	if end < 0 {
+		end = len(s)
+	}
+
+	return name, strings.TrimSpace(s[:end]), s[end:]
+}
+
+// readQuotedString reads the remainder of a quoted string, up to its closing
+// quote, returning the unescaped contents and the rest of the input.
+func readQuotedString(s string) (string, string) {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			}
+		case '"':
+			return b.String(), s[i+1:]
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String(), ""
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheControl_parse(t *testing.T) {
+	tests := map[string]struct {
+		values   []string
+		expected CacheControl
+	}{
+		"empty":                  {[]string{""}, CacheControl{}},
+		"single directive":       {[]string{"public"}, CacheControl{"public": ""}},
+		"directive with value":   {[]string{"public, max-age=60"}, CacheControl{"public": "", "max-age": "60"}},
+		"extra whitespace":       {[]string{"  public ,max-age = 60 ,, "}, CacheControl{"public": "", "max-age": "60"}},
+		"mixed case":             {[]string{"Public, MAX-AGE=60"}, CacheControl{"public": "", "max-age": "60"}},
+		"quoted value":           {[]string{`private="Set-Cookie, X-Token", max-age=60`}, CacheControl{"private": "Set-Cookie, X-Token", "max-age": "60"}},
+		"escaped quote":          {[]string{`ext="a \"b\"", public`}, CacheControl{"ext": `a "b"`, "public": ""}},
+		"unterminated quote":     {[]string{`ext="abc`}, CacheControl{"ext": "abc"}},
+		"multiple header values": {[]string{"public", "max-age=60"}, CacheControl{"public": "", "max-age": "60"}},
+		"first duplicate wins":   {[]string{"max-age=60, max-age=10"}, CacheControl{"max-age": "60"}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ParseCacheControl(tc.values))
+		})
+	}
+}
+
+func TestCacheControl_seconds(t *testing.T) {
+	cc := ParseCacheControl([]string{"max-age=60, s-maxage=abc, stale-if-error=-1, stale-while-revalidate=99999999999999999999, no-cache"})
+
+	seconds, ok := cc.Seconds("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, seconds)
+
+	_, ok = cc.Seconds("s-maxage")
+	assert.False(t, ok)
+
+	_, ok = cc.Seconds("stale-if-error")
+	assert.False(t, ok)
+
+	seconds, ok = cc.Seconds("stale-while-revalidate")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(maxDeltaSeconds)*time.Second, seconds)
+
+	_, ok = cc.Seconds("no-cache")
+	assert.False(t, ok)
+
+	_, ok = cc.Seconds("missing")
+	assert.False(t, ok)
+}
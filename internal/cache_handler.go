@@ -1,75 +1,144 @@
 package internal
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"log/slog"
+	"maps"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+const defaultCoalescingTimeout = 10 * time.Second
+
 type CacheKey uint64
 
 type Cache interface {
 	Get(key CacheKey) ([]byte, bool)
-	Set(key CacheKey, value []byte, expiresAt time.Time)
+	Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string)
+	Delete(key CacheKey) bool
+	DeleteTagged(match CacheTagMatcher) int
+	Clear() int
+	Stats() CacheStats
+	Entries() []CacheEntryInfo
 }
 
 type CacheHandler struct {
-	cache       Cache
-	next        http.Handler
-	maxBodySize int
+	cache          Cache
+	next           http.Handler
+	maxBodySize    int
+	getCurrentTime GetCurrentTime
+	stats          *CacheRequestStats
+	keyRules       CacheKeyRules
+	compressor     *cacheCompressor
+
+	coalescer         *requestCoalescer
+	coalescingTimeout time.Duration
+
+	revalidatingLock sync.Mutex
+	revalidating     map[CacheKey]bool
 }
 
 func NewCacheHandler(cache Cache, maxBodySize int, next http.Handler) *CacheHandler {
 	return &CacheHandler{
-		cache:       cache,
-		next:        next,
-		maxBodySize: maxBodySize,
+		cache:          cache,
+		next:           next,
+		maxBodySize:    maxBodySize,
+		getCurrentTime: time.Now,
+
+		coalescer:         newRequestCoalescer(),
+		coalescingTimeout: defaultCoalescingTimeout,
+
+		revalidating: map[CacheKey]bool{},
 	}
 }
 
 func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	variant := NewVariant(r)
-	response, key, found := h.fetchFromCache(r, variant)
+	defer func() { h.stats.Record(w.Header().Get("X-Cache")) }()
 
-	if found {
-		variant.SetResponseHeader(response.HttpHeader)
-		if !variant.Matches(response.VariantHeader) {
-			response, key, found = h.fetchFromCache(r, variant)
-		}
+	variant := NewVariantWithKeyRules(r, h.keyRules)
+	response, key, found := h.lookup(r, variant)
+	now := h.getCurrentTime()
+	usable := found && h.clientAcceptsCachedResponse(r, response, now)
+
+	if usable && response.IsFresh(now) {
+		h.writeCachedResponse(w, r, variant, key, &response, cacheStatusHit)
+		return
 	}
 
-	if found {
-		response.WriteCachedResponse(w, r)
+	if usable && response.IsStaleWhileRevalidate(now) {
+		h.revalidateInBackground(r, key, response)
+		h.writeCachedResponse(w, r, variant, key, &response, cacheStatusStale)
 		return
 	}
 
 	if !h.shouldCacheRequest(r) {
 		slog.Debug("Bypassing cache for request", "path", r.URL.Path, "method", r.Method)
-		w.Header().Set("X-Cache", "bypass")
+		w.Header().Set("X-Cache", cacheStatusBypass)
 		h.next.ServeHTTP(w, r)
 		return
 	}
 
-	cr := NewCacheableResponse(w, h.maxBodySize)
-	h.next.ServeHTTP(cr, r)
+	if found && (response.HasValidators() || response.IsStaleIfError(now)) {
+		h.refreshStaleResponse(w, r, variant, key, response)
+		return
+	}
 
-	cacheable, expires := cr.CacheStatus()
-	if cacheable {
-		variant.SetResponseHeader(cr.HttpHeader)
-		cr.VariantHeader = variant.VariantHeader()
+	if isRangeRequest(r) {
+		h.fetchRangeResponse(w, r, variant, key)
+		return
+	}
 
-		encoded, err := cr.ToBuffer()
-		if err != nil {
-			slog.Error("Failed to encode response for caching", "path", r.URL.Path, "error", err)
-		} else {
-			h.cache.Set(key, encoded, expires)
-			slog.Debug("Added response to cache", "path", r.URL.Path, "key", key, "expires", expires, "size", len(encoded))
+	done, leader := h.coalescer.Join(key, now)
+	if leader {
+		defer h.coalescer.Finish(key)
+	} else if h.waitForCoalescedRequest(r, done) {
+		variant := NewVariantWithKeyRules(r, h.keyRules)
+		response, key, found := h.lookup(r, variant)
+		now := h.getCurrentTime()
+		if found && response.IsFresh(now) && h.clientAcceptsCachedResponse(r, response, now) {
+			h.writeCachedResponse(w, r, variant, key, &response, cacheStatusCollapsed)
+			return
 		}
 	}
+
+	h.fetchResponse(w, r, variant, key)
 }
 
 // Private
 
+// writeCachedResponse serves a response from the cache, using a compressed
+// copy of it when the client accepts one.
+func (h *CacheHandler) writeCachedResponse(w http.ResponseWriter, r *http.Request, variant *Variant, key CacheKey, cr *CacheableResponse, cacheStatus string) {
+	encoding := h.compressor.encodingFor(w, r, cr)
+	if encoding != "" {
+		compressed, ok := h.compressedResponse(r, variant, key, cr, encoding)
+		if ok {
+			compressed.writeCachedResponse(w, r, cacheStatus)
+			return
+		}
+	}
+
+	cr.writeCachedResponse(w, r, cacheStatus)
+}
+
+func (h *CacheHandler) lookup(r *http.Request, variant *Variant) (CacheableResponse, CacheKey, bool) {
+	response, key, found := h.fetchFromCache(r, variant)
+
+	if found {
+		variant.SetResponseHeader(response.HttpHeader)
+		if !variant.Matches(response.VariantHeader) {
+			response, key, found = h.fetchFromCache(r, variant)
+		}
+	}
+
+	return response, key, found
+}
+
 func (h *CacheHandler) fetchFromCache(r *http.Request, variant *Variant) (CacheableResponse, CacheKey, bool) {
 	key := variant.CacheKey()
 	cached, found := h.cache.Get(key)
@@ -81,16 +150,424 @@ func (h *CacheHandler) fetchFromCache(r *http.Request, variant *Variant) (Cachea
 			return CacheableResponse{}, key, false
 		}
 
+		if response.PrimaryKey != variant.PrimaryKey() {
+			slog.Warn("Cache: ignoring response stored for a different request", "path", r.URL.Path, "key", key)
+			return CacheableResponse{}, key, false
+		}
+
 		return response, key, true
 	}
 
 	return CacheableResponse{}, key, false
 }
 
+// fetchResponse proxies the request to the upstream, and stores the response
+// if it is cacheable. When the response turns out not to be cacheable, any
+// requests waiting for it are released to make their own.
+func (h *CacheHandler) fetchResponse(w http.ResponseWriter, r *http.Request, variant *Variant, key CacheKey) {
+	pass := func() { h.coalescer.Pass(key, h.getCurrentTime()) }
+
+	cr := NewCacheableResponse(w, h.maxBodySize)
+	cr.onUncacheable = pass
+	h.next.ServeHTTP(cr, r)
+
+	if !h.storeResponse(r, variant, key, cr) {
+		pass()
+	}
+}
+
+// fetchRangeResponse passes a range request through to the upstream. Until we
+// have seen a response, we can't tell whether the whole of it would be
+// cacheable, or small enough to hold, so we don't ask for it in place of the
+// requested ranges. Instead, when the partial response shows that the whole
+// response can be cached, we fetch it separately in the background, so that
+// later range requests can be served from the cache.
+func (h *CacheHandler) fetchRangeResponse(w http.ResponseWriter, r *http.Request, variant *Variant, key CacheKey) {
+	cr := NewCacheableResponse(w, h.maxBodySize)
+	h.next.ServeHTTP(cr, r)
+	if !cr.headersWritten {
+		cr.WriteHeader(cr.StatusCode)
+	}
+
+	if !h.storeResponse(r, variant, key, cr) && h.canCacheFullResponse(cr) {
+		h.fillInBackground(r, key)
+	}
+}
+
+// finishRangeResponse serves the requested ranges from a full response that
+// was fetched in their place. Responses that were too large to hold are sent
+// in full, as we have already started sending them.
+func (h *CacheHandler) finishRangeResponse(w http.ResponseWriter, r *http.Request, variant *Variant, key CacheKey, cr *CacheableResponse, hw *heldResponseWriter) {
+	if hw.released {
+		return
+	}
+
+	if !h.storeResponse(r, variant, key, cr) {
+		cr.Body = cr.stasher.Body()
+	}
+	cr.writeCachedResponse(w, r, cacheStatusMiss)
+}
+
+// canCacheFullResponse reports whether the whole of the response that a
+// partial response is part of could be cached, if it were fetched in full.
+func (h *CacheHandler) canCacheFullResponse(cr *CacheableResponse) bool {
+	if cr.StatusCode != http.StatusPartialContent {
+		return false
+	}
+
+	length, ok := contentRangeLength(cr.HttpHeader.Get("Content-Range"))
+	if !ok || length > h.maxBodySize {
+		return false
+	}
+
+	full := CacheableResponse{StatusCode: http.StatusOK, HttpHeader: cr.HttpHeader}
+	cacheable, _ := full.CacheStatus(h.getCurrentTime())
+	return cacheable
+}
+
+// refreshStaleResponse fetches a replacement for an expired response. When
+// the response has validators, the request is made conditional, and a 304
+// from the upstream extends the life of the existing response. When the
+// response allows stale-if-error, it is served in place of a server error.
+func (h *CacheHandler) refreshStaleResponse(w http.ResponseWriter, r *http.Request, variant *Variant, key CacheKey, stale CacheableResponse) {
+	conditional := stale.HasValidators()
+	isRange := isRangeRequest(r)
+
+	req := r
+	if isRange {
+		req = withoutRange(r)
+	}
+	if conditional {
+		if req == r {
+			req = r.Clone(r.Context())
+		}
+		stale.SetConditionalHeaders(req)
+	}
+
+	var hw *heldResponseWriter
+	var dest http.ResponseWriter = w
+	if isRange {
+		hw = newHeldResponseWriter(w, h.maxBodySize)
+		dest = hw
+	}
+
+	serveStaleOnError := stale.IsStaleIfError(h.getCurrentTime())
+	if serveStaleOnError {
+		// There's no need to wait for the upstream to be ready when we have a
+		// response to serve if it isn't.
+		req = req.WithContext(withStaleFallback(req.Context()))
+	}
+	iw := newInterceptingWriter(dest, func(statusCode int) bool {
+		return (statusCode == http.StatusNotModified && conditional) ||
+			(statusCode >= http.StatusInternalServerError && serveStaleOnError)
+	})
+
+	cr := NewCacheableResponse(iw, h.maxBodySize)
+	h.next.ServeHTTP(cr, req)
+
+	if !iw.intercepted {
+		if isRange {
+			h.finishRangeResponse(w, r, variant, key, cr, hw)
+		} else {
+			h.storeResponse(r, variant, key, cr)
+		}
+		return
+	}
+
+	if iw.statusCode == http.StatusNotModified {
+		slog.Debug("Revalidated stale response", "path", r.URL.Path, "key", key)
+		stale.UpdateHeaders(cr.HttpHeader)
+		h.storeResponse(r, variant, key, &stale)
+		stale.writeCachedResponse(w, r, cacheStatusRevalidated)
+		return
+	}
+
+	slog.Info("Serving stale response after upstream error", "path", r.URL.Path, "status", iw.statusCode, "age", stale.Age(h.getCurrentTime()))
+	stale.WriteStaleResponse(w, r)
+}
+
+func (h *CacheHandler) waitForCoalescedRequest(r *http.Request, done <-chan struct{}) bool {
+	timer := time.NewTimer(h.coalescingTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		slog.Debug("Timed out waiting for coalesced request", "path", r.URL.Path)
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (h *CacheHandler) revalidateInBackground(r *http.Request, key CacheKey, stale CacheableResponse) {
+	h.inBackground(r, key, func(req *http.Request) {
+		slog.Debug("Revalidating stale response in background", "path", req.URL.Path, "key", key)
+
+		h.refreshStaleResponse(newDiscardingResponseWriter(), req, NewVariantWithKeyRules(req, h.keyRules), key, stale)
+	})
+}
+
+// fillInBackground fetches the whole response for a range request, and adds
+// it to the cache.
+func (h *CacheHandler) fillInBackground(r *http.Request, key CacheKey) {
+	h.inBackground(withoutRange(r), key, func(req *http.Request) {
+		slog.Debug("Fetching full response in background", "path", req.URL.Path, "key", key)
+
+		cr := NewCacheableResponse(newDiscardingResponseWriter(), h.maxBodySize)
+		h.next.ServeHTTP(cr, req)
+		h.storeResponse(req, NewVariantWithKeyRules(req, h.keyRules), key, cr)
+	})
+}
+
+// inBackground runs fn with a copy of the request, unless something is
+// already running in the background for the same key.
+func (h *CacheHandler) inBackground(r *http.Request, key CacheKey, fn func(req *http.Request)) {
+	h.revalidatingLock.Lock()
+	defer h.revalidatingLock.Unlock()
+
+	if h.revalidating[key] {
+		return
+	}
+	h.revalidating[key] = true
+
+	// The original request will be finished with long before the background
+	// work completes, so we need a copy that won't be canceled along with it.
+	req := r.Clone(context.WithoutCancel(r.Context()))
+
+	go func() {
+		defer func() {
+			h.revalidatingLock.Lock()
+			delete(h.revalidating, key)
+			h.revalidatingLock.Unlock()
+		}()
+
+		fn(req)
+	}()
+}
+
+// storeResponse adds the response to the cache if it is cacheable, and
+// reports whether it did so.
+func (h *CacheHandler) storeResponse(r *http.Request, variant *Variant, key CacheKey, cr *CacheableResponse) bool {
+	now := h.getCurrentTime()
+
+	cacheable, lifetime := cr.CacheStatus(now)
+	if !cacheable {
+		return false
+	}
+
+	variant.SetResponseHeader(cr.HttpHeader)
+	cr.PrimaryKey = variant.PrimaryKey()
+	cr.VariantHeader = variant.VariantHeader()
+	cr.CreatedAt = now.Add(-cr.InitialAge(now))
+	cr.ExpiresAt = cr.CreatedAt.Add(lifetime)
+	cr.StaleWhileRevalidate, cr.StaleIfError = cr.StaleStatus()
+
+	encoded, err := cr.ToBuffer()
+	if err != nil {
+		slog.Error("Failed to encode response for caching", "path", r.URL.Path, "error", err)
+		return false
+	}
+
+	h.cache.Set(key, encoded, cr.RetainUntil(), responseCacheTags(r.Host, variant.URL(), cr.HttpHeader)...)
+	slog.Debug("Added response to cache", "path", r.URL.Path, "key", key, "expires", cr.ExpiresAt, "size", len(encoded))
+	return true
+}
+
+// clientAcceptsCachedResponse checks the request's Cache-Control directives.
+// A client can ask for the response to be revalidated with the upstream by
+// sending no-cache, or limit the age of the response it will accept with
+// max-age.
+func (h *CacheHandler) clientAcceptsCachedResponse(r *http.Request, response CacheableResponse, now time.Time) bool {
+	cc := ParseCacheControl(r.Header.Values("Cache-Control"))
+
+	if cc.Has("no-cache") {
+		return false
+	}
+
+	maxAge, ok := cc.Seconds("max-age")
+	return !ok || response.Age(now) <= maxAge
+}
+
 func (h *CacheHandler) shouldCacheRequest(r *http.Request) bool {
 	allowedMethod := r.Method == http.MethodGet || r.Method == http.MethodHead
 	isUpgrade := r.Header.Get("Connection") == "Upgrade" || r.Header.Get("Upgrade") == "websocket"
-	isRange := r.Header.Get("Range") != ""
 
-	return allowedMethod && !isUpgrade && !isRange
+	return allowedMethod && !isUpgrade
+}
+
+func isRangeRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.Header.Get("Range") != ""
+}
+
+// contentRangeLength returns the complete length of the response from a
+// Content-Range header, such as "bytes 0-1023/4096".
+func contentRangeLength(contentRange string) (int, bool) {
+	_, length, ok := strings.Cut(contentRange, "/")
+	if !ok || !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(length)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// withoutRange returns a copy of a range request that asks for the whole
+// response instead.
+func withoutRange(r *http.Request) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	return req
+}
+
+// interceptingWriter passes responses through to the underlying writer,
+// unless their status is one that should be intercepted. Intercepted
+// responses are discarded, so that a cached response can be served in their
+// place.
+type interceptingWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	intercept   func(statusCode int) bool
+	statusCode  int
+	intercepted bool
+}
+
+func newInterceptingWriter(w http.ResponseWriter, intercept func(statusCode int) bool) *interceptingWriter {
+	return &interceptingWriter{w: w, header: http.Header{}, intercept: intercept}
+}
+
+func (w *interceptingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *interceptingWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+
+	if w.intercept(statusCode) {
+		w.intercepted = true
+		return
+	}
+
+	for name, values := range w.header {
+		w.w.Header()[name] = values
+	}
+	w.w.WriteHeader(statusCode)
+}
+
+func (w *interceptingWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.intercepted {
+		return len(b), nil
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *interceptingWriter) Flush() {
+	if w.intercepted {
+		return
+	}
+
+	flusher, ok := w.w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// heldResponseWriter holds back a response until it is complete, so that we
+// can decide how to answer the request once we have seen all of it. If the
+// body grows beyond the limit, the response is released to the underlying
+// writer as it stands, and the rest of it is passed straight through.
+type heldResponseWriter struct {
+	w          http.ResponseWriter
+	header     http.Header
+	limit      int
+	statusCode int
+	body       bytes.Buffer
+	released   bool
+}
+
+func newHeldResponseWriter(w http.ResponseWriter, limit int) *heldResponseWriter {
+	return &heldResponseWriter{w: w, header: http.Header{}, limit: limit}
+}
+
+func (w *heldResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *heldResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *heldResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.released && w.body.Len()+len(b) > w.limit {
+		w.release()
+	}
+
+	if w.released {
+		return w.w.Write(b)
+	}
+
+	return w.body.Write(b)
+}
+
+func (w *heldResponseWriter) Flush() {
+	if !w.released {
+		return
+	}
+
+	flusher, ok := w.w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (w *heldResponseWriter) release() {
+	w.released = true
+
+	maps.Copy(w.w.Header(), w.header)
+	w.w.WriteHeader(cmp.Or(w.statusCode, http.StatusOK))
+
+	_, err := w.w.Write(w.body.Bytes())
+	if err != nil {
+		slog.Error("Error writing held response body", "error", err)
+	}
+	w.body.Reset()
+}
+
+// discardingResponseWriter is used for requests that have no client waiting
+// for the response, such as background revalidations.
+type discardingResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardingResponseWriter() *discardingResponseWriter {
+	return &discardingResponseWriter{header: http.Header{}}
+}
+
+func (w *discardingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardingResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardingResponseWriter) WriteHeader(statusCode int) {
 }
@@ -4,11 +4,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCacheHandler_caching(t *testing.T) {
@@ -26,9 +30,9 @@ func TestCacheHandler_caching(t *testing.T) {
 			[]string{"miss", "hit", "hit"},
 			1,
 		},
-		"cacheable with s-max-age": {
+		"cacheable with s-maxage": {
 			httptest.NewRequest("GET", "http://example.com", nil),
-			"public, s-max-age=60",
+			"public, s-maxage=60",
 			[]string{"Hello 1", "Hello 1", "Hello 1"},
 			[]string{"miss", "hit", "hit"},
 			1,
@@ -212,10 +216,16 @@ func TestCacheHandler_different_hosts(t *testing.T) {
 	assert.Equal(t, "hit", resp.Header().Get("X-Cache"))
 }
 
-func TestCacheHandler_range_requests_are_not_cached(t *testing.T) {
+func TestCacheHandler_range_requests_are_served_from_cache(t *testing.T) {
 	cache := newTestCache()
+	var lock sync.Mutex
+	requestedRanges := []string{}
 
 	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestedRanges = append(requestedRanges, r.Header.Get("Range"))
+		lock.Unlock()
+
 		w.Header().Set("Cache-Control", "public, max-age=60")
 		http.ServeFile(w, r, fixturePath("image.jpg"))
 	}))
@@ -228,7 +238,10 @@ func TestCacheHandler_range_requests_are_not_cached(t *testing.T) {
 	assert.Equal(t, http.StatusPartialContent, w.Code)
 	assert.Equal(t, "2", w.Header().Get("Content-Length"))
 	assert.Equal(t, fixtureContent("image.jpg")[:2], w.Body.Bytes())
-	assert.Equal(t, "bypass", w.Header().Get("X-Cache"))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+	// The full response is fetched in the background, to serve later ranges
+	require.Eventually(t, func() bool { return cache.Stats().Items == 1 }, time.Second, time.Millisecond)
 
 	w = httptest.NewRecorder()
 	r = httptest.NewRequest("GET", "/", nil)
@@ -237,8 +250,1001 @@ func TestCacheHandler_range_requests_are_not_cached(t *testing.T) {
 
 	assert.Equal(t, http.StatusPartialContent, w.Code)
 	assert.Equal(t, "4", w.Header().Get("Content-Length"))
+	assert.Equal(t, fmt.Sprintf("bytes 2-5/%d", fixtureLength("image.jpg")), w.Header().Get("Content-Range"))
 	assert.Equal(t, fixtureContent("image.jpg")[2:6], w.Body.Bytes())
-	assert.Equal(t, "bypass", w.Header().Get("X-Cache"))
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, fixtureContent("image.jpg"), w.Body.Bytes())
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"bytes=0-1", ""}, requestedRanges)
+}
+
+func TestCacheHandler_multiple_range_requests_are_served_from_cache(t *testing.T) {
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=0-1,5-6")
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges; boundary="))
+	assert.Contains(t, w.Body.String(), "Content-Range: bytes 0-1/10\r\nContent-Type: text/plain\r\n\r\n01\r\n")
+	assert.Contains(t, w.Body.String(), "Content-Range: bytes 5-6/10\r\nContent-Type: text/plain\r\n\r\n56\r\n")
+}
+
+func TestCacheHandler_range_requests_with_if_range(t *testing.T) {
+	tests := map[string]struct {
+		ifRange        string
+		expectedStatus int
+		expectedBody   string
+	}{
+		"matching etag":  {`"v1"`, http.StatusPartialContent, "01"},
+		"different etag": {`"v2"`, http.StatusOK, "0123456789"},
+		"matching date":  {"Mon, 01 Jan 2024 00:00:00 GMT", http.StatusPartialContent, "01"},
+		"older date":     {"Sun, 31 Dec 2023 00:00:00 GMT", http.StatusOK, "0123456789"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newTestCache()
+
+			handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "public, max-age=60")
+				w.Header().Set("Etag", `"v1"`)
+				w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+				_, _ = w.Write([]byte("0123456789"))
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Range", "bytes=0-1")
+			r.Header.Set("If-Range", tc.ifRange)
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+			assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+		})
+	}
+}
+
+func TestCacheHandler_range_requests_revalidate_the_full_response(t *testing.T) {
+	now := time.Now()
+	cache := newTestCache()
+	requests := []http.Header{}
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Header.Clone())
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	handler.getCurrentTime = func() time.Time { return now }
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	handler.getCurrentTime = func() time.Time { return now.Add(2 * time.Minute) }
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=2-3")
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "23", w.Body.String())
+	assert.Equal(t, "revalidated", w.Header().Get("X-Cache"))
+
+	assert.Len(t, requests, 2)
+	assert.Empty(t, requests[1].Get("Range"))
+	assert.Equal(t, `"v1"`, requests[1].Get("If-None-Match"))
+}
+
+func TestCacheHandler_range_requests_for_uncacheable_responses_are_passed_through(t *testing.T) {
+	tests := map[string]struct {
+		cacheControl string
+		body         string
+	}{
+		"not cacheable":      {"private", "0123456789"},
+		"too large to cache": {"public, max-age=60", strings.Repeat("0123456789", 1024)},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newTestCache()
+			var counter atomic.Int32
+
+			handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				counter.Add(1)
+				w.Header().Set("Cache-Control", tc.cacheControl)
+				w.Header().Set("X-Custom", "present")
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(tc.body))
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Range", "bytes=0-1")
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusPartialContent, w.Code)
+			assert.Equal(t, "01", w.Body.String())
+			assert.Equal(t, "present", w.Header().Get("X-Custom"))
+			assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+			assert.Never(t, func() bool { return counter.Load() > 1 }, 50*time.Millisecond, time.Millisecond,
+				"the full response should not be fetched when it can't be cached")
+			assert.Empty(t, cache.items)
+		})
+	}
+}
+
+func TestCacheHandler_range_requests_are_served_from_refreshed_responses_that_cannot_be_cached(t *testing.T) {
+	now := time.Now()
+	cache := newTestCache()
+	cacheControl := "public, max-age=60, stale-if-error=60"
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControl)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	handler.getCurrentTime = func() time.Time { return now }
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+	cacheControl = "private"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=2-3")
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "23", w.Body.String())
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_range_requests_for_sendfile_responses_are_left_to_sendfile(t *testing.T) {
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("X-Sendfile", "/path/to/file")
+	}))
+
+	for _, expected := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=0-1")
+		handler.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "/path/to/file", w.Header().Get("X-Sendfile"))
+		assert.Equal(t, expected, w.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheHandler_stale_while_revalidate(t *testing.T) {
+	cache := newTestCache()
+	var counter atomic.Int32
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := counter.Add(1)
+		w.Header().Set("Cache-Control", "public, max-age=60, stale-while-revalidate=30")
+		fmt.Fprintf(w, "Hello %d", count)
+	}))
+
+	doReq := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com", nil)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+
+	resp := doReq()
+	assert.Equal(t, "Hello 1", resp.Body.String())
+	assert.Equal(t, "miss", resp.Header().Get("X-Cache"))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+	resp = doReq()
+	assert.Equal(t, "Hello 1", resp.Body.String())
+	assert.Equal(t, "stale", resp.Header().Get("X-Cache"))
+
+	assert.Eventually(t, func() bool {
+		resp := doReq()
+		return resp.Header().Get("X-Cache") == "hit" && resp.Body.String() == "Hello 2"
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, int32(2), counter.Load())
+}
+
+func TestCacheHandler_stale_while_revalidate_expires_after_window(t *testing.T) {
+	cache := newTestCache()
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "public, max-age=60, stale-while-revalidate=30")
+		fmt.Fprintf(w, "Hello %d", counter)
+	}))
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(100 * time.Second) }
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "Hello 2", w.Body.String())
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_stale_if_error(t *testing.T) {
+	tests := map[string]struct {
+		elapsed          time.Duration
+		upstreamStatus   int
+		expectedStatus   int
+		expectedBody     string
+		expectedCacheHit string
+	}{
+		"upstream error within window": {
+			70 * time.Second, http.StatusInternalServerError, http.StatusOK, "Hello 1", "stale",
+		},
+		"upstream unavailable within window": {
+			70 * time.Second, http.StatusBadGateway, http.StatusOK, "Hello 1", "stale",
+		},
+		"upstream success within window": {
+			70 * time.Second, http.StatusOK, http.StatusOK, "Hello 2", "miss",
+		},
+		"upstream client error within window": {
+			70 * time.Second, http.StatusNotFound, http.StatusNotFound, "Hello 2", "miss",
+		},
+		"upstream error after window": {
+			400 * time.Second, http.StatusInternalServerError, http.StatusInternalServerError, "Hello 2", "miss",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newTestCache()
+			counter := 0
+
+			handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				counter++
+				w.Header().Set("Cache-Control", "public, max-age=60, stale-if-error=300")
+				if counter > 1 {
+					w.WriteHeader(tc.upstreamStatus)
+				}
+				fmt.Fprintf(w, "Hello %d", counter)
+			}))
+
+			now := time.Now()
+			handler.getCurrentTime = func() time.Time { return now }
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+			assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+			handler.getCurrentTime = func() time.Time { return now.Add(tc.elapsed) }
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+			assert.Equal(t, tc.expectedCacheHit, w.Header().Get("X-Cache"))
+		})
+	}
+}
+
+func TestCacheHandler_stale_if_error_does_not_wait_for_upstream_to_be_ready(t *testing.T) {
+	cache := newTestCache()
+	readiness := NewUpstreamReadiness()
+	readiness.SetReady(true)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60, stale-if-error=300")
+		_, _ = w.Write([]byte("Hello"))
+	})
+	handler := NewCacheHandler(cache, 1024, NewUpstreamReadinessHandler(readiness, 10*time.Second, "", upstream))
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+
+	readiness.SetReady(false)
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+	started := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello", w.Body.String())
+	assert.Equal(t, "stale", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_revalidates_expired_responses(t *testing.T) {
+	lastModified := "Wed, 21 Oct 2015 07:28:00 GMT"
+
+	tests := map[string]struct {
+		responseHeader     http.Header
+		expectedConditions http.Header
+	}{
+		"with etag": {
+			http.Header{"Etag": []string{`"abc"`}},
+			http.Header{"If-None-Match": []string{`"abc"`}},
+		},
+		"with last-modified": {
+			http.Header{"Last-Modified": []string{lastModified}},
+			http.Header{"If-Modified-Since": []string{lastModified}},
+		},
+		"with both": {
+			http.Header{"Etag": []string{`"abc"`}, "Last-Modified": []string{lastModified}},
+			http.Header{"If-None-Match": []string{`"abc"`}, "If-Modified-Since": []string{lastModified}},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cache := newTestCache()
+			counter := 0
+
+			handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				counter++
+				for name, values := range tc.responseHeader {
+					w.Header()[name] = values
+				}
+
+				if counter == 1 {
+					w.Header().Set("Cache-Control", "public, max-age=60")
+					fmt.Fprintf(w, "Hello %d", counter)
+					return
+				}
+
+				assert.Equal(t, tc.expectedConditions.Get("If-None-Match"), r.Header.Get("If-None-Match"))
+				assert.Equal(t, tc.expectedConditions.Get("If-Modified-Since"), r.Header.Get("If-Modified-Since"))
+
+				w.Header().Set("Cache-Control", "public, max-age=120")
+				w.WriteHeader(http.StatusNotModified)
+			}))
+
+			now := time.Now()
+			handler.getCurrentTime = func() time.Time { return now }
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+			assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+			handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			r.Header.Set("If-None-Match", `"from-client"`)
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "Hello 1", w.Body.String())
+			assert.Equal(t, "revalidated", w.Header().Get("X-Cache"))
+			assert.Equal(t, "public, max-age=120", w.Header().Get("Cache-Control"))
+
+			handler.getCurrentTime = func() time.Time { return now.Add(150 * time.Second) }
+
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+			assert.Equal(t, "Hello 1", w.Body.String())
+			assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+			assert.Equal(t, 2, counter)
+		})
+	}
+}
+
+func TestCacheHandler_revalidation_does_not_store_cookies(t *testing.T) {
+	cache := newTestCache()
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Etag", `"abc"`)
+
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.Header().Set("Set-Cookie", "session=1234; Path=/; HttpOnly")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "Hello %d", counter)
+	}))
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "revalidated", w.Header().Get("X-Cache"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "Hello 1", w.Body.String())
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Empty(t, w.Header().Get("Set-Cookie"), "cookies from a 304 should not be replayed")
+	assert.Equal(t, 2, counter)
+}
+
+func TestCacheHandler_revalidation_replaces_modified_responses(t *testing.T) {
+	cache := newTestCache()
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		etag := fmt.Sprintf(`"v%d"`, counter)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Etag", etag)
+
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "Hello %d", counter)
+	}))
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "Hello 2", w.Body.String())
+	assert.Equal(t, `"v2"`, w.Header().Get("Etag"))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "Hello 2", w.Body.String())
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_revalidated_response_honors_client_conditions(t *testing.T) {
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Etag", `"abc"`)
+
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintf(w, "Hello")
+	}))
+
+	now := time.Now()
+	handler.getCurrentTime = func() time.Time { return now }
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(70 * time.Second) }
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, "revalidated", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_coalesces_concurrent_misses(t *testing.T) {
+	cache := newTestCache()
+	release := make(chan struct{})
+	var counter atomic.Int32
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := counter.Add(1)
+		<-release
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "Hello %d", count)
+	}))
+
+	responses := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Go(func() {
+			handler.ServeHTTP(responses[i], httptest.NewRequest("GET", "http://example.com", nil))
+		})
+	}
+
+	key := NewVariant(httptest.NewRequest("GET", "http://example.com", nil)).CacheKey()
+	assert.Eventually(t, func() bool {
+		return coalescedWaiters(handler.coalescer, key) == len(responses)-1
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), counter.Load())
+
+	hits := map[string]int{}
+	for _, resp := range responses {
+		assert.Equal(t, "Hello 1", resp.Body.String())
+		hits[resp.Header().Get("X-Cache")]++
+	}
+	assert.Equal(t, map[string]int{"miss": 1, "collapsed": 4}, hits)
+}
+
+func TestCacheHandler_coalesced_requests_are_released_when_response_is_not_cacheable(t *testing.T) {
+	cache := newTestCache()
+	release := make(chan struct{})
+	var counter atomic.Int32
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := counter.Add(1)
+		w.Header().Set("Cache-Control", "private")
+		w.WriteHeader(http.StatusOK)
+		if count == 1 {
+			<-release
+		}
+		fmt.Fprintf(w, "Hello %d", count)
+	}))
+
+	leader := httptest.NewRecorder()
+	var wg sync.WaitGroup
+
+	wg.Go(func() { handler.ServeHTTP(leader, httptest.NewRequest("GET", "http://example.com", nil)) })
+	assert.Eventually(t, func() bool { return counter.Load() == 1 }, time.Second, time.Millisecond)
+
+	// The leader's headers show that its response can't be cached, so there's
+	// no point in waiting for the rest of it.
+	follower := httptest.NewRecorder()
+	handler.ServeHTTP(follower, httptest.NewRequest("GET", "http://example.com", nil))
+
+	assert.Equal(t, "Hello 2", follower.Body.String())
+	assert.Equal(t, "miss", follower.Header().Get("X-Cache"))
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, "Hello 1", leader.Body.String())
+
+	// Later requests don't wait for each other either
+	key := NewVariant(httptest.NewRequest("GET", "http://example.com", nil)).CacheKey()
+	_, isLeader := handler.coalescer.Join(key, time.Now())
+	assert.False(t, isLeader)
+}
+
+func TestCacheHandler_coalesced_requests_respect_client_cache_control(t *testing.T) {
+	cache := newTestCache()
+	release := make(chan struct{})
+	var counter atomic.Int32
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := counter.Add(1)
+		if count == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "Hello %d", count)
+	}))
+
+	leader := httptest.NewRecorder()
+	follower := httptest.NewRecorder()
+	var wg sync.WaitGroup
+
+	wg.Go(func() { handler.ServeHTTP(leader, httptest.NewRequest("GET", "http://example.com", nil)) })
+	assert.Eventually(t, func() bool { return counter.Load() == 1 }, time.Second, time.Millisecond)
+
+	key := NewVariant(httptest.NewRequest("GET", "http://example.com", nil)).CacheKey()
+	wg.Go(func() {
+		r := httptest.NewRequest("GET", "http://example.com", nil)
+		r.Header.Set("Cache-Control", "no-cache")
+		handler.ServeHTTP(follower, r)
+	})
+	assert.Eventually(t, func() bool { return coalescedWaiters(handler.coalescer, key) == 1 }, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, "Hello 1", leader.Body.String())
+	assert.Equal(t, "Hello 2", follower.Body.String())
+	assert.Equal(t, "miss", follower.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_coalesced_requests_are_proxied_after_timeout(t *testing.T) {
+	cache := newTestCache()
+	release := make(chan struct{})
+	var counter atomic.Int32
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := counter.Add(1)
+		if count == 1 {
+			<-release
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "Hello %d", count)
+	}))
+	handler.coalescingTimeout = 10 * time.Millisecond
+
+	leader := httptest.NewRecorder()
+	var wg sync.WaitGroup
+
+	wg.Go(func() { handler.ServeHTTP(leader, httptest.NewRequest("GET", "http://example.com", nil)) })
+	assert.Eventually(t, func() bool { return counter.Load() == 1 }, time.Second, time.Millisecond)
+
+	follower := httptest.NewRecorder()
+	handler.ServeHTTP(follower, httptest.NewRequest("GET", "http://example.com", nil))
+
+	assert.Equal(t, "Hello 2", follower.Body.String())
+	assert.Equal(t, "miss", follower.Header().Get("X-Cache"))
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, "Hello 1", leader.Body.String())
+}
+
+func TestCacheHandler_client_cache_control(t *testing.T) {
+	tests := map[string]struct {
+		cacheControl string
+		expected     string
+	}{
+		"no directives":             {"", "hit"},
+		"no-cache":                  {"no-cache", "miss"},
+		"max-age of zero":           {"max-age=0", "miss"},
+		"max-age older than cached": {"max-age=10", "miss"},
+		"max-age newer than cached": {"max-age=60", "hit"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			cache := newTestCache()
+
+			handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "public, max-age=600")
+				_, _ = w.Write([]byte("Hello"))
+			}))
+			handler.getCurrentTime = func() time.Time { return now }
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+			handler.getCurrentTime = func() time.Time { return now.Add(30 * time.Second) }
+
+			r := httptest.NewRequest("GET", "http://example.com", nil)
+			if tc.cacheControl != "" {
+				r.Header.Set("Cache-Control", tc.cacheControl)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.expected, w.Header().Get("X-Cache"))
+		})
+	}
+}
+
+func TestCacheHandler_client_no_cache_revalidates_with_upstream(t *testing.T) {
+	cache := newTestCache()
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte("Hello"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+
+	r := httptest.NewRequest("GET", "http://example.com", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, 2, counter)
+	assert.Equal(t, "revalidated", w.Header().Get("X-Cache"))
+	assert.Equal(t, "Hello", w.Body.String())
+}
+
+func TestCacheHandler_age_includes_upstream_age(t *testing.T) {
+	now := time.Now()
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Age", "50")
+		_, _ = w.Write([]byte("Hello"))
+	}))
+	handler.getCurrentTime = func() time.Time { return now }
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(5 * time.Second) }
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(15 * time.Second) }
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_surrogate_control_is_not_sent_to_clients(t *testing.T) {
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=0")
+		w.Header().Set("Surrogate-Control", "max-age=60")
+		_, _ = w.Write([]byte("Hello"))
+	}))
+
+	for _, expected := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com", nil))
+
+		assert.Equal(t, expected, w.Header().Get("X-Cache"))
+		assert.Equal(t, "private, max-age=0", w.Header().Get("Cache-Control"))
+		assert.Empty(t, w.Header().Get("Surrogate-Control"))
+	}
+}
+
+func TestCacheHandler_key_rules(t *testing.T) {
+	cache := NewMemoryCache(1*MB, 1*MB)
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		fmt.Fprintf(w, "Hello %d", counter)
+	}))
+	handler.keyRules = CacheKeyRules{IgnoreQueryParams: []string{"utm_*"}}
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	assert.Equal(t, "miss", serve("http://example.com/articles?utm_source=news&page=2").Header().Get("X-Cache"))
+
+	w := serve("http://example.com/articles?page=2&utm_source=social")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Equal(t, "Hello 1", w.Body.String())
+
+	u, _ := url.Parse("http://example.com/articles?page=2")
+	assert.Equal(t, 1, cache.DeleteTagged(matchURL("example.com", u)))
+	assert.Equal(t, "miss", serve("http://example.com/articles?page=2").Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_responses_can_be_purged_by_tag(t *testing.T) {
+	cache := NewMemoryCache(1*MB, 1*MB)
+	counter := 0
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counter++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Surrogate-Key", "articles")
+		fmt.Fprintf(w, "Hello %d", counter)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/articles", nil))
+		return w
+	}
+
+	serve()
+	assert.Equal(t, "hit", serve().Header().Get("X-Cache"))
+
+	assert.Equal(t, 1, cache.DeleteTagged(matchSurrogateKey("articles")))
+
+	w := serve()
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+	assert.Equal(t, "Hello 2", w.Body.String())
+
+	assert.Equal(t, 1, cache.DeleteTagged(matchPathPrefix("example.com", "/articles")))
+	assert.Equal(t, "miss", serve().Header().Get("X-Cache"))
+}
+
+func TestCacheHandler_records_request_stats(t *testing.T) {
+	cache := newTestCache()
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		_, _ = w.Write([]byte("Hello"))
+	}))
+	handler.stats = NewCacheRequestStats()
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://example.com", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "http://example.com", nil))
+
+	counts := handler.stats.Counts()
+	assert.Equal(t, int64(1), counts[cacheStatusMiss])
+	assert.Equal(t, int64(2), counts[cacheStatusHit])
+	assert.Equal(t, int64(1), counts[cacheStatusBypass])
+}
+
+func TestCacheHandler_key_collisions_are_treated_as_misses(t *testing.T) {
+	cache := &collidingTestCache{newTestCache()}
+
+	handler := NewCacheHandler(cache, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		fmt.Fprintf(w, "Hello from %s", r.URL.Path)
+	}))
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+
+	assert.Equal(t, "miss", serve("http://example.com/one").Header().Get("X-Cache"))
+	assert.Equal(t, "hit", serve("http://example.com/one").Header().Get("X-Cache"))
+
+	w := serve("http://example.com/two")
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+	assert.Equal(t, "Hello from /two", w.Body.String())
+
+	w = serve("http://example.com/one")
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+	assert.Equal(t, "Hello from /one", w.Body.String())
+}
+
+func TestCacheHandler_compressed_copies_follow_the_cached_response(t *testing.T) {
+	cache := NewMemoryCache(1*MB, 1*MB)
+	now := time.Now()
+	version := "first"
+
+	handler := NewCacheHandler(cache, 1*MB, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(strings.Repeat(version, 1000)))
+	}))
+	handler.compressor = newCacheCompressor(CompressionOptions{})
+	handler.getCurrentTime = func() time.Time { return now }
+
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Misses are passed through as they are, for the CompressionHandler.
+	w := serve("gzip")
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	w = serve("gzip")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	_, body := gunzipWithComment(t, w.Body.Bytes())
+	assert.Equal(t, strings.Repeat("first", 1000), string(body))
+
+	handler.getCurrentTime = func() time.Time { return now.Add(2 * time.Minute) }
+	version = "second"
+	assert.Equal(t, "miss", serve("gzip").Header().Get("X-Cache"))
+
+	w = serve("gzip")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	_, body = gunzipWithComment(t, w.Body.Bytes())
+	assert.Equal(t, strings.Repeat("second", 1000), string(body))
+
+	assert.Equal(t, 2, cache.DeleteTagged(matchURL("example.com", &url.URL{Path: "/"})))
+}
+
+func TestCacheHandler_small_responses_are_not_compressed(t *testing.T) {
+	cache := NewMemoryCache(1*MB, 1*MB)
+
+	handler := NewCacheHandler(cache, 1*MB, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		_, _ = w.Write([]byte("Hello"))
+	}))
+	handler.compressor = newCacheCompressor(CompressionOptions{})
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(w, r)
+
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Hello", w.Body.String())
+	}
+
+	assert.Equal(t, 1, cache.Stats().Items)
+}
+
+func TestCacheHandler_compression_follows_the_compression_policy(t *testing.T) {
+	cache := NewMemoryCache(1*MB, 1*MB)
+	body := strings.Repeat("A", 2000)
+
+	handler := NewCacheHandler(cache, 1*MB, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		if r.URL.Query().Has("no-transform") {
+			w.Header().Add("Cache-Control", "no-transform")
+		}
+		if r.URL.Query().Has("opt-out") {
+			w.Header().Set("X-No-Compression", "1")
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	handler.compressor = newCacheCompressor(CompressionOptions{
+		excludedContentTypes: []string{"font/*"},
+		optOutHeader:         "X-No-Compression",
+	})
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, target := range []string{"/?type=font/woff2", "/?type=text/plain&no-transform", "/?type=text/plain&opt-out"} {
+		serve(target)
+
+		w := serve(target)
+		assert.Equal(t, "hit", w.Header().Get("X-Cache"), target)
+		assert.Empty(t, w.Header().Get("Content-Encoding"), target)
+		assert.Equal(t, body, w.Body.String(), target)
+	}
+
+	w := serve("/?type=text/plain")
+	assert.Equal(t, "miss", w.Header().Get("X-Cache"))
+	w = serve("/?type=text/plain")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
 }
 
 func BenchmarkCacheHandler_retrieving(b *testing.B) {
@@ -259,6 +1265,7 @@ func BenchmarkCacheHandler_retrieving(b *testing.B) {
 // Mocks
 
 type testCache struct {
+	sync.Mutex
 	items map[CacheKey][]byte
 }
 
@@ -267,10 +1274,63 @@ func newTestCache() *testCache {
 }
 
 func (t *testCache) Get(key CacheKey) ([]byte, bool) {
+	t.Lock()
+	defer t.Unlock()
+
 	item, found := t.items[key]
 	return item, found
 }
 
-func (t *testCache) Set(key CacheKey, value []byte, expiresAt time.Time) {
+func (t *testCache) Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string) {
+	t.Lock()
+	defer t.Unlock()
+
 	t.items[key] = value
 }
+
+func (t *testCache) Delete(key CacheKey) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	_, found := t.items[key]
+	delete(t.items, key)
+	return found
+}
+
+func (t *testCache) DeleteTagged(match CacheTagMatcher) int {
+	return 0
+}
+
+func (t *testCache) Stats() CacheStats {
+	t.Lock()
+	defer t.Unlock()
+
+	return CacheStats{Items: len(t.items)}
+}
+
+func (t *testCache) Entries() []CacheEntryInfo {
+	return nil
+}
+
+func (t *testCache) Clear() int {
+	t.Lock()
+	defer t.Unlock()
+
+	count := len(t.items)
+	clear(t.items)
+	return count
+}
+
+// collidingTestCache stores every item under the same key, as if they all had
+// the same hash.
+type collidingTestCache struct {
+	*testCache
+}
+
+func (t *collidingTestCache) Get(key CacheKey) ([]byte, bool) {
+	return t.testCache.Get(0)
+}
+
+func (t *collidingTestCache) Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string) {
+	t.testCache.Set(0, value, expiresAt, tags...)
+}
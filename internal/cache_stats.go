@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats describes the contents of a cache, along with how many items
+// have been stored in it and evicted from it.
+type CacheStats struct {
+	Items         int                `json:"items"`
+	SizeBytes     int                `json:"size_bytes"`
+	CapacityBytes int                `json:"capacity_bytes"`
+	Stores        int64              `json:"stores"`
+	Evictions     CacheEvictionStats `json:"evictions"`
+}
+
+// CacheEvictionStats counts the items removed to make space, by whether they
+// had expired or were still fresh, along with the items that were never
+// stored because they were too large, or because the eviction policy did not
+// consider them worth the space.
+type CacheEvictionStats struct {
+	Expired  int64 `json:"expired"`
+	Capacity int64 `json:"capacity"`
+	TooLarge int64 `json:"too_large"`
+	Rejected int64 `json:"rejected"`
+}
+
+// CacheEntryInfo describes a single item in a cache.
+type CacheEntryInfo struct {
+	Key       CacheKey
+	Size      int
+	Hits      int64
+	ExpiresAt time.Time
+	Tags      []string
+}
+
+func (s CacheStats) add(other CacheStats) CacheStats {
+	return CacheStats{
+		Items:         s.Items + other.Items,
+		SizeBytes:     s.SizeBytes + other.SizeBytes,
+		CapacityBytes: s.CapacityBytes + other.CapacityBytes,
+		Stores:        s.Stores + other.Stores,
+		Evictions: CacheEvictionStats{
+			Expired:  s.Evictions.Expired + other.Evictions.Expired,
+			Capacity: s.Evictions.Capacity + other.Evictions.Capacity,
+			TooLarge: s.Evictions.TooLarge + other.Evictions.TooLarge,
+			Rejected: s.Evictions.Rejected + other.Evictions.Rejected,
+		},
+	}
+}
+
+func (s *CacheEvictionStats) recordEviction(expired bool) {
+	if expired {
+		s.Expired++
+	} else {
+		s.Capacity++
+	}
+}
+
+// CacheRequestStats counts the requests handled by the CacheHandler, by the
+// cache status they were served with.
+type CacheRequestStats struct {
+	counts map[string]*atomic.Int64
+}
+
+var cacheRequestStatuses = []string{
+	cacheStatusHit, cacheStatusMiss, cacheStatusStale, cacheStatusRevalidated, cacheStatusCollapsed, cacheStatusBypass,
+}
+
+func NewCacheRequestStats() *CacheRequestStats {
+	s := &CacheRequestStats{counts: map[string]*atomic.Int64{}}
+	for _, status := range cacheRequestStatuses {
+		s.counts[status] = &atomic.Int64{}
+	}
+
+	return s
+}
+
+// Record counts a request. It can be called on a nil CacheRequestStats, in
+// which case nothing is recorded.
+func (s *CacheRequestStats) Record(cacheStatus string) {
+	if s == nil {
+		return
+	}
+
+	count, ok := s.counts[cacheStatus]
+	if ok {
+		count.Add(1)
+	}
+}
+
+func (s *CacheRequestStats) Counts() map[string]int64 {
+	counts := map[string]int64{}
+	for status, count := range s.counts {
+		counts[status] = count.Load()
+	}
+
+	return counts
+}
+
+// HitRatio is the proportion of cacheable requests that were answered with a
+// cached response. Revalidated responses count as hits, since their bodies
+// came from the cache.
+func (s *CacheRequestStats) HitRatio() float64 {
+	counts := s.Counts()
+
+	hits := counts[cacheStatusHit] + counts[cacheStatusStale] + counts[cacheStatusRevalidated] + counts[cacheStatusCollapsed]
+	total := hits + counts[cacheStatusMiss]
+	if total == 0 {
+		return 0
+	}
+
+	return float64(hits) / float64(total)
+}
+
+// logCacheStats logs a summary of the cache's activity at every interval,
+// until the returned function is called.
+func logCacheStats(interval time.Duration, cache Cache, requestStats *CacheRequestStats) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				stats := cache.Stats()
+				counts := requestStats.Counts()
+
+				slog.Info("Cache stats",
+					"hit_ratio", requestStats.HitRatio(),
+					"hits", counts[cacheStatusHit],
+					"misses", counts[cacheStatusMiss],
+					"stale", counts[cacheStatusStale],
+					"revalidated", counts[cacheStatusRevalidated],
+					"collapsed", counts[cacheStatusCollapsed],
+					"bypasses", counts[cacheStatusBypass],
+					"items", stats.Items,
+					"size", stats.SizeBytes,
+					"capacity", stats.CapacityBytes,
+					"stores", stats.Stores,
+					"evicted_expired", stats.Evictions.Expired,
+					"evicted_capacity", stats.Evictions.Capacity,
+					"rejected_too_large", stats.Evictions.TooLarge,
+					"rejected_by_policy", stats.Evictions.Rejected)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
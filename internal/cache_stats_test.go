@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheRequestStats_hit_ratio(t *testing.T) {
+	s := NewCacheRequestStats()
+	assert.Equal(t, 0.0, s.HitRatio())
+
+	for _, status := range []string{cacheStatusHit, cacheStatusStale, cacheStatusRevalidated, cacheStatusCollapsed, cacheStatusMiss, cacheStatusBypass, "unknown"} {
+		s.Record(status)
+	}
+
+	assert.Equal(t, 0.8, s.HitRatio())
+	assert.NotContains(t, s.Counts(), "unknown")
+}
+
+func TestCacheRequestStats_nil_stats_are_ignored(t *testing.T) {
+	var s *CacheRequestStats
+	assert.NotPanics(t, func() { s.Record(cacheStatusHit) })
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Cached items can be tagged, so that they can be found and purged without
+// knowing their keys. Every response cached by the CacheHandler is tagged with
+// its URL, along with any surrogate keys that the upstream provided.
+const (
+	urlCacheTagPrefix       = "url:"
+	surrogateCacheTagPrefix = "key:"
+)
+
+type CacheTagMatcher func(tag string) bool
+
+// urlCacheTag tags a response with the URL it was cached for. Hosts are case
+// insensitive, so they are lowercased in the same way as for the cache key.
+func urlCacheTag(host string, u *url.URL) string {
+	tag := urlCacheTagPrefix + strings.ToLower(host) + u.Path
+
+	query := u.RawQuery
+	params, err := url.ParseQuery(query)
+	if err == nil {
+		query = params.Encode()
+	}
+	if query != "" {
+		tag += "?" + query
+	}
+
+	return tag
+}
+
+// cacheTagURL returns the URL that a cached item was tagged with, without its
+// scheme.
+func cacheTagURL(tags []string) string {
+	for _, tag := range tags {
+		location, ok := strings.CutPrefix(tag, urlCacheTagPrefix)
+		if ok {
+			return location
+		}
+	}
+
+	return ""
+}
+
+func surrogateCacheTag(key string) string {
+	return surrogateCacheTagPrefix + key
+}
+
+// responseCacheTags returns the tags for a response cached for the given URL.
+// Surrogate keys can be given in either a space-separated Surrogate-Key
+// header, or a comma-separated Cache-Tag header.
+func responseCacheTags(host string, u *url.URL, header http.Header) []string {
+	tags := []string{urlCacheTag(host, u)}
+
+	for _, value := range header.Values("Surrogate-Key") {
+		for key := range strings.FieldsSeq(value) {
+			tags = append(tags, surrogateCacheTag(key))
+		}
+	}
+
+	for _, value := range header.Values("Cache-Tag") {
+		for key := range strings.SplitSeq(value, ",") {
+			key = strings.TrimSpace(key)
+			if key != "" {
+				tags = append(tags, surrogateCacheTag(key))
+			}
+		}
+	}
+
+	return tags
+}
+
+func matchURL(host string, u *url.URL) CacheTagMatcher {
+	expected := urlCacheTag(host, u)
+
+	return func(tag string) bool {
+		return tag == expected
+	}
+}
+
+// matchPathPrefix matches the URLs with a path starting with prefix. If host
+// is empty, URLs on any host will match.
+func matchPathPrefix(host string, prefix string) CacheTagMatcher {
+	host = strings.ToLower(host)
+
+	return func(tag string) bool {
+		location, ok := strings.CutPrefix(tag, urlCacheTagPrefix)
+		if !ok {
+			return false
+		}
+
+		index := strings.Index(location, "/")
+		if index < 0 {
+			return false
+		}
+
+		if host != "" && location[:index] != host {
+			return false
+		}
+
+		return strings.HasPrefix(location[index:], prefix)
+	}
+}
+
+func matchSurrogateKey(key string) CacheTagMatcher {
+	expected := surrogateCacheTag(key)
+
+	return func(tag string) bool {
+		return tag == expected
+	}
+}
+
+type cacheTagIndex map[string]map[CacheKey]struct{}
+
+func (i cacheTagIndex) add(key CacheKey, tags []string) {
+	for _, tag := range tags {
+		keys, ok := i[tag]
+		if !ok {
+			keys = map[CacheKey]struct{}{}
+			i[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (i cacheTagIndex) remove(key CacheKey, tags []string) {
+	for _, tag := range tags {
+		keys, ok := i[tag]
+		if ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(i, tag)
+			}
+		}
+	}
+}
+
+func (i cacheTagIndex) matching(match CacheTagMatcher) []CacheKey {
+	found := map[CacheKey]struct{}{}
+
+	for tag, keys := range i {
+		if match(tag) {
+			for key := range keys {
+				found[key] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]CacheKey, 0, len(found))
+	for key := range found {
+		result = append(result, key)
+	}
+
+	return result
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheTags_response_tags(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/articles?page=2&order=new", nil)
+
+	header := http.Header{}
+	header.Add("Surrogate-Key", "articles  article-1")
+	header.Add("Cache-Tag", "home, ,sidebar")
+
+	tags := responseCacheTags(r.Host, r.URL, header)
+
+	assert.Equal(t, []string{
+		"url:example.com/articles?order=new&page=2",
+		"key:articles",
+		"key:article-1",
+		"key:home",
+		"key:sidebar",
+	}, tags)
+}
+
+func TestCacheTags_match_url(t *testing.T) {
+	u, _ := url.Parse("http://example.com/articles?page=2&order=new")
+	match := matchURL("example.com", u)
+
+	assert.True(t, match("url:example.com/articles?order=new&page=2"))
+	assert.False(t, match("url:example.com/articles"))
+	assert.False(t, match("url:other.com/articles?order=new&page=2"))
+}
+
+func TestCacheTags_keep_malformed_queries(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/p?q=%zz", nil)
+
+	assert.Equal(t, []string{"url:example.com/p?q=%zz"}, responseCacheTags(r.Host, r.URL, http.Header{}))
+}
+
+func TestCacheTags_hosts_are_case_insensitive(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://Example.COM/articles", nil)
+	tags := responseCacheTags(r.Host, r.URL, http.Header{})
+
+	assert.Equal(t, []string{"url:example.com/articles"}, tags)
+	assert.True(t, matchURL("EXAMPLE.com", r.URL)(tags[0]))
+}
+
+func TestCacheTags_match_path_prefix(t *testing.T) {
+	tests := map[string]struct {
+		host     string
+		prefix   string
+		tag      string
+		expected bool
+	}{
+		"matching prefix":          {"", "/articles", "url:example.com/articles/1", true},
+		"matching prefix and host": {"example.com", "/articles", "url:example.com/articles/1", true},
+		"different host":           {"other.com", "/articles", "url:example.com/articles/1", false},
+		"host in a different case": {"Example.COM", "/articles", "url:example.com/articles/1", true},
+		"different prefix":         {"", "/admin", "url:example.com/articles/1", false},
+		"surrogate key":            {"", "/articles", "key:/articles", false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, matchPathPrefix(tc.host, tc.prefix)(tc.tag))
+		})
+	}
+}
+
+func TestCacheTags_index(t *testing.T) {
+	index := cacheTagIndex{}
+	index.add(1, []string{"key:a", "key:b"})
+	index.add(2, []string{"key:b"})
+
+	assert.ElementsMatch(t, []CacheKey{1, 2}, index.matching(matchSurrogateKey("b")))
+	assert.ElementsMatch(t, []CacheKey{1, 2}, index.matching(func(string) bool { return true }))
+
+	index.remove(1, []string{"key:a", "key:b"})
+	assert.Empty(t, index.matching(matchSurrogateKey("a")))
+	assert.Equal(t, cacheTagIndex{"key:b": {2: {}}}, index)
+}
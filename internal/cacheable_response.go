@@ -2,33 +2,55 @@ package internal
 
 import (
 	"bytes"
-	"encoding/gob"
 	"io"
 	"log/slog"
 	"maps"
 	"net/http"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var (
-	publicExp   = regexp.MustCompile(`\bpublic\b`)
-	noCacheExpt = regexp.MustCompile(`\bno-cache\b`)
-	sMaxAgeExp  = regexp.MustCompile(`\bs-max-age=(\d+)\b`)
-	maxAgeExp   = regexp.MustCompile(`\bmax-age=(\d+)\b`)
+// How long to keep a response that has validators beyond its expiry, so that
+// it can be revalidated with the upstream rather than fetched again in full.
+const revalidationRetention = 1 * time.Hour
+
+// Headers that must not be updated from a 304 response: those that describe
+// the stored body, and cookies, which are meant only for the client that made
+// the request and would otherwise be replayed to everyone.
+var notModifiedExcludedHeaders = []string{
+	"Content-Encoding", "Content-Length", "Content-Range", "Transfer-Encoding", "Set-Cookie",
+}
+
+const (
+	cacheStatusHit         = "hit"
+	cacheStatusMiss        = "miss"
+	cacheStatusStale       = "stale"
+	cacheStatusRevalidated = "revalidated"
+	cacheStatusCollapsed   = "collapsed"
+	cacheStatusBypass      = "bypass"
 )
 
 type CacheableResponse struct {
+	PrimaryKey    string
 	StatusCode    int
 	HttpHeader    http.Header
 	Body          []byte
 	VariantHeader http.Header
 
+	CreatedAt            time.Time
+	ExpiresAt            time.Time
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
 	responseWriter http.ResponseWriter
 	stasher        *stashingWriter
 	headersWritten bool
+
+	// onUncacheable is called as soon as the response headers show that the
+	// response can't be cached, before its body is written.
+	onUncacheable func()
 }
 
 func NewCacheableResponse(w http.ResponseWriter, maxBodyLength int) *CacheableResponse {
@@ -41,24 +63,6 @@ func NewCacheableResponse(w http.ResponseWriter, maxBodyLength int) *CacheableRe
 	}
 }
 
-func CacheableResponseFromBuffer(b []byte) (CacheableResponse, error) {
-	var cr CacheableResponse
-	decoder := gob.NewDecoder(bytes.NewReader(b))
-	err := decoder.Decode(&cr)
-
-	return cr, err
-}
-
-func (c *CacheableResponse) ToBuffer() ([]byte, error) {
-	c.Body = c.stasher.Body()
-
-	var b bytes.Buffer
-	encoder := gob.NewEncoder(&b)
-	err := encoder.Encode(c)
-
-	return b.Bytes(), err
-}
-
 func (c *CacheableResponse) Header() http.Header {
 	return c.HttpHeader
 }
@@ -72,8 +76,12 @@ func (c *CacheableResponse) Write(bytes []byte) (int, error) {
 
 func (c *CacheableResponse) WriteHeader(statusCode int) {
 	c.StatusCode = statusCode
-	c.scrubHeaders()
-	c.copyHeaders(c.responseWriter, false, c.StatusCode)
+	cacheable := c.scrubHeaders()
+	if !cacheable && c.onUncacheable != nil {
+		c.onUncacheable()
+	}
+
+	c.copyHeaders(c.responseWriter, cacheStatusMiss, c.StatusCode)
 	c.headersWritten = true
 }
 
@@ -84,56 +92,176 @@ func (c *CacheableResponse) Flush() {
 	}
 }
 
-func (c *CacheableResponse) CacheStatus() (bool, time.Time) {
-	if c.stasher.Overflowed() {
-		return false, time.Time{}
+// CacheStatus reports whether the response can be cached, and if so, for how
+// long it will remain fresh, measured from when it was generated.
+func (c *CacheableResponse) CacheStatus(now time.Time) (bool, time.Duration) {
+	if c.stasher != nil && c.stasher.Overflowed() {
+		return false, 0
 	}
 
-	if c.StatusCode < 200 || c.StatusCode > 399 || c.StatusCode == http.StatusNotModified {
-		return false, time.Time{}
+	if c.StatusCode < 200 || c.StatusCode > 399 || c.StatusCode == http.StatusNotModified || c.StatusCode == http.StatusPartialContent {
+		return false, 0
 	}
 
 	if strings.Contains(c.HttpHeader.Get("Vary"), "*") {
-		return false, time.Time{}
+		return false, 0
+	}
+
+	lifetime, ok := c.freshnessLifetime(now)
+	if !ok || lifetime <= c.InitialAge(now) {
+		return false, 0
+	}
+
+	return true, lifetime
+}
+
+// StaleStatus returns how long after expiry the response may be served while
+// it is revalidated in the background, and how long it may be served in place
+// of an error from the upstream. Responses that must be revalidated can't be
+// served stale at all.
+func (c *CacheableResponse) StaleStatus() (time.Duration, time.Duration) {
+	cc, _ := c.cacheDirectives()
+
+	if cc.Has("must-revalidate") || cc.Has("proxy-revalidate") {
+		return 0, 0
 	}
 
-	cc := c.HttpHeader.Get("Cache-Control")
+	staleWhileRevalidate, _ := cc.Seconds("stale-while-revalidate")
+	staleIfError, _ := cc.Seconds("stale-if-error")
+
+	return staleWhileRevalidate, staleIfError
+}
+
+// InitialAge is the age the response already had when we received it, either
+// from its time in other caches, or its time in transit.
+func (c *CacheableResponse) InitialAge(now time.Time) time.Duration {
+	var age time.Duration
+
+	if date, err := http.ParseTime(c.HttpHeader.Get("Date")); err == nil {
+		age = max(now.Sub(date), 0)
+	}
 
-	if !publicExp.MatchString(cc) || noCacheExpt.MatchString(cc) {
-		return false, time.Time{}
+	if ageValue, ok := parseDeltaSeconds(c.HttpHeader.Get("Age")); ok {
+		age = max(age, ageValue)
 	}
 
-	matches := sMaxAgeExp.FindStringSubmatch(cc)
-	if len(matches) != 2 {
-		matches = maxAgeExp.FindStringSubmatch(cc)
+	return age
+}
+
+func (c *CacheableResponse) Age(now time.Time) time.Duration {
+	return max(now.Sub(c.CreatedAt), 0)
+}
+
+func (c *CacheableResponse) IsFresh(now time.Time) bool {
+	return now.Before(c.ExpiresAt)
+}
+
+func (c *CacheableResponse) IsStaleWhileRevalidate(now time.Time) bool {
+	return !c.IsFresh(now) && now.Before(c.ExpiresAt.Add(c.StaleWhileRevalidate))
+}
+
+func (c *CacheableResponse) IsStaleIfError(now time.Time) bool {
+	return !c.IsFresh(now) && now.Before(c.ExpiresAt.Add(c.StaleIfError))
+}
+
+// HasValidators reports whether the response can be revalidated with a
+// conditional request.
+func (c *CacheableResponse) HasValidators() bool {
+	return c.HttpHeader.Get("Etag") != "" || c.HttpHeader.Get("Last-Modified") != ""
+}
+
+// SetConditionalHeaders replaces any conditional headers in the request with
+// the validators from this response, so that a 304 from the upstream means
+// that this response is still current.
+func (c *CacheableResponse) SetConditionalHeaders(r *http.Request) {
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+
+	if etag := c.HttpHeader.Get("Etag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := c.HttpHeader.Get("Last-Modified"); lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
 	}
-	if len(matches) != 2 {
-		return false, time.Time{}
+}
+
+// UpdateHeaders merges in the headers from a 304 response that confirmed this
+// response is still current.
+func (c *CacheableResponse) UpdateHeaders(header http.Header) {
+	for name, values := range header {
+		if !slices.Contains(notModifiedExcludedHeaders, name) {
+			c.HttpHeader[name] = values
+		}
 	}
+}
 
-	maxAge, err := strconv.Atoi(matches[1])
-	if err != nil || maxAge <= 0 {
-		return false, time.Time{}
+// RetainUntil is the time until which the response should be kept in the
+// cache, including any period in which it may be served stale or revalidated.
+func (c *CacheableResponse) RetainUntil() time.Time {
+	retention := max(c.StaleWhileRevalidate, c.StaleIfError)
+	if c.HasValidators() {
+		retention = max(retention, revalidationRetention)
 	}
 
-	return true, time.Now().Add(time.Duration(maxAge) * time.Second)
+	return c.ExpiresAt.Add(retention)
 }
 
 func (c *CacheableResponse) WriteCachedResponse(w http.ResponseWriter, r *http.Request) {
+	c.writeCachedResponse(w, r, cacheStatusHit)
+}
+
+func (c *CacheableResponse) WriteStaleResponse(w http.ResponseWriter, r *http.Request) {
+	c.writeCachedResponse(w, r, cacheStatusStale)
+}
+
+// Private
+
+func (c *CacheableResponse) writeCachedResponse(w http.ResponseWriter, r *http.Request, cacheStatus string) {
 	if c.wasNotModified(r) {
-		c.copyHeaders(w, true, http.StatusNotModified)
+		c.copyHeaders(w, cacheStatus, http.StatusNotModified)
+	} else if c.canServeRange(r) {
+		c.writeRangeResponse(w, r, cacheStatus)
 	} else {
-		c.copyHeaders(w, true, c.StatusCode)
-		_, err := io.Copy(w, bytes.NewReader(c.Body))
+		c.copyHeaders(w, cacheStatus, c.StatusCode)
+		_, err := w.Write(c.Body)
 		if err != nil {
 			slog.Error("Error writing cached response body", "error", err)
 		}
 	}
 }
 
-// Private
+// canServeRange reports whether a range request can be answered from the
+// cached body. Responses that are served with X-Sendfile have no body here,
+// so their ranges are left to the SendfileHandler.
+func (c *CacheableResponse) canServeRange(r *http.Request) bool {
+	return r.Header.Get("Range") != "" &&
+		c.StatusCode == http.StatusOK &&
+		c.HttpHeader.Get("X-Sendfile") == ""
+}
+
+// writeRangeResponse serves the requested ranges from the cached body,
+// including checking any If-Range condition.
+func (c *CacheableResponse) writeRangeResponse(w http.ResponseWriter, r *http.Request, cacheStatus string) {
+	c.setHeaders(w, cacheStatus)
+
+	// The length will be set to match whichever ranges are served.
+	w.Header().Del("Content-Length")
+
+	lastModified, _ := http.ParseTime(c.HttpHeader.Get("Last-Modified"))
+	http.ServeContent(w, r, "", lastModified, bytes.NewReader(c.Body))
+}
 
 func (c *CacheableResponse) wasNotModified(r *http.Request) bool {
+	// If-Modified-Since is only considered when there is no If-None-Match, as
+	// the entity tag is the more accurate validator.
+	if r.Header.Get("If-None-Match") != "" {
+		return c.etagMatches(r)
+	}
+
+	return c.notModifiedSince(r)
+}
+
+func (c *CacheableResponse) etagMatches(r *http.Request) bool {
 	requestEtag := c.HttpHeader.Get("Etag")
 	if requestEtag == "" {
 		return false
@@ -149,24 +277,107 @@ func (c *CacheableResponse) wasNotModified(r *http.Request) bool {
 	return false
 }
 
-func (c *CacheableResponse) copyHeaders(w http.ResponseWriter, wasHit bool, statusCode int) {
-	maps.Copy(w.Header(), c.HttpHeader)
+func (c *CacheableResponse) notModifiedSince(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
 
-	if wasHit {
-		w.Header().Set("X-Cache", "hit")
-	} else {
-		w.Header().Set("X-Cache", "miss")
+	ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(c.HttpHeader.Get("Last-Modified"))
+	if err != nil {
+		return false
 	}
 
+	return !lastModified.After(ifModifiedSince)
+}
+
+func (c *CacheableResponse) copyHeaders(w http.ResponseWriter, cacheStatus string, statusCode int) {
+	c.setHeaders(w, cacheStatus)
 	w.WriteHeader(statusCode)
 }
 
-func (c *CacheableResponse) scrubHeaders() {
-	cacheable, _ := c.CacheStatus()
+func (c *CacheableResponse) setHeaders(w http.ResponseWriter, cacheStatus string) {
+	maps.Copy(w.Header(), c.HttpHeader)
+	w.Header().Set("X-Cache", cacheStatus)
+
+	// Surrogate-Control is meant only for us, so it is not passed on.
+	w.Header().Del("Surrogate-Control")
+
+	if cacheStatus != cacheStatusMiss && !c.CreatedAt.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(c.Age(time.Now()).Seconds())))
+	}
+}
+
+func (c *CacheableResponse) scrubHeaders() bool {
+	cacheable, _ := c.CacheStatus(time.Now())
 
 	if cacheable {
 		c.HttpHeader.Del("Set-Cookie")
 	}
+
+	return cacheable
+}
+
+// cacheDirectives returns the directives that control how we cache the
+// response. Surrogate-Control is addressed specifically to caches like ours,
+// so when it sets a lifetime, it takes precedence over Cache-Control.
+func (c *CacheableResponse) cacheDirectives() (CacheControl, bool) {
+	surrogateControl := ParseCacheControl(c.HttpHeader.Values("Surrogate-Control"))
+	if surrogateControl.Has("max-age") || surrogateControl.Has("no-store") {
+		return surrogateControl, true
+	}
+
+	return ParseCacheControl(c.HttpHeader.Values("Cache-Control")), false
+}
+
+// freshnessLifetime follows RFC 9111 section 4.2.1, for a shared cache. We
+// only cache responses that are explicitly marked as public, unless they were
+// given a lifetime with Surrogate-Control.
+func (c *CacheableResponse) freshnessLifetime(now time.Time) (time.Duration, bool) {
+	cc, surrogate := c.cacheDirectives()
+
+	if cc.Has("no-store") {
+		return 0, false
+	}
+
+	if surrogate {
+		return cc.Seconds("max-age")
+	}
+
+	if !cc.Has("public") || cc.Has("private") || cc.Has("no-cache") {
+		return 0, false
+	}
+
+	if cc.Has("s-maxage") {
+		return cc.Seconds("s-maxage")
+	}
+
+	if cc.Has("max-age") {
+		return cc.Seconds("max-age")
+	}
+
+	expires := c.HttpHeader.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+
+	// An invalid Expires value, such as "0", means the response has already
+	// expired.
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, false
+	}
+
+	date, err := http.ParseTime(c.HttpHeader.Get("Date"))
+	if err != nil {
+		date = now
+	}
+
+	return expiresAt.Sub(date), true
 }
 
 type stashingWriter struct {
@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Cached responses are stored in a simple binary format, which starts with a
+// magic number and a version, so that other versions of the format can be
+// recognised. The body comes last, and is not length-prefixed, so that a
+// decoded response can refer to it in place, rather than copying it.
+//
+//	magic           "THRR"
+//	version         byte
+//	status code     uint16
+//	created at      int64, nanoseconds since the epoch, or 0 for none
+//	expires at      int64
+//	stale-w-r       int64, nanoseconds
+//	stale-if-error  int64
+//	primary key     string
+//	headers         header
+//	variant headers header
+//	body            the rest of the buffer
+//
+// Strings are a uvarint length followed by that many bytes. Headers are a
+// uvarint count of names, each followed by a uvarint count of its values.
+
+const (
+	cachedResponseMagic       = "THRR"
+	cachedResponseVersion     = 1
+	cachedResponseFixedLength = len(cachedResponseMagic) + 1 + 2 + 4*8
+)
+
+var (
+	ErrCachedResponseInvalid            = errors.New("cached response is not in a recognised format")
+	ErrCachedResponseTruncated          = errors.New("cached response is truncated")
+	ErrCachedResponseUnsupportedVersion = errors.New("cached response has an unsupported version")
+)
+
+func CacheableResponseFromBuffer(b []byte) (CacheableResponse, error) {
+	if !bytes.HasPrefix(b, []byte(cachedResponseMagic)) {
+		return CacheableResponse{}, ErrCachedResponseInvalid
+	}
+
+	if len(b) <= len(cachedResponseMagic) {
+		return CacheableResponse{}, ErrCachedResponseTruncated
+	}
+
+	switch b[len(cachedResponseMagic)] {
+	case cachedResponseVersion:
+		return decodeCachedResponse(b)
+	default:
+		return CacheableResponse{}, ErrCachedResponseUnsupportedVersion
+	}
+}
+
+func (c *CacheableResponse) ToBuffer() ([]byte, error) {
+	if c.stasher != nil {
+		c.Body = c.stasher.Body()
+	}
+
+	if c.StatusCode < 0 || c.StatusCode > math.MaxUint16 {
+		return nil, errors.New("invalid status code")
+	}
+
+	size := cachedResponseFixedLength + encodedStringLength(c.PrimaryKey) +
+		encodedHeaderLength(c.HttpHeader) + encodedHeaderLength(c.VariantHeader) + len(c.Body)
+
+	b := make([]byte, 0, size)
+	b = append(b, cachedResponseMagic...)
+	b = append(b, cachedResponseVersion)
+	b = binary.BigEndian.AppendUint16(b, uint16(c.StatusCode))
+	b = binary.BigEndian.AppendUint64(b, uint64(encodeTime(c.CreatedAt)))
+	b = binary.BigEndian.AppendUint64(b, uint64(encodeTime(c.ExpiresAt)))
+	b = binary.BigEndian.AppendUint64(b, uint64(c.StaleWhileRevalidate))
+	b = binary.BigEndian.AppendUint64(b, uint64(c.StaleIfError))
+	b = appendString(b, c.PrimaryKey)
+	b = appendHeader(b, c.HttpHeader)
+	b = appendHeader(b, c.VariantHeader)
+	b = append(b, c.Body...)
+
+	return b, nil
+}
+
+// Private
+
+func decodeCachedResponse(b []byte) (CacheableResponse, error) {
+	d := cachedResponseDecoder{b: b[len(cachedResponseMagic)+1:]}
+
+	cr := CacheableResponse{
+		StatusCode:           int(d.uint16()),
+		CreatedAt:            decodeTime(int64(d.uint64())),
+		ExpiresAt:            decodeTime(int64(d.uint64())),
+		StaleWhileRevalidate: time.Duration(d.uint64()),
+		StaleIfError:         time.Duration(d.uint64()),
+		PrimaryKey:           d.string(),
+		HttpHeader:           d.header(),
+		VariantHeader:        d.header(),
+	}
+
+	if d.err != nil {
+		return CacheableResponse{}, d.err
+	}
+
+	// The body is whatever remains, which we use without copying. Limiting its
+	// capacity means it can never be appended to in place.
+	cr.Body = d.b[:len(d.b):len(d.b)]
+
+	return cr, nil
+}
+
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func encodedStringLength(s string) int {
+	return uvarintLength(uint64(len(s))) + len(s)
+}
+
+func encodedHeaderLength(header http.Header) int {
+	length := uvarintLength(uint64(len(header)))
+	for name, values := range header {
+		length += encodedStringLength(name) + uvarintLength(uint64(len(values)))
+		for _, value := range values {
+			length += encodedStringLength(value)
+		}
+	}
+
+	return length
+}
+
+func uvarintLength(n uint64) int {
+	length := 1
+	for n >= 0x80 {
+		n >>= 7
+		length++
+	}
+
+	return length
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendHeader(b []byte, header http.Header) []byte {
+	b = binary.AppendUvarint(b, uint64(len(header)))
+	for name, values := range header {
+		b = appendString(b, name)
+		b = binary.AppendUvarint(b, uint64(len(values)))
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+
+	return b
+}
+
+// cachedResponseDecoder reads the fields of a cached response in turn. After
+// the first error, every read returns a zero value, so the error only needs to
+// be checked at the end.
+type cachedResponseDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *cachedResponseDecoder) uint16() uint16 {
+	if !d.has(2) {
+		return 0
+	}
+
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *cachedResponseDecoder) uint64() uint64 {
+	if !d.has(8) {
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *cachedResponseDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *cachedResponseDecoder) string() string {
+	length := d.uvarint()
+	if !d.has(length) {
+		return ""
+	}
+
+	s := string(d.b[:length])
+	d.b = d.b[length:]
+	return s
+}
+
+func (d *cachedResponseDecoder) header() http.Header {
+	// Each name takes at least two bytes, for its length and its count of
+	// values, and each value takes at least one.
+	count := d.count(2)
+
+	header := make(http.Header, count)
+	for range count {
+		name := d.string()
+		values := make([]string, d.count(1))
+		for i := range values {
+			values[i] = d.string()
+		}
+
+		header[name] = values
+	}
+
+	return header
+}
+
+// count reads the number of items that follow, each of which takes at least
+// size bytes. A count too large for the remaining bytes can only come from a
+// corrupt buffer, and mustn't be used to allocate space for the items.
+func (d *cachedResponseDecoder) count(size uint64) uint64 {
+	count := d.uvarint()
+	if count > uint64(len(d.b))/size {
+		d.fail()
+		return 0
+	}
+
+	return count
+}
+
+func (d *cachedResponseDecoder) fail() {
+	if d.err == nil {
+		d.err = ErrCachedResponseTruncated
+	}
+}
+
+// has checks that at least n more bytes are available.
+func (d *cachedResponseDecoder) has(n uint64) bool {
+	if uint64(len(d.b)) < n {
+		d.fail()
+	}
+
+	return d.err == nil
+}
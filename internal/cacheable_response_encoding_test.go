@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheableResponseEncoding_round_trip(t *testing.T) {
+	cr := newTestEncodedResponse(11)
+
+	saved, err := cr.ToBuffer()
+	require.NoError(t, err)
+
+	restored, err := CacheableResponseFromBuffer(saved)
+	require.NoError(t, err)
+
+	assert.Equal(t, cr.PrimaryKey, restored.PrimaryKey)
+	assert.Equal(t, cr.StatusCode, restored.StatusCode)
+	assert.Equal(t, cr.HttpHeader, restored.HttpHeader)
+	assert.Equal(t, cr.VariantHeader, restored.VariantHeader)
+	assert.Equal(t, cr.Body, restored.Body)
+	assert.True(t, cr.CreatedAt.Equal(restored.CreatedAt))
+	assert.True(t, cr.ExpiresAt.Equal(restored.ExpiresAt))
+	assert.Equal(t, cr.StaleWhileRevalidate, restored.StaleWhileRevalidate)
+	assert.Equal(t, cr.StaleIfError, restored.StaleIfError)
+}
+
+func TestCacheableResponseEncoding_empty_values(t *testing.T) {
+	cr := CacheableResponse{StatusCode: http.StatusNoContent}
+
+	saved, err := cr.ToBuffer()
+	require.NoError(t, err)
+
+	restored, err := CacheableResponseFromBuffer(saved)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusNoContent, restored.StatusCode)
+	assert.True(t, restored.CreatedAt.IsZero())
+	assert.True(t, restored.ExpiresAt.IsZero())
+	assert.Empty(t, restored.HttpHeader)
+	assert.Empty(t, restored.Body)
+}
+
+func TestCacheableResponseEncoding_body_is_not_copied(t *testing.T) {
+	saved, err := newTestEncodedResponse(1 * KB).ToBuffer()
+	require.NoError(t, err)
+
+	restored, err := CacheableResponseFromBuffer(saved)
+	require.NoError(t, err)
+
+	assert.Same(t, &saved[len(saved)-1], &restored.Body[len(restored.Body)-1])
+	assert.Equal(t, len(restored.Body), cap(restored.Body))
+}
+
+func TestCacheableResponseEncoding_rejects_unrecognised_data(t *testing.T) {
+	_, err := CacheableResponseFromBuffer([]byte("not a cached response"))
+	assert.ErrorIs(t, err, ErrCachedResponseInvalid)
+}
+
+func TestCacheableResponseEncoding_rejects_unknown_versions(t *testing.T) {
+	saved, err := newTestEncodedResponse(11).ToBuffer()
+	require.NoError(t, err)
+
+	saved[len(cachedResponseMagic)] = cachedResponseVersion + 1
+
+	_, err = CacheableResponseFromBuffer(saved)
+	assert.ErrorIs(t, err, ErrCachedResponseUnsupportedVersion)
+}
+
+func TestCacheableResponseEncoding_rejects_truncated_responses(t *testing.T) {
+	cr := newTestEncodedResponse(0)
+	saved, err := cr.ToBuffer()
+	require.NoError(t, err)
+
+	for length := len(cachedResponseMagic); length < len(saved); length++ {
+		_, err := CacheableResponseFromBuffer(saved[:length])
+		assert.ErrorIs(t, err, ErrCachedResponseTruncated, "length %d", length)
+	}
+}
+
+func TestCacheableResponseEncoding_rejects_oversized_counts(t *testing.T) {
+	b := []byte(cachedResponseMagic)
+	b = append(b, cachedResponseVersion)
+	b = append(b, make([]byte, cachedResponseFixedLength-len(b))...)
+	b = appendString(b, "")
+	b = append(b, 0xff, 0xff, 0xff, 0xff, 0x0f)
+
+	_, err := CacheableResponseFromBuffer(b)
+	assert.ErrorIs(t, err, ErrCachedResponseTruncated)
+}
+
+func TestCacheableResponseEncoding_cached_responses_are_served_from_the_buffer(t *testing.T) {
+	saved, err := newTestEncodedResponse(11).ToBuffer()
+	require.NoError(t, err)
+
+	restored, err := CacheableResponseFromBuffer(saved)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	restored.WriteCachedResponse(w, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Equal(t, "xxxxxxxxxxx", w.Body.String())
+}
+
+func BenchmarkCacheableResponseEncoding_encode(b *testing.B) {
+	cr := newTestEncodedResponse(64 * KB)
+
+	for b.Loop() {
+		_, _ = cr.ToBuffer()
+	}
+}
+
+func BenchmarkCacheableResponseEncoding_encode_gob(b *testing.B) {
+	cr := newTestEncodedResponse(64 * KB)
+
+	for b.Loop() {
+		var buffer bytes.Buffer
+		_ = gob.NewEncoder(&buffer).Encode(cr)
+	}
+}
+
+func BenchmarkCacheableResponseEncoding_decode(b *testing.B) {
+	cr := newTestEncodedResponse(64 * KB)
+	saved, _ := cr.ToBuffer()
+
+	for b.Loop() {
+		_, _ = CacheableResponseFromBuffer(saved)
+	}
+}
+
+func BenchmarkCacheableResponseEncoding_decode_gob(b *testing.B) {
+	cr := newTestEncodedResponse(64 * KB)
+
+	var buffer bytes.Buffer
+	_ = gob.NewEncoder(&buffer).Encode(cr)
+	saved := buffer.Bytes()
+
+	for b.Loop() {
+		var restored CacheableResponse
+		_ = gob.NewDecoder(bytes.NewReader(saved)).Decode(&restored)
+	}
+}
+
+// Helpers
+
+func newTestEncodedResponse(bodySize int) *CacheableResponse {
+	now := time.Now()
+
+	return &CacheableResponse{
+		PrimaryKey: `"GET" "example.com" "/assets/app.js" ""`,
+		StatusCode: http.StatusOK,
+		HttpHeader: http.Header{
+			"Cache-Control":  {"public, max-age=31536000, immutable"},
+			"Content-Type":   {"text/plain"},
+			"Content-Length": {"11"},
+			"Etag":           {`"abc123"`},
+			"Last-Modified":  {"Mon, 02 Jan 2006 15:04:05 GMT"},
+			"Vary":           {"Accept-Encoding"},
+			"Link":           {"</a.css>; rel=preload", "</b.css>; rel=preload"},
+		},
+		VariantHeader:        http.Header{"Accept-Encoding": {"gzip"}},
+		Body:                 bytes.Repeat([]byte("x"), bodySize),
+		CreatedAt:            now,
+		ExpiresAt:            now.Add(1 * time.Hour),
+		StaleWhileRevalidate: 30 * time.Second,
+		StaleIfError:         5 * time.Minute,
+	}
+}
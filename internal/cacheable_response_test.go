@@ -4,50 +4,138 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestCacheableResponse_cache_headers(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	httpTime := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+
 	tests := map[string]struct {
-		cacheControl string
-		cacheable    bool
+		headers   map[string]string
+		cacheable bool
+		lifetime  time.Duration
 	}{
 		"public, with max-age": {
-			cacheControl: "public, max-age=60",
-			cacheable:    true,
+			headers:   map[string]string{"Cache-Control": "public, max-age=60"},
+			cacheable: true,
+			lifetime:  60 * time.Second,
 		},
-
-		"public, with s-max-age": {
-			cacheControl: "public, s-max-age=60",
-			cacheable:    true,
+		"public, with s-maxage": {
+			headers:   map[string]string{"Cache-Control": "public, s-maxage=60"},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"s-maxage takes precedence over max-age": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=10, s-maxage=600"},
+			cacheable: true,
+			lifetime:  600 * time.Second,
+		},
+		"misspelled s-max-age is ignored": {
+			headers:   map[string]string{"Cache-Control": "public, s-max-age=60"},
+			cacheable: false,
+		},
+		"directives are case-insensitive": {
+			headers:   map[string]string{"Cache-Control": "Public, Max-Age=60"},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"quoted arguments": {
+			headers:   map[string]string{"Cache-Control": `public, max-age="60"`},
+			cacheable: true,
+			lifetime:  60 * time.Second,
 		},
-
 		"public, with max-age of zero": {
-			cacheControl: "public, max-age=0",
-			cacheable:    false,
+			headers:   map[string]string{"Cache-Control": "public, max-age=0"},
+			cacheable: false,
+		},
+		"public, with invalid max-age": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=sixty"},
+			cacheable: false,
 		},
-
 		"public, with no max-age": {
-			cacheControl: "public",
-			cacheable:    false,
+			headers:   map[string]string{"Cache-Control": "public"},
+			cacheable: false,
 		},
-
 		"private, with max-age": {
-			cacheControl: "private, max-age=60",
-			cacheable:    false,
+			headers:   map[string]string{"Cache-Control": "private, max-age=60"},
+			cacheable: false,
+		},
+		"private with field names": {
+			headers:   map[string]string{"Cache-Control": `public, max-age=60, private="Set-Cookie, X-Token"`},
+			cacheable: false,
 		},
-
 		"max-age, but no public specified": {
-			cacheControl: "max-age=60",
-			cacheable:    false,
+			headers:   map[string]string{"Cache-Control": "max-age=60"},
+			cacheable: false,
 		},
-
 		"public, with max-age, but also no-cache": {
-			cacheControl: "public, max-age=60, no-cache",
-			cacheable:    false,
+			headers:   map[string]string{"Cache-Control": "public, max-age=60, no-cache"},
+			cacheable: false,
+		},
+		"public, with max-age, but also no-store": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60, no-store"},
+			cacheable: false,
+		},
+		"must-revalidate is still cacheable": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60, must-revalidate"},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"Expires relative to Date": {
+			headers:   map[string]string{"Cache-Control": "public", "Date": httpTime(-10 * time.Second), "Expires": httpTime(50 * time.Second)},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"Expires without Date": {
+			headers:   map[string]string{"Cache-Control": "public", "Expires": httpTime(60 * time.Second)},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"Expires in the past": {
+			headers:   map[string]string{"Cache-Control": "public", "Expires": httpTime(-60 * time.Second)},
+			cacheable: false,
+		},
+		"invalid Expires": {
+			headers:   map[string]string{"Cache-Control": "public", "Expires": "0"},
+			cacheable: false,
+		},
+		"max-age takes precedence over Expires": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Expires": httpTime(-60 * time.Second)},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"Age within lifetime": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Age": "30"},
+			cacheable: true,
+			lifetime:  60 * time.Second,
+		},
+		"Age beyond lifetime": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Age": "90"},
+			cacheable: false,
+		},
+		"Date older than lifetime": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Date": httpTime(-90 * time.Second)},
+			cacheable: false,
+		},
+		"Surrogate-Control overrides Cache-Control": {
+			headers:   map[string]string{"Cache-Control": "private, no-cache", "Surrogate-Control": "max-age=300"},
+			cacheable: true,
+			lifetime:  300 * time.Second,
+		},
+		"Surrogate-Control no-store": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Surrogate-Control": "no-store"},
+			cacheable: false,
+		},
+		"Surrogate-Control without a lifetime falls back to Cache-Control": {
+			headers:   map[string]string{"Cache-Control": "public, max-age=60", "Surrogate-Control": "content=\"ESI/1.0\""},
+			cacheable: true,
+			lifetime:  60 * time.Second,
 		},
 	}
 
@@ -55,21 +143,124 @@ func TestCacheableResponse_cache_headers(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			rec := httptest.NewRecorder()
 			cr := NewCacheableResponse(rec, 1024)
-			cr.Header().Set("Cache-Control", test.cacheControl)
+			for k, v := range test.headers {
+				cr.Header().Set(k, v)
+			}
 
-			cacheable, _ := cr.CacheStatus()
+			cacheable, lifetime := cr.CacheStatus(now)
 			assert.Equal(t, test.cacheable, cacheable)
+			if test.cacheable {
+				assert.Equal(t, test.lifetime, lifetime)
+			}
+		})
+	}
+}
+
+func TestCacheableResponse_initial_age(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		date     string
+		age      string
+		expected time.Duration
+	}{
+		"no Date or Age":      {"", "", 0},
+		"Age header":          {"", "30", 30 * time.Second},
+		"invalid Age header":  {"", "-30", 0},
+		"Date in the past":    {now.Add(-10 * time.Second).Format(http.TimeFormat), "", 10 * time.Second},
+		"Date in the future":  {now.Add(10 * time.Second).Format(http.TimeFormat), "", 0},
+		"larger of Date, Age": {now.Add(-10 * time.Second).Format(http.TimeFormat), "30", 30 * time.Second},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cr := CacheableResponse{HttpHeader: http.Header{}}
+			if test.date != "" {
+				cr.HttpHeader.Set("Date", test.date)
+			}
+			if test.age != "" {
+				cr.HttpHeader.Set("Age", test.age)
+			}
+
+			assert.Equal(t, test.expected, cr.InitialAge(now))
+		})
+	}
+}
+
+func TestCacheableResponse_stale_status(t *testing.T) {
+	tests := map[string]struct {
+		cacheControl         string
+		staleWhileRevalidate time.Duration
+		staleIfError         time.Duration
+	}{
+		"no stale directives": {
+			cacheControl: "public, max-age=60",
+		},
+		"stale-while-revalidate": {
+			cacheControl:         "public, max-age=60, stale-while-revalidate=30",
+			staleWhileRevalidate: 30 * time.Second,
+		},
+		"stale-if-error": {
+			cacheControl: "public, max-age=60, stale-if-error=600",
+			staleIfError: 600 * time.Second,
+		},
+		"both": {
+			cacheControl:         "public, stale-if-error=600, max-age=60, stale-while-revalidate=30",
+			staleWhileRevalidate: 30 * time.Second,
+			staleIfError:         600 * time.Second,
+		},
+		"must-revalidate": {
+			cacheControl: "public, max-age=60, stale-while-revalidate=30, stale-if-error=600, must-revalidate",
+		},
+		"proxy-revalidate": {
+			cacheControl: "public, max-age=60, stale-while-revalidate=30, stale-if-error=600, proxy-revalidate",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			cr := NewCacheableResponse(rec, 1024)
+			cr.Header().Set("Cache-Control", test.cacheControl)
+
+			staleWhileRevalidate, staleIfError := cr.StaleStatus()
+			assert.Equal(t, test.staleWhileRevalidate, staleWhileRevalidate)
+			assert.Equal(t, test.staleIfError, staleIfError)
 		})
 	}
 }
 
+func TestCacheableResponse_freshness(t *testing.T) {
+	now := time.Now()
+	cr := CacheableResponse{
+		CreatedAt:            now,
+		ExpiresAt:            now.Add(60 * time.Second),
+		StaleWhileRevalidate: 30 * time.Second,
+		StaleIfError:         120 * time.Second,
+	}
+
+	assert.True(t, cr.IsFresh(now.Add(30*time.Second)))
+	assert.False(t, cr.IsStaleWhileRevalidate(now.Add(30*time.Second)))
+
+	assert.False(t, cr.IsFresh(now.Add(70*time.Second)))
+	assert.True(t, cr.IsStaleWhileRevalidate(now.Add(70*time.Second)))
+	assert.True(t, cr.IsStaleIfError(now.Add(70*time.Second)))
+
+	assert.False(t, cr.IsStaleWhileRevalidate(now.Add(100*time.Second)))
+	assert.True(t, cr.IsStaleIfError(now.Add(100*time.Second)))
+	assert.False(t, cr.IsStaleIfError(now.Add(200*time.Second)))
+
+	assert.Equal(t, 70*time.Second, cr.Age(now.Add(70*time.Second)))
+	assert.Equal(t, now.Add(180*time.Second), cr.RetainUntil())
+}
+
 func TestCacheableResponse_does_not_cache_items_with_wildcard_vary_header(t *testing.T) {
 	rec := httptest.NewRecorder()
 	cr := NewCacheableResponse(rec, 1024)
 	cr.Header().Set("Cache-Control", "public, max-age=60")
 	cr.Header().Set("Vary", "*")
 
-	cacheable, _ := cr.CacheStatus()
+	cacheable, _ := cr.CacheStatus(time.Now())
 	assert.False(t, cacheable)
 }
 
@@ -79,7 +270,7 @@ func TestCacheableResponse_does_not_cache_items_where_body_too_large(t *testing.
 	cr.Header().Set("Cache-Control", "public, max-age=60")
 	_, _ = cr.Write([]byte("12345678901234567890"))
 
-	cacheable, _ := cr.CacheStatus()
+	cacheable, _ := cr.CacheStatus(time.Now())
 	assert.False(t, cacheable)
 }
 
@@ -89,7 +280,7 @@ func TestCacheableResponse_does_not_cache_304_responses(t *testing.T) {
 	cr.Header().Set("Cache-Control", "public, max-age=60")
 	cr.WriteHeader(http.StatusNotModified)
 
-	cacheable, _ := cr.CacheStatus()
+	cacheable, _ := cr.CacheStatus(time.Now())
 	assert.False(t, cacheable)
 }
 
@@ -138,6 +329,54 @@ func TestCacheableResponse_write_cached_response(t *testing.T) {
 	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
 }
 
+func TestCacheableResponse_write_stale_response(t *testing.T) {
+	rec := httptest.NewRecorder()
+	cr := NewCacheableResponse(rec, 1024)
+	cr.Header().Set("Cache-Control", "public, max-age=60")
+	_, _ = cr.Write([]byte("Hello World"))
+
+	_, _ = cr.ToBuffer() // Ensure the body is saved
+	cr.CreatedAt = time.Now().Add(-90 * time.Second)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	cr.WriteStaleResponse(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello World", w.Body.String())
+	assert.Equal(t, "stale", w.Header().Get("X-Cache"))
+	assert.Equal(t, "90", w.Header().Get("Age"))
+}
+
+func TestCacheableResponse_write_cached_range_response(t *testing.T) {
+	tests := map[string]struct {
+		statusCode     int
+		header         http.Header
+		expectedStatus int
+		expectedBody   string
+	}{
+		"ok response":       {http.StatusOK, http.Header{}, http.StatusPartialContent, "23"},
+		"not found":         {http.StatusNotFound, http.Header{}, http.StatusNotFound, "0123456789"},
+		"sendfile response": {http.StatusOK, http.Header{"X-Sendfile": {"/file"}}, http.StatusOK, "0123456789"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tc.header.Set("Content-Length", "10")
+			cr := CacheableResponse{StatusCode: tc.statusCode, HttpHeader: tc.header, Body: []byte("0123456789")}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Range", "bytes=2-3")
+			cr.WriteCachedResponse(w, r)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedBody, w.Body.String())
+			assert.Equal(t, strconv.Itoa(len(tc.expectedBody)), w.Header().Get("Content-Length"))
+		})
+	}
+}
+
 func TestCacheableResponse_conditional_response(t *testing.T) {
 	etag := `"deadbeef"`
 
@@ -228,6 +467,90 @@ func TestCacheableResponse_conditional_response_no_etag_in_response(t *testing.T
 	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
 }
 
+func TestCacheableResponse_conditional_response_if_modified_since(t *testing.T) {
+	tests := map[string]struct {
+		method          string
+		ifModifiedSince string
+		ifNoneMatch     string
+		expectedStatus  int
+	}{
+		"same time":               {http.MethodGet, "Wed, 21 Oct 2015 07:28:00 GMT", "", http.StatusNotModified},
+		"later time":              {http.MethodGet, "Thu, 22 Oct 2015 07:28:00 GMT", "", http.StatusNotModified},
+		"earlier time":            {http.MethodGet, "Tue, 20 Oct 2015 07:28:00 GMT", "", http.StatusOK},
+		"invalid time":            {http.MethodGet, "yesterday", "", http.StatusOK},
+		"HEAD request":            {http.MethodHead, "Wed, 21 Oct 2015 07:28:00 GMT", "", http.StatusNotModified},
+		"POST request":            {http.MethodPost, "Wed, 21 Oct 2015 07:28:00 GMT", "", http.StatusOK},
+		"etag takes precedence":   {http.MethodGet, "Wed, 21 Oct 2015 07:28:00 GMT", `"other"`, http.StatusOK},
+		"matching etag and dates": {http.MethodGet, "Tue, 20 Oct 2015 07:28:00 GMT", `"deadbeef"`, http.StatusNotModified},
+	}
+
+	rec := httptest.NewRecorder()
+	cr := NewCacheableResponse(rec, 1024)
+	cr.Header().Set("Etag", `"deadbeef"`)
+	cr.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	cr.WriteHeader(http.StatusOK)
+	_, _ = cr.Write([]byte("Hello World"))
+
+	_, _ = cr.ToBuffer() // Ensure the body is saved
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.Header.Set("If-Modified-Since", tc.ifModifiedSince)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			cr.WriteCachedResponse(w, r)
+
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestCacheableResponse_conditional_headers(t *testing.T) {
+	cr := CacheableResponse{HttpHeader: http.Header{}}
+	cr.HttpHeader.Set("Etag", `"deadbeef"`)
+	cr.HttpHeader.Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+	assert.True(t, cr.HasValidators())
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"client"`)
+	cr.SetConditionalHeaders(r)
+
+	assert.Equal(t, `"deadbeef"`, r.Header.Get("If-None-Match"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", r.Header.Get("If-Modified-Since"))
+
+	cr.HttpHeader.Del("Etag")
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", `"client"`)
+	cr.SetConditionalHeaders(r)
+
+	assert.Empty(t, r.Header.Get("If-None-Match"))
+	assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", r.Header.Get("If-Modified-Since"))
+
+	cr.HttpHeader.Del("Last-Modified")
+	assert.False(t, cr.HasValidators())
+}
+
+func TestCacheableResponse_update_headers(t *testing.T) {
+	cr := CacheableResponse{HttpHeader: http.Header{}}
+	cr.HttpHeader.Set("Cache-Control", "public, max-age=60")
+	cr.HttpHeader.Set("Content-Length", "11")
+	cr.HttpHeader.Set("Content-Type", "text/plain")
+
+	cr.UpdateHeaders(http.Header{
+		"Cache-Control":  []string{"public, max-age=600"},
+		"Content-Length": []string{"0"},
+		"Etag":           []string{`"deadbeef"`},
+	})
+
+	assert.Equal(t, "public, max-age=600", cr.HttpHeader.Get("Cache-Control"))
+	assert.Equal(t, "11", cr.HttpHeader.Get("Content-Length"))
+	assert.Equal(t, "text/plain", cr.HttpHeader.Get("Content-Type"))
+	assert.Equal(t, `"deadbeef"`, cr.HttpHeader.Get("Etag"))
+}
+
 func TestCacheableResponse_scrubs_cookies_from_cacheable_responses(t *testing.T) {
 	rec := httptest.NewRecorder()
 	cr := NewCacheableResponse(rec, 1024)
@@ -0,0 +1,15 @@
+package internal
+
+import "time"
+
+// Clock waits for time to pass. Code that waits should use a Clock, rather
+// than the time package directly, so that tests can control it.
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
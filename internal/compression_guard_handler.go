@@ -9,19 +9,67 @@ import (
 	"github.com/klauspost/compress/gzhttp"
 )
 
-func NewCompressionGuardHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check for user-specific headers in the request
-		if hasUserSpecificRequestHeaders(r) {
-			w.Header().Set(gzhttp.HeaderNoCompression, "1")
-		}
+// CompressionGuardRules refine which responses the compression guard leaves
+// uncompressed. With the zero value, no response to a user-specific request
+// is compressed.
+type CompressionGuardRules struct {
+	// AllowedPaths are always compressed, because they can't contain secrets,
+	// like static assets. A path ending in * matches every path that starts
+	// with the rest of it, like /assets/*.
+	AllowedPaths []string
+
+	// ContentTypes, when not empty, are the only content types the guard
+	// protects, like text/html.
+	ContentTypes []string
+
+	// SecretsHeader is a response header that the upstream can set to mark a
+	// response as containing secrets, so that it is never compressed. It is
+	// removed before the response is sent.
+	SecretsHeader string
+}
 
-		// Wrap the ResponseWriter to check for user-specific headers in the response
-		wrappedWriter := &compressionGuardResponseWriter{ResponseWriter: w}
+// NewCompressionGuardHandler marks responses that may contain secrets with
+// gzhttp.HeaderNoCompression, so that the compression handlers leave them
+// alone. It needs to see the response headers before the compression writers
+// do, so it must be placed between them and the upstream.
+func NewCompressionGuardHandler(rules CompressionGuardRules, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrappedWriter := &compressionGuardResponseWriter{ResponseWriter: w, r: r, rules: rules}
 		next.ServeHTTP(wrappedWriter, r)
 	})
 }
 
+// protects reports whether the response to a request should be left
+// uncompressed, because it may contain secrets.
+func (rules CompressionGuardRules) protects(r *http.Request, header http.Header) bool {
+	if rules.SecretsHeader != "" && header.Get(rules.SecretsHeader) != "" {
+		return true
+	}
+
+	if rules.allowsPath(r.URL.Path) {
+		return false
+	}
+
+	if !hasUserSpecificRequestHeaders(r) && !hasUserSpecificResponseHeaders(header) {
+		return false
+	}
+
+	// When we don't know the content type yet, we play it safe.
+	contentType := header.Get("Content-Type")
+	return len(rules.ContentTypes) == 0 || contentType == "" || contentTypeMatches(contentType, rules.ContentTypes)
+}
+
+func (rules CompressionGuardRules) allowsPath(path string) bool {
+	for _, pattern := range rules.AllowedPaths {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if path == pattern || (wildcard && strings.HasPrefix(path, prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func hasUserSpecificRequestHeaders(r *http.Request) bool {
 	return r.Header.Get("Cookie") != "" ||
 		r.Header.Get("Authorization") != "" ||
@@ -30,6 +78,8 @@ func hasUserSpecificRequestHeaders(r *http.Request) bool {
 
 type compressionGuardResponseWriter struct {
 	http.ResponseWriter
+	r           *http.Request
+	rules       CompressionGuardRules
 	wroteHeader bool
 }
 
@@ -39,11 +89,14 @@ func (w *compressionGuardResponseWriter) WriteHeader(statusCode int) {
 	}
 	w.wroteHeader = true
 
-	// Check for user-specific headers in the response
-	if hasUserSpecificResponseHeaders(w.Header()) {
+	if w.rules.protects(w.r, w.Header()) {
 		w.Header().Set(gzhttp.HeaderNoCompression, "1")
 	}
 
+	if w.rules.SecretsHeader != "" {
+		w.Header().Del(w.rules.SecretsHeader)
+	}
+
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
@@ -81,6 +134,10 @@ func hasUserSpecificResponseHeaders(h http.Header) bool {
 
 // Flush implements http.Flusher
 func (w *compressionGuardResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
 	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
 		flusher.Flush()
 	}
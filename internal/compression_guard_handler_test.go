@@ -85,7 +85,7 @@ func TestCompressionGuardHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			handler := NewCompressionGuardHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler := NewCompressionGuardHandler(CompressionGuardRules{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				for k, v := range tt.responseHeader {
 					w.Header().Set(k, v)
 				}
@@ -108,3 +108,56 @@ func TestCompressionGuardHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressionGuardHandler_rules(t *testing.T) {
+	rules := CompressionGuardRules{
+		AllowedPaths:  []string{"/assets/*", "/manifest.json"},
+		ContentTypes:  []string{"text/html", "application/json"},
+		SecretsHeader: "X-Contains-Secrets",
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		cookie         bool
+		responseHeader map[string]string
+		wantNoCompress bool
+	}{
+		{"Guarded content type", "/", true, map[string]string{"Content-Type": "text/html; charset=utf-8"}, true},
+		{"Other content type", "/", true, map[string]string{"Content-Type": "text/javascript"}, false},
+		{"Unknown content type", "/", true, map[string]string{}, true},
+		{"Guarded content type without auth", "/", false, map[string]string{"Content-Type": "text/html"}, false},
+		{"Guarded content type with user-specific response", "/", false, map[string]string{"Content-Type": "text/html", "Set-Cookie": "a=b"}, true},
+		{"Allowed path prefix", "/assets/app.html", true, map[string]string{"Content-Type": "text/html"}, false},
+		{"Allowed exact path", "/manifest.json", true, map[string]string{"Content-Type": "application/json"}, false},
+		{"Not an allowed path", "/manifest.json/other", true, map[string]string{"Content-Type": "application/json"}, true},
+		{"Secrets header", "/", false, map[string]string{"Content-Type": "text/javascript", "X-Contains-Secrets": "1"}, true},
+		{"Secrets header on an allowed path", "/assets/app.js", false, map[string]string{"X-Contains-Secrets": "1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewCompressionGuardHandler(rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.responseHeader {
+					w.Header().Set(k, v)
+				}
+				_, _ = w.Write([]byte("Hello"))
+			}))
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.cookie {
+				req.Header.Set("Cookie", "session=123")
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if tt.wantNoCompress {
+				assert.Equal(t, "1", rr.Header().Get(gzhttp.HeaderNoCompression))
+			} else {
+				assert.Empty(t, rr.Header().Get(gzhttp.HeaderNoCompression))
+			}
+			assert.Empty(t, rr.Header().Get("X-Contains-Secrets"))
+		})
+	}
+}
@@ -2,9 +2,13 @@ package internal
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/gzhttp"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 )
 
 var compressedImageContentTypes = []string{
@@ -12,36 +16,205 @@ var compressedImageContentTypes = []string{
 	"image/gif", "image/avif", "image/heic", "image/heif", "image/jxl",
 }
 
-func NewCompressionHandler(jitter int, disableOnAuth bool, next http.Handler) http.Handler {
-	var wrapper func(http.Handler) http.HandlerFunc
-	var err error
+// By default, responses smaller than this aren't worth compressing.
+const defaultCompressionMinSize = 1024
 
-	if jitter > 0 {
-		wrapper, err = gzhttp.NewWrapper(
-			gzhttp.MinSize(1024),
-			gzhttp.CompressionLevel(6),
-			gzhttp.ContentTypeFilter(contentTypeFilter),
-			gzhttp.RandomJitter(jitter, 0, false),
-		)
-	} else {
-		wrapper, err = gzhttp.NewWrapper(
-			gzhttp.MinSize(1024),
-			gzhttp.CompressionLevel(6),
-			gzhttp.ContentTypeFilter(contentTypeFilter),
-		)
-	}
+// When jitter is enabled, its amount is derived from up to this much of the
+// start of the response, so the response is buffered until we have it.
+const compressionJitterBufferSize = 64 * KB
+
+const (
+	defaultGzipCompressionLevel   = 6
+	defaultBrotliCompressionLevel = 5
+	defaultZstdCompressionLevel   = 1
+)
+
+// CompressionOptions configures which responses are compressed, and the
+// encodings they can be compressed with. Gzip is always available; Brotli and
+// zstd are used when they're enabled and the client prefers them. A level or
+// minimum size of 0 selects the default.
+type CompressionOptions struct {
+	jitter        int
+	disableOnAuth bool
+	gzipLevel     int
+	brotliEnabled bool
+	brotliLevel   int
+	zstdEnabled   bool
+	zstdLevel     int
+	minSize       int
+
+	// contentTypes, when set, are the only content types that will be
+	// compressed. Otherwise we compress anything that isn't already
+	// compressed. Content types in excludedContentTypes are never compressed.
+	// Both accept patterns like `image/*`.
+	contentTypes         []string
+	excludedContentTypes []string
 
+	// The upstream can ask for a response not to be compressed by including
+	// this header, as well as with `Cache-Control: no-transform`.
+	optOutHeader string
+
+	// guardRules refine which responses are left uncompressed when
+	// disableOnAuth is set.
+	guardRules CompressionGuardRules
+}
+
+func NewCompressionHandler(options CompressionOptions, next http.Handler) http.Handler {
+	return newCompressionWrapper(options)(next)
+}
+
+// newCompressionWrapper returns a wrapper that compresses responses with the
+// encoding negotiated for each request. Gzip and zstd are handled by gzhttp,
+// and Brotli by our own writer, which follows the same rules.
+func newCompressionWrapper(options CompressionOptions) func(http.Handler) http.HandlerFunc {
+	options = options.withDefaults()
+
+	gzipWrapper, err := gzhttp.NewWrapper(
+		gzhttp.MinSize(options.minSize),
+		gzhttp.CompressionLevel(options.gzipLevel),
+		gzhttp.ContentTypeFilter(options.contentTypeFilter),
+		gzhttp.EnableZstd(options.zstdEnabled),
+		gzhttp.ZstdCompressionLevel(options.zstdLevel),
+		gzhttp.RandomJitter(options.jitter, compressionJitterBufferSize, false),
+	)
 	if err != nil {
 		panic("failed to create gzip wrapper: " + err.Error())
 	}
 
-	handler := wrapper(next)
+	brotliWrapper := newBrotliWrapper(options)
+
+	return func(next http.Handler) http.HandlerFunc {
+		next = newCompressionOptOutHandler(options, next)
+		if options.disableOnAuth {
+			next = NewCompressionGuardHandler(options.guardRules, next)
+		}
+
+		gzipHandler := gzipWrapper(next)
+		brotliHandler := brotliWrapper(next)
 
-	if disableOnAuth {
-		return NewCompressionGuardHandler(handler)
+		return func(w http.ResponseWriter, r *http.Request) {
+			if options.negotiateContentEncoding(r) == "br" {
+				brotliHandler(w, r)
+			} else {
+				gzipHandler(w, r)
+			}
+		}
 	}
+}
+
+// withDefaults fills in the default levels and minimum size, in place of any
+// that are missing or out of range.
+func (o CompressionOptions) withDefaults() CompressionOptions {
+	o.gzipLevel = compressionLevel(o.gzipLevel, defaultGzipCompressionLevel, gzip.BestSpeed, gzip.BestCompression)
+	o.brotliLevel = compressionLevel(o.brotliLevel, defaultBrotliCompressionLevel, 1, brotli.BestCompression)
+	o.zstdLevel = compressionLevel(o.zstdLevel, defaultZstdCompressionLevel, int(zstd.SpeedFastest), int(zstd.SpeedBestCompression))
 
-	return handler
+	if o.minSize <= 0 {
+		o.minSize = defaultCompressionMinSize
+	}
+
+	return o
+}
+
+// contentTypeFilter reports whether responses with a content type should be
+// compressed.
+func (o CompressionOptions) contentTypeFilter(contentType string) bool {
+	if contentTypeMatches(contentType, o.excludedContentTypes) {
+		return false
+	}
+
+	if len(o.contentTypes) > 0 {
+		return contentTypeMatches(contentType, o.contentTypes)
+	}
+
+	return contentTypeFilter(contentType)
+}
+
+// guarded reports whether the compression guard will keep the response to a
+// request uncompressed.
+func (o CompressionOptions) guarded(r *http.Request, header http.Header) bool {
+	return o.disableOnAuth && o.guardRules.protects(r, header)
+}
+
+// optedOut reports whether the upstream has asked for a response not to be
+// compressed.
+func (o CompressionOptions) optedOut(header http.Header) bool {
+	if o.optOutHeader != "" && header.Get(o.optOutHeader) != "" {
+		return true
+	}
+
+	return ParseCacheControl(header.Values("Cache-Control")).Has("no-transform")
+}
+
+// The encodings we can compress with, in the order we prefer them when a
+// client accepts several of them equally.
+var compressionEncodings = []string{"zstd", "br", "gzip"}
+
+// negotiateContentEncoding picks the encoding that the compression wrapper
+// will use for a request, or returns an empty string if the response won't be
+// compressed.
+func (o CompressionOptions) negotiateContentEncoding(r *http.Request) string {
+	if r.Method == http.MethodHead {
+		return ""
+	}
+
+	return preferredEncoding(r.Header.Get("Accept-Encoding"), o.encodingEnabled)
+}
+
+func (o CompressionOptions) encodingEnabled(encoding string) bool {
+	switch encoding {
+	case "zstd":
+		return o.zstdEnabled
+	case "br":
+		return o.brotliEnabled
+	default:
+		return true
+	}
+}
+
+// preferredEncoding returns the allowed encoding with the highest quality
+// value in an Accept-Encoding header, or an empty string if the client
+// doesn't accept any of them. Ties are settled by the order of
+// compressionEncodings.
+func preferredEncoding(accept string, allowed func(encoding string) bool) string {
+	encoding := ""
+	best := 0.0
+
+	for _, name := range compressionEncodings {
+		q := acceptedEncodingQuality(accept, name)
+		if q > best && allowed(name) {
+			encoding = name
+			best = q
+		}
+	}
+
+	return encoding
+}
+
+// acceptedEncodingQuality returns the quality value given to an encoding in an
+// Accept-Encoding header, or 0 if it is not accepted.
+func acceptedEncodingQuality(accept string, encoding string) float64 {
+	for item := range strings.SplitSeq(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		for param := range strings.SplitSeq(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					return 0
+				}
+				return q
+			}
+		}
+
+		return 1
+	}
+
+	return 0
 }
 
 func contentTypeFilter(contentType string) bool {
@@ -58,3 +231,32 @@ func contentTypeFilter(contentType string) bool {
 
 	return true
 }
+
+// compressionLevel returns the level to use for an encoding, falling back to
+// the default when none was given or the level is out of range.
+func compressionLevel(level, defaultLevel, minLevel, maxLevel int) int {
+	if level < minLevel || level > maxLevel {
+		return defaultLevel
+	}
+
+	return level
+}
+
+// contentTypeMatches reports whether a content type matches any of the
+// patterns. Patterns ending in `*` match any type that starts the same way;
+// others must match exactly. Parameters, like charset, are ignored.
+func contentTypeMatches(contentType string, patterns []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if wildcard && strings.HasPrefix(mediaType, prefix) || mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,13 +1,17 @@
 package internal
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzhttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,7 +26,7 @@ func TestCompressionHandler(t *testing.T) {
 	})
 
 	t.Run("compresses responses", func(t *testing.T) {
-		handler := NewCompressionHandler(0, false, upstream)
+		handler := NewCompressionHandler(CompressionOptions{}, upstream)
 
 		req := httptest.NewRequest("GET", "/", nil)
 		req.Header.Set("Accept-Encoding", "gzip")
@@ -41,7 +45,7 @@ func TestCompressionHandler(t *testing.T) {
 	})
 
 	t.Run("applies jitter when configured", func(t *testing.T) {
-		handler := NewCompressionHandler(32, false, upstream)
+		handler := NewCompressionHandler(CompressionOptions{jitter: 32}, upstream)
 
 		req := httptest.NewRequest("GET", "/", nil)
 		req.Header.Set("Accept-Encoding", "gzip")
@@ -59,7 +63,7 @@ func TestCompressionHandler(t *testing.T) {
 	})
 
 	t.Run("wraps with guard when disableOnAuth is true", func(t *testing.T) {
-		handler := NewCompressionHandler(0, true, upstream)
+		handler := NewCompressionHandler(CompressionOptions{disableOnAuth: true}, upstream)
 
 		req := httptest.NewRequest("GET", "/", nil)
 		req.Header.Set("Accept-Encoding", "gzip")
@@ -74,7 +78,7 @@ func TestCompressionHandler(t *testing.T) {
 	})
 
 	t.Run("compresses authenticated requests when disableOnAuth is false", func(t *testing.T) {
-		handler := NewCompressionHandler(0, false, upstream)
+		handler := NewCompressionHandler(CompressionOptions{}, upstream)
 
 		req := httptest.NewRequest("GET", "/", nil)
 		req.Header.Set("Accept-Encoding", "gzip")
@@ -87,6 +91,60 @@ func TestCompressionHandler(t *testing.T) {
 	})
 }
 
+func TestCompressionHandler_guard(t *testing.T) {
+	largeBody := strings.Repeat("A", 2000)
+
+	serve := func(encoding string, path string, cookie bool, header http.Header) *httptest.ResponseRecorder {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			_, _ = w.Write([]byte(largeBody))
+		})
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		if cookie {
+			req.Header.Set("Cookie", "session=secret")
+		}
+		rr := httptest.NewRecorder()
+
+		options := CompressionOptions{
+			brotliEnabled: true,
+			disableOnAuth: true,
+			guardRules: CompressionGuardRules{
+				AllowedPaths:  []string{"/assets/*"},
+				ContentTypes:  []string{"text/html"},
+				SecretsHeader: "X-Contains-Secrets",
+			},
+		}
+		NewCompressionHandler(options, upstream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	html := http.Header{"Content-Type": {"text/html"}}
+	js := http.Header{"Content-Type": {"text/javascript"}}
+
+	for _, encoding := range []string{"gzip", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			assert.Empty(t, serve(encoding, "/", true, html).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(encoding, "/", false, html).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(encoding, "/", true, js).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(encoding, "/assets/page.html", true, html).Header().Get("Content-Encoding"))
+
+			userSpecific := http.Header{"Content-Type": {"text/html"}, "Set-Cookie": {"session=new"}}
+			assert.Empty(t, serve(encoding, "/", false, userSpecific).Header().Get("Content-Encoding"))
+
+			secret := http.Header{"Content-Type": {"text/javascript"}, "X-Contains-Secrets": {"1"}}
+			rr := serve(encoding, "/assets/app.js", false, secret)
+			assert.Empty(t, rr.Header().Get("Content-Encoding"))
+			assert.Empty(t, rr.Header().Get("X-Contains-Secrets"))
+			assert.Empty(t, rr.Header().Get(gzhttp.HeaderNoCompression))
+			assert.Equal(t, largeBody, rr.Body.String())
+		})
+	}
+}
+
 func TestCompressionHandler_contentTypeFilter(t *testing.T) {
 	largeBody := strings.Repeat("A", 2000)
 
@@ -131,7 +189,7 @@ func TestCompressionHandler_contentTypeFilter(t *testing.T) {
 
 	for _, contentType := range compressedContentTypes {
 		t.Run("still compresses "+contentType, func(t *testing.T) {
-			handler := NewCompressionHandler(0, false, upstreamWithType(contentType))
+			handler := NewCompressionHandler(CompressionOptions{}, upstreamWithType(contentType))
 
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, request())
@@ -142,7 +200,7 @@ func TestCompressionHandler_contentTypeFilter(t *testing.T) {
 
 	for _, contentType := range excludedContentTypes {
 		t.Run("does not compress "+contentType, func(t *testing.T) {
-			handler := NewCompressionHandler(0, false, upstreamWithType(contentType))
+			handler := NewCompressionHandler(CompressionOptions{}, upstreamWithType(contentType))
 
 			rr := httptest.NewRecorder()
 			handler.ServeHTTP(rr, request())
@@ -152,3 +210,291 @@ func TestCompressionHandler_contentTypeFilter(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressionHandler_brotli(t *testing.T) {
+	largeBody := strings.Repeat("Hello, Brotli! ", 200)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(largeBody)))
+		_, err := w.Write([]byte(largeBody))
+		require.NoError(t, err)
+	})
+
+	serve := func(options CompressionOptions, upstream http.Handler, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+
+		NewCompressionHandler(options, upstream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("compresses responses", func(t *testing.T) {
+		rr := serve(CompressionOptions{brotliEnabled: true}, upstream, "gzip, br")
+
+		assert.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+		assert.Empty(t, rr.Header().Get("Content-Length"))
+		assert.Less(t, rr.Body.Len(), len(largeBody))
+		assert.Equal(t, largeBody, unbrotli(t, rr.Body.Bytes()))
+	})
+
+	t.Run("is not used when disabled", func(t *testing.T) {
+		rr := serve(CompressionOptions{}, upstream, "gzip, br")
+
+		assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("pads responses with jitter that depends on the content", func(t *testing.T) {
+		plain := serve(CompressionOptions{brotliEnabled: true}, upstream, "br")
+		padded := serve(CompressionOptions{brotliEnabled: true, jitter: 32}, upstream, "br")
+		again := serve(CompressionOptions{brotliEnabled: true, jitter: 32}, upstream, "br")
+
+		padding := padded.Body.Len() - plain.Body.Len()
+		assert.GreaterOrEqual(t, padding, 1+2)
+		assert.LessOrEqual(t, padding, 32+2)
+		assert.Equal(t, padded.Body.Bytes(), again.Body.Bytes())
+		assert.Equal(t, largeBody, unbrotli(t, padded.Body.Bytes()))
+	})
+
+	t.Run("splits large amounts of jitter across metadata blocks", func(t *testing.T) {
+		rr := serve(CompressionOptions{brotliEnabled: true, jitter: 1000}, upstream, "br")
+
+		assert.Equal(t, largeBody, unbrotli(t, rr.Body.Bytes()))
+	})
+
+	t.Run("uses the configured level", func(t *testing.T) {
+		fastest := serve(CompressionOptions{brotliEnabled: true, brotliLevel: 1}, upstream, "br")
+		smallest := serve(CompressionOptions{brotliEnabled: true, brotliLevel: 11}, upstream, "br")
+
+		assert.Less(t, smallest.Body.Len(), fastest.Body.Len())
+		assert.Equal(t, largeBody, unbrotli(t, smallest.Body.Bytes()))
+	})
+
+	t.Run("does not compress small responses", func(t *testing.T) {
+		small := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("Hello"))
+		})
+		rr := serve(CompressionOptions{brotliEnabled: true}, small, "br")
+
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Hello", rr.Body.String())
+	})
+
+	t.Run("does not compress excluded content types", func(t *testing.T) {
+		image := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(largeBody))
+		})
+		rr := serve(CompressionOptions{brotliEnabled: true}, image, "br")
+
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, largeBody, rr.Body.String())
+	})
+
+	t.Run("does not compress responses that are already encoded", func(t *testing.T) {
+		encoded := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write([]byte(largeBody))
+		})
+		rr := serve(CompressionOptions{brotliEnabled: true}, encoded, "br")
+
+		assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, largeBody, rr.Body.String())
+	})
+
+	t.Run("respects the compression guard", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "br")
+		req.Header.Set("Cookie", "session=secret")
+		rr := httptest.NewRecorder()
+
+		NewCompressionHandler(CompressionOptions{brotliEnabled: true, disableOnAuth: true}, upstream).ServeHTTP(rr, req)
+
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Empty(t, rr.Header().Get(gzhttp.HeaderNoCompression))
+		assert.Equal(t, largeBody, rr.Body.String())
+	})
+
+	t.Run("compresses streamed responses when flushed", func(t *testing.T) {
+		streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte("data: second\n\n"))
+		})
+		rr := serve(CompressionOptions{brotliEnabled: true, jitter: 32}, streaming, "br")
+
+		assert.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+		assert.True(t, rr.Flushed)
+		assert.Equal(t, "data: first\n\ndata: second\n\n", unbrotli(t, rr.Body.Bytes()))
+	})
+}
+
+func TestCompressionHandler_levels(t *testing.T) {
+	largeBody := fixtureContent("loremipsum.txt")
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(largeBody)
+	})
+
+	serve := func(options CompressionOptions, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+
+		NewCompressionHandler(options, upstream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	gzipFastest := serve(CompressionOptions{gzipLevel: 1}, "gzip")
+	gzipSmallest := serve(CompressionOptions{gzipLevel: 9}, "gzip")
+	assert.Less(t, gzipSmallest.Body.Len(), gzipFastest.Body.Len())
+
+	zstdFastest := serve(CompressionOptions{zstdEnabled: true, zstdLevel: 1}, "zstd")
+	zstdSmallest := serve(CompressionOptions{zstdEnabled: true, zstdLevel: 4}, "zstd")
+	assert.Equal(t, "zstd", zstdSmallest.Header().Get("Content-Encoding"))
+	assert.Less(t, zstdSmallest.Body.Len(), zstdFastest.Body.Len())
+
+	outOfRange := serve(CompressionOptions{gzipLevel: 42}, "gzip")
+	assert.Equal(t, serve(CompressionOptions{}, "gzip").Body.Bytes(), outOfRange.Body.Bytes())
+}
+
+func TestCompressionHandler_policy(t *testing.T) {
+	largeBody := strings.Repeat("A", 2000)
+
+	serve := func(options CompressionOptions, acceptEncoding string, header http.Header, body string) *httptest.ResponseRecorder {
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			_, _ = w.Write([]byte(body))
+		})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+
+		NewCompressionHandler(options, upstream).ServeHTTP(rr, req)
+		return rr
+	}
+
+	contentType := func(value string) http.Header {
+		return http.Header{"Content-Type": {value}}
+	}
+
+	for _, encoding := range []string{"gzip", "br"} {
+		options := func(o CompressionOptions) CompressionOptions {
+			o.brotliEnabled = true
+			return o
+		}
+
+		t.Run(encoding+": excluded content types", func(t *testing.T) {
+			o := options(CompressionOptions{excludedContentTypes: []string{"font/*", "application/x-custom"}})
+
+			assert.Empty(t, serve(o, encoding, contentType("font/woff2"), largeBody).Header().Get("Content-Encoding"))
+			assert.Empty(t, serve(o, encoding, contentType("application/x-custom; charset=utf-8"), largeBody).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(o, encoding, contentType("application/x-custom-other"), largeBody).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(o, encoding, contentType("text/plain"), largeBody).Header().Get("Content-Encoding"))
+		})
+
+		t.Run(encoding+": allowed content types", func(t *testing.T) {
+			o := options(CompressionOptions{contentTypes: []string{"text/*", "image/png"}, excludedContentTypes: []string{"text/csv"}})
+
+			assert.Equal(t, encoding, serve(o, encoding, contentType("text/html"), largeBody).Header().Get("Content-Encoding"))
+			assert.Equal(t, encoding, serve(o, encoding, contentType("image/png"), largeBody).Header().Get("Content-Encoding"))
+			assert.Empty(t, serve(o, encoding, contentType("text/csv"), largeBody).Header().Get("Content-Encoding"))
+			assert.Empty(t, serve(o, encoding, contentType("application/json"), largeBody).Header().Get("Content-Encoding"))
+		})
+
+		t.Run(encoding+": minimum size", func(t *testing.T) {
+			o := options(CompressionOptions{minSize: 100})
+
+			assert.Equal(t, encoding, serve(o, encoding, contentType("text/plain"), strings.Repeat("A", 100)).Header().Get("Content-Encoding"))
+			assert.Empty(t, serve(o, encoding, contentType("text/plain"), strings.Repeat("A", 99)).Header().Get("Content-Encoding"))
+		})
+
+		t.Run(encoding+": no-transform", func(t *testing.T) {
+			o := options(CompressionOptions{})
+			header := http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"public, no-transform"}}
+
+			rr := serve(o, encoding, header, largeBody)
+			assert.Empty(t, rr.Header().Get("Content-Encoding"))
+			assert.Empty(t, rr.Header().Get(gzhttp.HeaderNoCompression))
+			assert.Equal(t, largeBody, rr.Body.String())
+		})
+
+		t.Run(encoding+": opt-out header", func(t *testing.T) {
+			o := options(CompressionOptions{optOutHeader: "X-No-Compression"})
+			header := http.Header{"Content-Type": {"text/plain"}, "X-No-Compression": {"1"}}
+
+			rr := serve(o, encoding, header, largeBody)
+			assert.Empty(t, rr.Header().Get("Content-Encoding"))
+			assert.Empty(t, rr.Header().Get("X-No-Compression"))
+			assert.Equal(t, largeBody, rr.Body.String())
+
+			rr = serve(options(CompressionOptions{}), encoding, header, largeBody)
+			assert.Equal(t, encoding, rr.Header().Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestCompressionHandler_contentTypeMatches(t *testing.T) {
+	patterns := []string{"text/*", "application/json", "IMAGE/SVG+XML"}
+
+	assert.True(t, contentTypeMatches("text/html", patterns))
+	assert.True(t, contentTypeMatches("Text/CSS; charset=utf-8", patterns))
+	assert.True(t, contentTypeMatches("application/json", patterns))
+	assert.True(t, contentTypeMatches("image/svg+xml", patterns))
+	assert.False(t, contentTypeMatches("application/json-seq", patterns))
+	assert.False(t, contentTypeMatches("image/png", patterns))
+	assert.False(t, contentTypeMatches("text/html", nil))
+	assert.True(t, contentTypeMatches("font/woff2", []string{"*"}))
+}
+
+func TestCompressionHandler_negotiateContentEncoding(t *testing.T) {
+	allEncodings := CompressionOptions{brotliEnabled: true, zstdEnabled: true}
+	gzipOnly := CompressionOptions{}
+
+	tests := map[string]struct {
+		options        CompressionOptions
+		method         string
+		acceptEncoding string
+		expected       string
+	}{
+		"none":                       {allEncodings, "GET", "", ""},
+		"gzip":                       {allEncodings, "GET", "gzip, deflate", "gzip"},
+		"zstd preferred":             {allEncodings, "GET", "gzip, deflate, br, zstd", "zstd"},
+		"br preferred over gzip":     {allEncodings, "GET", "gzip, deflate, br", "br"},
+		"gzip with higher q":         {allEncodings, "GET", "zstd;q=0.5, br;q=0.5, gzip", "gzip"},
+		"zstd with higher q":         {allEncodings, "GET", "zstd, gzip;q=0.8", "zstd"},
+		"br with higher q":           {allEncodings, "GET", "zstd;q=0.5, br, gzip;q=0.8", "br"},
+		"gzip refused":               {allEncodings, "GET", "gzip;q=0", ""},
+		"case insensitive":           {allEncodings, "GET", "GZIP", "gzip"},
+		"unsupported encodings":      {allEncodings, "GET", "deflate, compress", ""},
+		"disabled encodings":         {gzipOnly, "GET", "zstd, br, gzip;q=0.1", "gzip"},
+		"only disabled encodings":    {gzipOnly, "GET", "zstd, br", ""},
+		"HEAD is not compressed":     {allEncodings, "HEAD", "gzip", ""},
+		"HEAD is not compressed, br": {allEncodings, "HEAD", "br", ""},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+			assert.Equal(t, tc.expected, tc.options.negotiateContentEncoding(r))
+		})
+	}
+}
+
+// Helpers
+
+func unbrotli(t *testing.T, b []byte) string {
+	body, err := io.ReadAll(brotli.NewReader(bytes.NewReader(b)))
+	require.NoError(t, err)
+
+	return string(body)
+}
@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"github.com/klauspost/compress/gzhttp"
+)
+
+// newCompressionOptOutHandler lets the upstream ask for a response not to be
+// compressed. It sits between the compression writers and the rest of the
+// handlers, so that it can mark the response before they decide whether to
+// compress it.
+func newCompressionOptOutHandler(options CompressionOptions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&compressionOptOutResponseWriter{ResponseWriter: w, options: options}, r)
+	})
+}
+
+type compressionOptOutResponseWriter struct {
+	http.ResponseWriter
+	options CompressionOptions
+	checked bool
+}
+
+func (w *compressionOptOutResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= 200 {
+		w.checkHeaders()
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *compressionOptOutResponseWriter) Write(b []byte) (int, error) {
+	w.checkHeaders()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressionOptOutResponseWriter) Flush() {
+	w.checkHeaders()
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressionOptOutResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+func (w *compressionOptOutResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Private
+
+func (w *compressionOptOutResponseWriter) checkHeaders() {
+	if w.checked {
+		return
+	}
+	w.checked = true
+
+	header := w.Header()
+	if w.options.optedOut(header) {
+		header.Set(gzhttp.HeaderNoCompression, "1")
+	}
+
+	// The opt-out header is only meant for us.
+	if w.options.optOutHeader != "" {
+		header.Del(w.options.optOutHeader)
+	}
+}
@@ -17,15 +17,34 @@ const (
 
 	ENV_PREFIX = "THRUSTER_"
 
-	defaultTargetPort = 3000
+	defaultTargetPort          = 3000
+	defaultTargetSocketEnabled = false
 
+	defaultCacheStorage          = CacheStorageMemory
+	defaultCacheEvictionPolicy   = EvictionPolicySample
 	defaultCacheSize             = 64 * MB
+	defaultDiskCacheSize         = 256 * MB
 	defaultMaxCacheItemSizeBytes = 1 * MB
 	defaultMaxRequestBody        = 0
 
+	defaultRequestDecompressionEnabled = false
+
 	defaultACMEDirectoryURL = acme.LetsEncryptURL
 	defaultStoragePath      = "./storage/thruster"
 	defaultBadGatewayPage   = "./public/502.html"
+	defaultStartingPage     = "./public/503.html"
+
+	defaultUpstreamReadyTimeout = 10 * time.Second
+
+	defaultUpstreamRestartPolicy     = RestartPolicyNever
+	defaultUpstreamRestartBackoff    = 1 * time.Second
+	defaultUpstreamRestartMaxBackoff = 30 * time.Second
+	defaultUpstreamMaxRestarts       = 5
+	defaultUpstreamRestartWindow     = 60 * time.Second
+	defaultUpstreamReloadTimeout     = 60 * time.Second
+
+	defaultAdminPort             = 0
+	defaultCacheStatsLogInterval = 0
 
 	defaultHttpPort         = 80
 	defaultHttpsPort        = 443
@@ -33,6 +52,9 @@ const (
 	defaultHttpReadTimeout  = 30 * time.Second
 	defaultHttpWriteTimeout = 30 * time.Second
 
+	defaultShutdownDelay   = 0
+	defaultShutdownTimeout = 30 * time.Second
+
 	defaultH2CEnabled = false
 
 	defaultLogLevel    = slog.LevelInfo
@@ -40,20 +62,53 @@ const (
 
 	defaultGzipCompressionDisableOnAuth = false
 	defaultGzipCompressionJitter        = 32
+	defaultBrotliCompressionEnabled     = true
+	defaultZstdCompressionEnabled       = true
+)
+
+const (
+	CacheStorageMemory = "memory"
+	CacheStorageDisk   = "disk"
+	CacheStorageTiered = "tiered"
 )
 
 type Config struct {
-	TargetPort      int
-	UpstreamCommand string
-	UpstreamArgs    []string
-
-	CacheSizeBytes               int
-	MaxCacheItemSizeBytes        int
-	XSendfileEnabled             bool
-	GzipCompressionEnabled       bool
-	GzipCompressionDisableOnAuth bool
-	GzipCompressionJitter        int
-	MaxRequestBody               int
+	TargetPort          int
+	ReloadTargetPort    int
+	TargetSocketEnabled bool
+	UpstreamCommand     string
+	UpstreamArgs        []string
+
+	UpstreamRestartPolicy     string
+	UpstreamRestartBackoff    time.Duration
+	UpstreamRestartMaxBackoff time.Duration
+	UpstreamMaxRestarts       int
+	UpstreamRestartWindow     time.Duration
+	UpstreamReloadTimeout     time.Duration
+
+	CacheStorage                        string
+	CacheEvictionPolicy                 string
+	CacheKeyRules                       CacheKeyRules
+	CacheSizeBytes                      int
+	DiskCacheSizeBytes                  int
+	MaxCacheItemSizeBytes               int
+	XSendfileEnabled                    bool
+	GzipCompressionEnabled              bool
+	GzipCompressionDisableOnAuth        bool
+	GzipCompressionJitter               int
+	GzipCompressionLevel                int
+	BrotliCompressionEnabled            bool
+	BrotliCompressionLevel              int
+	ZstdCompressionEnabled              bool
+	ZstdCompressionLevel                int
+	GzipCompressionMinSize              int
+	GzipCompressionContentTypes         []string
+	GzipCompressionExcludedContentTypes []string
+	GzipCompressionOptOutHeader         string
+	GzipCompressionGuardRules           CompressionGuardRules
+	MaxRequestBody                      int
+	RequestDecompressionEnabled         bool
+	MaxDecompressedRequestBody          int
 
 	TLSDomains       []string
 	ACMEDirectoryURL string
@@ -61,6 +116,14 @@ type Config struct {
 	EAB_HMACKey      string
 	StoragePath      string
 	BadGatewayPage   string
+	StartingPage     string
+
+	UpstreamHealthCheckPath string
+	UpstreamReadyTimeout    time.Duration
+	HealthCheckPath         string
+
+	AdminPort             int
+	CacheStatsLogInterval time.Duration
 
 	HttpPort         int
 	HttpsPort        int
@@ -68,6 +131,9 @@ type Config struct {
 	HttpReadTimeout  time.Duration
 	HttpWriteTimeout time.Duration
 
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+
 	H2CEnabled bool
 
 	ForwardHeaders bool
@@ -87,17 +153,51 @@ func NewConfig() (*Config, error) {
 	}
 
 	config := &Config{
-		TargetPort:      getEnvInt("TARGET_PORT", defaultTargetPort),
-		UpstreamCommand: os.Args[1],
-		UpstreamArgs:    os.Args[2:],
-
-		CacheSizeBytes:               getEnvInt("CACHE_SIZE", defaultCacheSize),
-		MaxCacheItemSizeBytes:        getEnvInt("MAX_CACHE_ITEM_SIZE", defaultMaxCacheItemSizeBytes),
-		XSendfileEnabled:             getEnvBool("X_SENDFILE_ENABLED", true),
-		GzipCompressionEnabled:       getEnvBool("GZIP_COMPRESSION_ENABLED", true),
-		GzipCompressionDisableOnAuth: getEnvBool("GZIP_COMPRESSION_DISABLE_ON_AUTH", defaultGzipCompressionDisableOnAuth),
-		GzipCompressionJitter:        getEnvInt("GZIP_COMPRESSION_JITTER", defaultGzipCompressionJitter),
-		MaxRequestBody:               getEnvInt("MAX_REQUEST_BODY", defaultMaxRequestBody),
+		TargetPort:          getEnvInt("TARGET_PORT", defaultTargetPort),
+		TargetSocketEnabled: getEnvBool("TARGET_SOCKET_ENABLED", defaultTargetSocketEnabled),
+		UpstreamCommand:     os.Args[1],
+		UpstreamArgs:        os.Args[2:],
+
+		UpstreamRestartPolicy:     getEnvString("UPSTREAM_RESTART_POLICY", defaultUpstreamRestartPolicy),
+		UpstreamRestartBackoff:    getEnvDuration("UPSTREAM_RESTART_BACKOFF", defaultUpstreamRestartBackoff),
+		UpstreamRestartMaxBackoff: getEnvDuration("UPSTREAM_RESTART_MAX_BACKOFF", defaultUpstreamRestartMaxBackoff),
+		UpstreamMaxRestarts:       getEnvInt("UPSTREAM_MAX_RESTARTS", defaultUpstreamMaxRestarts),
+		UpstreamRestartWindow:     getEnvDuration("UPSTREAM_RESTART_WINDOW", defaultUpstreamRestartWindow),
+		UpstreamReloadTimeout:     getEnvDuration("UPSTREAM_RELOAD_TIMEOUT", defaultUpstreamReloadTimeout),
+
+		CacheStorage:        getEnvString("CACHE_STORAGE", defaultCacheStorage),
+		CacheEvictionPolicy: getEnvString("CACHE_EVICTION_POLICY", defaultCacheEvictionPolicy),
+		CacheKeyRules: CacheKeyRules{
+			IgnoreQueryParams: getEnvStrings("CACHE_KEY_IGNORE_QUERY_PARAMS", []string{}),
+			QueryParams:       getEnvStrings("CACHE_KEY_QUERY_PARAMS", []string{}),
+			IgnoreHost:        getEnvBool("CACHE_KEY_IGNORE_HOST", false),
+			Headers:           getEnvStrings("CACHE_KEY_HEADERS", []string{}),
+			Cookies:           getEnvStrings("CACHE_KEY_COOKIES", []string{}),
+		},
+		CacheSizeBytes:                      getEnvInt("CACHE_SIZE", defaultCacheSize),
+		DiskCacheSizeBytes:                  getEnvInt("DISK_CACHE_SIZE", defaultDiskCacheSize),
+		MaxCacheItemSizeBytes:               getEnvInt("MAX_CACHE_ITEM_SIZE", defaultMaxCacheItemSizeBytes),
+		XSendfileEnabled:                    getEnvBool("X_SENDFILE_ENABLED", true),
+		GzipCompressionEnabled:              getEnvBool("GZIP_COMPRESSION_ENABLED", true),
+		GzipCompressionDisableOnAuth:        getEnvBool("GZIP_COMPRESSION_DISABLE_ON_AUTH", defaultGzipCompressionDisableOnAuth),
+		GzipCompressionJitter:               getEnvInt("GZIP_COMPRESSION_JITTER", defaultGzipCompressionJitter),
+		GzipCompressionLevel:                getEnvInt("GZIP_COMPRESSION_LEVEL", defaultGzipCompressionLevel),
+		BrotliCompressionEnabled:            getEnvBool("BROTLI_COMPRESSION_ENABLED", defaultBrotliCompressionEnabled),
+		BrotliCompressionLevel:              getEnvInt("BROTLI_COMPRESSION_LEVEL", defaultBrotliCompressionLevel),
+		ZstdCompressionEnabled:              getEnvBool("ZSTD_COMPRESSION_ENABLED", defaultZstdCompressionEnabled),
+		ZstdCompressionLevel:                getEnvInt("ZSTD_COMPRESSION_LEVEL", defaultZstdCompressionLevel),
+		GzipCompressionMinSize:              getEnvInt("GZIP_COMPRESSION_MIN_SIZE", defaultCompressionMinSize),
+		GzipCompressionContentTypes:         getEnvStrings("GZIP_COMPRESSION_CONTENT_TYPES", []string{}),
+		GzipCompressionExcludedContentTypes: getEnvStrings("GZIP_COMPRESSION_EXCLUDED_CONTENT_TYPES", []string{}),
+		GzipCompressionOptOutHeader:         getEnvString("GZIP_COMPRESSION_OPT_OUT_HEADER", ""),
+		MaxRequestBody:                      getEnvInt("MAX_REQUEST_BODY", defaultMaxRequestBody),
+		RequestDecompressionEnabled:         getEnvBool("REQUEST_DECOMPRESSION_ENABLED", defaultRequestDecompressionEnabled),
+		MaxDecompressedRequestBody:          getEnvInt("MAX_DECOMPRESSED_REQUEST_BODY", 0),
+		GzipCompressionGuardRules: CompressionGuardRules{
+			AllowedPaths:  getEnvStrings("GZIP_COMPRESSION_GUARD_ALLOWED_PATHS", []string{}),
+			ContentTypes:  getEnvStrings("GZIP_COMPRESSION_GUARD_CONTENT_TYPES", []string{}),
+			SecretsHeader: getEnvString("GZIP_COMPRESSION_GUARD_SECRETS_HEADER", ""),
+		},
 
 		TLSDomains:       getEnvStrings("TLS_DOMAIN", []string{}),
 		ACMEDirectoryURL: getEnvString("ACME_DIRECTORY", defaultACMEDirectoryURL),
@@ -105,6 +205,14 @@ func NewConfig() (*Config, error) {
 		EAB_HMACKey:      getEnvString("EAB_HMAC_KEY", ""),
 		StoragePath:      getEnvString("STORAGE_PATH", defaultStoragePath),
 		BadGatewayPage:   getEnvString("BAD_GATEWAY_PAGE", defaultBadGatewayPage),
+		StartingPage:     getEnvString("STARTING_PAGE", defaultStartingPage),
+
+		UpstreamHealthCheckPath: getEnvString("UPSTREAM_HEALTH_CHECK_PATH", ""),
+		UpstreamReadyTimeout:    getEnvDuration("UPSTREAM_READY_TIMEOUT", defaultUpstreamReadyTimeout),
+		HealthCheckPath:         getEnvString("HEALTH_CHECK_PATH", ""),
+
+		AdminPort:             getEnvInt("ADMIN_PORT", defaultAdminPort),
+		CacheStatsLogInterval: getEnvDuration("CACHE_STATS_LOG_INTERVAL", defaultCacheStatsLogInterval),
 
 		HttpPort:         getEnvInt("HTTP_PORT", defaultHttpPort),
 		HttpsPort:        getEnvInt("HTTPS_PORT", defaultHttpsPort),
@@ -112,6 +220,9 @@ func NewConfig() (*Config, error) {
 		HttpReadTimeout:  getEnvDuration("HTTP_READ_TIMEOUT", defaultHttpReadTimeout),
 		HttpWriteTimeout: getEnvDuration("HTTP_WRITE_TIMEOUT", defaultHttpWriteTimeout),
 
+		ShutdownDelay:   getEnvDuration("SHUTDOWN_DELAY", defaultShutdownDelay),
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+
 		H2CEnabled: getEnvBool("H2C_ENABLED", defaultH2CEnabled),
 
 		LogLevel:    logLevel,
@@ -119,6 +230,7 @@ func NewConfig() (*Config, error) {
 	}
 
 	config.ForwardHeaders = getEnvBool("FORWARD_HEADERS", !config.HasTLS())
+	config.ReloadTargetPort = getEnvInt("RELOAD_TARGET_PORT", config.TargetPort+1)
 
 	return config, nil
 }
@@ -102,17 +102,67 @@ func TestConfig_defaults(t *testing.T) {
 	require.NoError(t, err)
 
 	assert.Equal(t, 3000, c.TargetPort)
+	assert.Equal(t, 3001, c.ReloadTargetPort)
+	assert.Equal(t, false, c.TargetSocketEnabled)
 	assert.Equal(t, "echo", c.UpstreamCommand)
+	assert.Equal(t, RestartPolicyNever, c.UpstreamRestartPolicy)
+	assert.Equal(t, time.Second, c.UpstreamRestartBackoff)
+	assert.Equal(t, 30*time.Second, c.UpstreamRestartMaxBackoff)
+	assert.Equal(t, 5, c.UpstreamMaxRestarts)
+	assert.Equal(t, 60*time.Second, c.UpstreamRestartWindow)
+	assert.Equal(t, 60*time.Second, c.UpstreamReloadTimeout)
+	assert.Equal(t, CacheStorageMemory, c.CacheStorage)
+	assert.Equal(t, EvictionPolicySample, c.CacheEvictionPolicy)
+	assert.Equal(t, CacheKeyRules{IgnoreQueryParams: []string{}, QueryParams: []string{}, Headers: []string{}, Cookies: []string{}}, c.CacheKeyRules)
 	assert.Equal(t, defaultCacheSize, c.CacheSizeBytes)
+	assert.Equal(t, defaultDiskCacheSize, c.DiskCacheSizeBytes)
+	assert.Equal(t, 0, c.AdminPort)
+	assert.Equal(t, time.Duration(0), c.CacheStatsLogInterval)
 	assert.Equal(t, slog.LevelInfo, c.LogLevel)
 	assert.Equal(t, false, c.H2CEnabled)
+	assert.Equal(t, defaultGzipCompressionLevel, c.GzipCompressionLevel)
+	assert.Equal(t, true, c.BrotliCompressionEnabled)
+	assert.Equal(t, defaultBrotliCompressionLevel, c.BrotliCompressionLevel)
+	assert.Equal(t, true, c.ZstdCompressionEnabled)
+	assert.Equal(t, defaultZstdCompressionLevel, c.ZstdCompressionLevel)
+	assert.Equal(t, defaultCompressionMinSize, c.GzipCompressionMinSize)
+	assert.Equal(t, []string{}, c.GzipCompressionContentTypes)
+	assert.Equal(t, []string{}, c.GzipCompressionExcludedContentTypes)
+	assert.Equal(t, "", c.GzipCompressionOptOutHeader)
+	assert.Equal(t, CompressionGuardRules{AllowedPaths: []string{}, ContentTypes: []string{}}, c.GzipCompressionGuardRules)
+	assert.Equal(t, false, c.RequestDecompressionEnabled)
+	assert.Equal(t, 0, c.MaxDecompressedRequestBody)
+	assert.Equal(t, defaultStartingPage, c.StartingPage)
+	assert.Equal(t, "", c.UpstreamHealthCheckPath)
+	assert.Equal(t, 10*time.Second, c.UpstreamReadyTimeout)
+	assert.Equal(t, "", c.HealthCheckPath)
+	assert.Equal(t, time.Duration(0), c.ShutdownDelay)
+	assert.Equal(t, 30*time.Second, c.ShutdownTimeout)
 }
 
 func TestConfig_override_defaults_with_env_vars(t *testing.T) {
 	usingProgramArgs(t, "thruster", "echo", "hello")
 	usingEnvVar(t, "TARGET_PORT", "4000")
+	usingEnvVar(t, "TARGET_SOCKET_ENABLED", "true")
+	usingEnvVar(t, "UPSTREAM_RESTART_POLICY", "on-failure")
+	usingEnvVar(t, "UPSTREAM_RESTART_BACKOFF", "2")
+	usingEnvVar(t, "UPSTREAM_RESTART_MAX_BACKOFF", "10")
+	usingEnvVar(t, "UPSTREAM_MAX_RESTARTS", "3")
+	usingEnvVar(t, "UPSTREAM_RESTART_WINDOW", "300")
+	usingEnvVar(t, "RELOAD_TARGET_PORT", "4500")
+	usingEnvVar(t, "UPSTREAM_RELOAD_TIMEOUT", "20")
 	usingEnvVar(t, "CACHE_SIZE", "256")
+	usingEnvVar(t, "CACHE_STORAGE", "disk")
+	usingEnvVar(t, "CACHE_EVICTION_POLICY", "tinylfu")
+	usingEnvVar(t, "CACHE_KEY_IGNORE_QUERY_PARAMS", "utm_*, fbclid")
+	usingEnvVar(t, "CACHE_KEY_IGNORE_HOST", "true")
+	usingEnvVar(t, "CACHE_KEY_COOKIES", "locale")
+	usingEnvVar(t, "DISK_CACHE_SIZE", "1024")
+	usingEnvVar(t, "ADMIN_PORT", "9000")
+	usingEnvVar(t, "CACHE_STATS_LOG_INTERVAL", "60")
 	usingEnvVar(t, "HTTP_READ_TIMEOUT", "5")
+	usingEnvVar(t, "SHUTDOWN_DELAY", "10")
+	usingEnvVar(t, "SHUTDOWN_TIMEOUT", "120")
 	usingEnvVar(t, "X_SENDFILE_ENABLED", "0")
 	usingEnvVar(t, "GZIP_COMPRESSION_ENABLED", "0")
 	usingEnvVar(t, "DEBUG", "1")
@@ -121,13 +171,49 @@ func TestConfig_override_defaults_with_env_vars(t *testing.T) {
 	usingEnvVar(t, "H2C_ENABLED", "true")
 	usingEnvVar(t, "GZIP_COMPRESSION_DISABLE_ON_AUTH", "true")
 	usingEnvVar(t, "GZIP_COMPRESSION_JITTER", "64")
+	usingEnvVar(t, "GZIP_COMPRESSION_LEVEL", "9")
+	usingEnvVar(t, "BROTLI_COMPRESSION_ENABLED", "false")
+	usingEnvVar(t, "BROTLI_COMPRESSION_LEVEL", "11")
+	usingEnvVar(t, "ZSTD_COMPRESSION_ENABLED", "false")
+	usingEnvVar(t, "ZSTD_COMPRESSION_LEVEL", "3")
+	usingEnvVar(t, "GZIP_COMPRESSION_MIN_SIZE", "256")
+	usingEnvVar(t, "GZIP_COMPRESSION_CONTENT_TYPES", "text/*, application/json")
+	usingEnvVar(t, "GZIP_COMPRESSION_EXCLUDED_CONTENT_TYPES", "font/*")
+	usingEnvVar(t, "GZIP_COMPRESSION_OPT_OUT_HEADER", "X-No-Compression")
+	usingEnvVar(t, "GZIP_COMPRESSION_GUARD_ALLOWED_PATHS", "/assets/*, /packs/*")
+	usingEnvVar(t, "GZIP_COMPRESSION_GUARD_CONTENT_TYPES", "text/html")
+	usingEnvVar(t, "GZIP_COMPRESSION_GUARD_SECRETS_HEADER", "X-Contains-Secrets")
+	usingEnvVar(t, "REQUEST_DECOMPRESSION_ENABLED", "true")
+	usingEnvVar(t, "MAX_DECOMPRESSED_REQUEST_BODY", "1048576")
+	usingEnvVar(t, "STARTING_PAGE", "./public/starting.html")
+	usingEnvVar(t, "UPSTREAM_HEALTH_CHECK_PATH", "/up")
+	usingEnvVar(t, "UPSTREAM_READY_TIMEOUT", "3")
+	usingEnvVar(t, "HEALTH_CHECK_PATH", "/_thruster/health")
 
 	c, err := NewConfig()
 	require.NoError(t, err)
 
 	assert.Equal(t, 4000, c.TargetPort)
+	assert.Equal(t, true, c.TargetSocketEnabled)
+	assert.Equal(t, RestartPolicyOnFailure, c.UpstreamRestartPolicy)
+	assert.Equal(t, 2*time.Second, c.UpstreamRestartBackoff)
+	assert.Equal(t, 10*time.Second, c.UpstreamRestartMaxBackoff)
+	assert.Equal(t, 3, c.UpstreamMaxRestarts)
+	assert.Equal(t, 300*time.Second, c.UpstreamRestartWindow)
+	assert.Equal(t, 4500, c.ReloadTargetPort)
+	assert.Equal(t, 20*time.Second, c.UpstreamReloadTimeout)
 	assert.Equal(t, 256, c.CacheSizeBytes)
+	assert.Equal(t, CacheStorageDisk, c.CacheStorage)
+	assert.Equal(t, EvictionPolicyTinyLFU, c.CacheEvictionPolicy)
+	assert.Equal(t, []string{"utm_*", "fbclid"}, c.CacheKeyRules.IgnoreQueryParams)
+	assert.Equal(t, true, c.CacheKeyRules.IgnoreHost)
+	assert.Equal(t, []string{"locale"}, c.CacheKeyRules.Cookies)
+	assert.Equal(t, 1024, c.DiskCacheSizeBytes)
+	assert.Equal(t, 9000, c.AdminPort)
+	assert.Equal(t, 60*time.Second, c.CacheStatsLogInterval)
 	assert.Equal(t, 5*time.Second, c.HttpReadTimeout)
+	assert.Equal(t, 10*time.Second, c.ShutdownDelay)
+	assert.Equal(t, 120*time.Second, c.ShutdownTimeout)
 	assert.Equal(t, false, c.XSendfileEnabled)
 	assert.Equal(t, false, c.GzipCompressionEnabled)
 	assert.Equal(t, slog.LevelDebug, c.LogLevel)
@@ -136,6 +222,24 @@ func TestConfig_override_defaults_with_env_vars(t *testing.T) {
 	assert.Equal(t, true, c.H2CEnabled)
 	assert.Equal(t, true, c.GzipCompressionDisableOnAuth)
 	assert.Equal(t, 64, c.GzipCompressionJitter)
+	assert.Equal(t, 9, c.GzipCompressionLevel)
+	assert.Equal(t, false, c.BrotliCompressionEnabled)
+	assert.Equal(t, 11, c.BrotliCompressionLevel)
+	assert.Equal(t, false, c.ZstdCompressionEnabled)
+	assert.Equal(t, 3, c.ZstdCompressionLevel)
+	assert.Equal(t, 256, c.GzipCompressionMinSize)
+	assert.Equal(t, []string{"text/*", "application/json"}, c.GzipCompressionContentTypes)
+	assert.Equal(t, []string{"font/*"}, c.GzipCompressionExcludedContentTypes)
+	assert.Equal(t, "X-No-Compression", c.GzipCompressionOptOutHeader)
+	assert.Equal(t, []string{"/assets/*", "/packs/*"}, c.GzipCompressionGuardRules.AllowedPaths)
+	assert.Equal(t, []string{"text/html"}, c.GzipCompressionGuardRules.ContentTypes)
+	assert.Equal(t, "X-Contains-Secrets", c.GzipCompressionGuardRules.SecretsHeader)
+	assert.Equal(t, true, c.RequestDecompressionEnabled)
+	assert.Equal(t, 1048576, c.MaxDecompressedRequestBody)
+	assert.Equal(t, "./public/starting.html", c.StartingPage)
+	assert.Equal(t, "/up", c.UpstreamHealthCheckPath)
+	assert.Equal(t, 3*time.Second, c.UpstreamReadyTimeout)
+	assert.Equal(t, "/_thruster/health", c.HealthCheckPath)
 }
 
 func TestConfig_override_defaults_with_env_vars_using_prefix(t *testing.T) {
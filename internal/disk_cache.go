@@ -0,0 +1,484 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheMagic      = "THRC"
+	diskCacheVersion    = 3
+	diskCacheTempSuffix = ".tmp"
+)
+
+var ErrInvalidDiskCacheEntry = errors.New("invalid disk cache entry")
+
+type DiskCacheEntry struct {
+	lastAccessedAt time.Time
+	expiresAt      time.Time
+	size           int
+	tags           []string
+	hits           int64
+}
+
+type DiskCacheEntryMap map[CacheKey]*DiskCacheEntry
+
+// DiskCache stores cached items as individual files beneath a directory, so
+// that they survive a restart. The index of keys, sizes, expiry times and
+// tags is kept in memory, and rebuilt from the directory contents when the
+// cache is opened.
+//
+// Each file starts with a header containing the expiry time and tags of the
+// item, followed by its value.
+type DiskCache struct {
+	sync.Mutex
+	path           string
+	capacity       int
+	maxItemSize    int
+	size           int
+	items          DiskCacheEntryMap
+	policy         *sampledEvictionPolicy
+	tags           cacheTagIndex
+	stores         int64
+	evictions      CacheEvictionStats
+	getCurrentTime GetCurrentTime
+}
+
+func NewDiskCache(path string, capacity, maxItemSize int) (*DiskCache, error) {
+	c := &DiskCache{
+		path:           path,
+		capacity:       capacity,
+		maxItemSize:    maxItemSize,
+		size:           0,
+		items:          DiskCacheEntryMap{},
+		tags:           cacheTagIndex{},
+		getCurrentTime: time.Now,
+	}
+	c.policy = newSampledEvictionPolicy(c)
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *DiskCache) Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string) {
+	itemSize := len(value)
+	if itemSize > c.maxItemSize || itemSize > c.capacity {
+		slog.Debug("Cache: item is too large to store", "len", itemSize)
+		c.Lock()
+		c.evictions.TooLarge++
+		c.Unlock()
+		return
+	}
+
+	tempName, err := c.writeTempFile(value, expiresAt, tags)
+	if err != nil {
+		slog.Error("Cache: failed to write item to disk", "key", key, "error", err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	existingItem, ok := c.items[key]
+	if ok {
+		c.size -= existingItem.size
+		existingItem.size = 0
+	}
+
+	limit := c.capacity - itemSize
+	for c.size > limit {
+		slog.Debug("Cache: evicting item to make space", "current_size", c.size, "need_size", limit)
+		c.evictOldestItem()
+	}
+
+	err = os.Rename(tempName, c.filename(key))
+	if err != nil {
+		slog.Error("Cache: failed to store item on disk", "key", key, "error", err)
+		os.Remove(tempName)
+		if _, ok := c.items[key]; ok {
+			c.removeItem(key)
+		}
+		return
+	}
+
+	existingItem, ok = c.items[key]
+	if ok {
+		c.tags.remove(key, existingItem.tags)
+	} else {
+		c.policy.added(key)
+	}
+
+	c.items[key] = &DiskCacheEntry{
+		lastAccessedAt: c.getCurrentTime(),
+		expiresAt:      expiresAt,
+		size:           itemSize,
+		tags:           tags,
+	}
+
+	c.size += itemSize
+	c.tags.add(key, tags)
+	c.stores++
+
+	slog.Debug("Cache: added item", "key", key, "size", itemSize, "expires_at", expiresAt)
+}
+
+func (c *DiskCache) Get(key CacheKey) ([]byte, bool) {
+	value, _, _, ok := c.get(key)
+	return value, ok
+}
+
+func (c *DiskCache) Delete(key CacheKey) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	_, ok := c.items[key]
+	if ok {
+		c.removeItem(key)
+		os.Remove(c.filename(key))
+	}
+
+	return ok
+}
+
+func (c *DiskCache) DeleteTagged(match CacheTagMatcher) int {
+	return len(c.deleteTagged(match))
+}
+
+func (c *DiskCache) Clear() int {
+	return len(c.clear())
+}
+
+func (c *DiskCache) Stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{
+		Items:         len(c.items),
+		SizeBytes:     c.size,
+		CapacityBytes: c.capacity,
+		Stores:        c.stores,
+		Evictions:     c.evictions,
+	}
+}
+
+func (c *DiskCache) Entries() []CacheEntryInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	entries := make([]CacheEntryInfo, 0, len(c.items))
+	for key, item := range c.items {
+		entries = append(entries, CacheEntryInfo{
+			Key:       key,
+			Size:      item.size,
+			Hits:      item.hits,
+			ExpiresAt: item.expiresAt,
+			Tags:      item.tags,
+		})
+	}
+
+	return entries
+}
+
+// Private
+
+func (c *DiskCache) deleteTagged(match CacheTagMatcher) []CacheKey {
+	c.Lock()
+	defer c.Unlock()
+
+	keys := c.tags.matching(match)
+	for _, key := range keys {
+		c.removeItem(key)
+		os.Remove(c.filename(key))
+	}
+
+	return keys
+}
+
+func (c *DiskCache) clear() []CacheKey {
+	c.Lock()
+	defer c.Unlock()
+
+	keys := c.policy.keys
+	for _, key := range keys {
+		os.Remove(c.filename(key))
+	}
+
+	c.size = 0
+	c.items = DiskCacheEntryMap{}
+	c.policy = newSampledEvictionPolicy(c)
+	c.tags = cacheTagIndex{}
+
+	return keys
+}
+
+func (c *DiskCache) get(key CacheKey) ([]byte, time.Time, []string, bool) {
+	c.Lock()
+
+	now := c.getCurrentTime()
+
+	item, ok := c.items[key]
+	if !ok || item.expiresAt.Before(now) {
+		c.Unlock()
+		return nil, time.Time{}, nil, false
+	}
+
+	item.lastAccessedAt = now
+	item.hits++
+	c.Unlock()
+
+	value, expiresAt, tags, err := c.readFile(c.filename(key))
+	if err != nil {
+		slog.Debug("Cache: failed to read item from disk", "key", key, "error", err)
+		return nil, time.Time{}, nil, false
+	}
+
+	return value, expiresAt, tags, true
+}
+
+func (c *DiskCache) contains(key CacheKey, expiresAt time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	item, ok := c.items[key]
+	return ok && item.expiresAt.Equal(expiresAt)
+}
+
+func (c *DiskCache) load() error {
+	entries, err := os.ReadDir(c.path)
+	if err != nil {
+		return err
+	}
+
+	now := c.getCurrentTime()
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := filepath.Join(c.path, entry.Name())
+		if strings.HasSuffix(entry.Name(), diskCacheTempSuffix) {
+			os.Remove(name)
+			continue
+		}
+
+		key, err := strconv.ParseUint(entry.Name(), 16, 64)
+		if err != nil {
+			continue
+		}
+
+		expiresAt, tags, size, err := c.readFileHeader(name)
+		if err != nil || expiresAt.Before(now) {
+			os.Remove(name)
+			continue
+		}
+
+		c.policy.added(CacheKey(key))
+		c.items[CacheKey(key)] = &DiskCacheEntry{
+			lastAccessedAt: now,
+			expiresAt:      expiresAt,
+			size:           size,
+			tags:           tags,
+		}
+		c.size += size
+		c.tags.add(CacheKey(key), tags)
+	}
+
+	for c.size > c.capacity {
+		c.evictOldestItem()
+	}
+
+	slog.Debug("Cache: loaded items from disk", "path", c.path, "items", len(c.items), "size", c.size)
+	return nil
+}
+
+func (c *DiskCache) evictOldestItem() {
+	key := c.policy.victim()
+	item := c.items[key]
+
+	c.evictions.recordEviction(item.expiresAt.Before(c.getCurrentTime()))
+	c.removeItem(key)
+	os.Remove(c.filename(key))
+}
+
+func (c *DiskCache) removeItem(key CacheKey) {
+	item := c.items[key]
+
+	c.size -= item.size
+	c.tags.remove(key, item.tags)
+	c.policy.removed(key)
+	delete(c.items, key)
+}
+
+func (c *DiskCache) now() time.Time {
+	return c.getCurrentTime()
+}
+
+func (c *DiskCache) accessTimes(key CacheKey) (time.Time, time.Time) {
+	item := c.items[key]
+	return item.lastAccessedAt, item.expiresAt
+}
+
+func (c *DiskCache) filename(key CacheKey) string {
+	return filepath.Join(c.path, fmt.Sprintf("%016x", uint64(key)))
+}
+
+func (c *DiskCache) writeTempFile(value []byte, expiresAt time.Time, tags []string) (string, error) {
+	f, err := os.CreateTemp(c.path, "*"+diskCacheTempSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	w := bufio.NewWriter(f)
+	err = c.writeHeader(w, expiresAt, tags)
+	if err == nil {
+		_, err = w.Write(value)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (c *DiskCache) readFile(name string) ([]byte, time.Time, []string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, nil, err
+	}
+
+	r := &countingReader{r: bytes.NewReader(b)}
+	expiresAt, tags, err := c.readHeader(r)
+	if err != nil {
+		return nil, time.Time{}, nil, err
+	}
+
+	return b[r.count:], expiresAt, tags, nil
+}
+
+func (c *DiskCache) readFileHeader(name string) (time.Time, []string, int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return time.Time{}, nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, nil, 0, err
+	}
+
+	r := &countingReader{r: bufio.NewReader(f)}
+	expiresAt, tags, err := c.readHeader(r)
+	if err != nil {
+		return time.Time{}, nil, 0, err
+	}
+
+	return expiresAt, tags, int(info.Size()) - r.count, nil
+}
+
+func (c *DiskCache) writeHeader(w io.Writer, expiresAt time.Time, tags []string) error {
+	header := []byte(diskCacheMagic)
+	header = append(header, diskCacheVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(expiresAt.UnixNano()))
+	header = binary.AppendUvarint(header, uint64(len(tags)))
+
+	for _, tag := range tags {
+		header = binary.AppendUvarint(header, uint64(len(tag)))
+		header = append(header, tag...)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func (c *DiskCache) readHeader(r *countingReader) (time.Time, []string, error) {
+	prefix := make([]byte, len(diskCacheMagic)+1)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil || string(prefix[:len(diskCacheMagic)]) != diskCacheMagic || prefix[len(diskCacheMagic)] != diskCacheVersion {
+		return time.Time{}, nil, ErrInvalidDiskCacheEntry
+	}
+
+	var nanos uint64
+	err = binary.Read(r, binary.BigEndian, &nanos)
+	if err != nil {
+		return time.Time{}, nil, ErrInvalidDiskCacheEntry
+	}
+
+	tagCount, err := binary.ReadUvarint(r)
+	if err != nil {
+		return time.Time{}, nil, ErrInvalidDiskCacheEntry
+	}
+
+	// Lengths are checked against what can actually be read, rather than
+	// trusted up front, so that a corrupt header can't make us allocate
+	// an arbitrary amount of memory.
+	var tags []string
+	for range tagCount {
+		tagLength, err := binary.ReadUvarint(r)
+		if err != nil {
+			return time.Time{}, nil, ErrInvalidDiskCacheEntry
+		}
+
+		tag, err := io.ReadAll(io.LimitReader(r, int64(min(tagLength, math.MaxInt64))))
+		if err != nil || uint64(len(tag)) != tagLength {
+			return time.Time{}, nil, ErrInvalidDiskCacheEntry
+		}
+		tags = append(tags, string(tag))
+	}
+
+	return time.Unix(0, int64(nanos)), tags, nil
+}
+
+// countingReader tracks how many bytes have been read, so that we know where
+// the header ends.
+type countingReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	count int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.count += n
+	return n, err
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.count++
+	}
+	return b, err
+}
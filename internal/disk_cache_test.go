@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskCache_store_and_retrieve(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 32*MB, 1*MB)
+	c.Set(1, []byte("hello world"), time.Now().Add(30*time.Second))
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+}
+
+func TestDiskCache_storing_updates_existing_value(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 32*MB, 1*MB)
+	c.Set(1, []byte("first"), time.Now().Add(30*time.Second))
+	c.Set(1, []byte("second"), time.Now().Add(30*time.Second))
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("second"), read)
+
+	assert.Equal(t, 1, len(c.policy.keys))
+	assert.Equal(t, 6, c.size)
+}
+
+func TestDiskCache_expiry(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 32*MB, 1*MB)
+	now := time.Date(2023, 1, 22, 17, 30, 0, 0, time.UTC)
+
+	c.getCurrentTime = func() time.Time { return now }
+	c.Set(1, []byte("hello world"), now.Add(1*time.Second))
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+
+	c.getCurrentTime = func() time.Time { return now.Add(2 * time.Second) }
+
+	_, ok = c.Get(1)
+	assert.False(t, ok)
+}
+
+func TestDiskCache_items_persist_when_reopened(t *testing.T) {
+	dir := t.TempDir()
+	expiresAt := time.Now().Add(1 * time.Hour).Truncate(time.Second)
+
+	c := newTestDiskCache(t, dir, 32*MB, 1*MB)
+	c.Set(1, []byte("hello world"), expiresAt)
+	c.Set(2, []byte("goodbye"), expiresAt)
+
+	c = newTestDiskCache(t, dir, 32*MB, 1*MB)
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+
+	read, ok = c.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("goodbye"), read)
+
+	assert.Equal(t, 2, len(c.policy.keys))
+	assert.Equal(t, 18, c.size)
+	assert.True(t, expiresAt.Equal(c.items[1].expiresAt))
+}
+
+func TestDiskCache_tags_persist_when_reopened(t *testing.T) {
+	dir := t.TempDir()
+
+	c := newTestDiskCache(t, dir, 32*MB, 1*MB)
+	c.Set(1, []byte("hello world"), time.Now().Add(1*time.Hour), "url:example.com/", "key:home")
+	c.Set(2, []byte("goodbye"), time.Now().Add(1*time.Hour))
+
+	c = newTestDiskCache(t, dir, 32*MB, 1*MB)
+	assert.Equal(t, []string{"url:example.com/", "key:home"}, c.items[1].tags)
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+
+	assert.Equal(t, 1, c.DeleteTagged(matchSurrogateKey("home")))
+	assert.NoFileExists(t, c.filename(1))
+	assert.FileExists(t, c.filename(2))
+}
+
+func TestDiskCache_long_and_numerous_tags_persist_when_reopened(t *testing.T) {
+	dir := t.TempDir()
+
+	longTag := "key:" + strings.Repeat("a", 70000)
+	manyTags := make([]string, 70000)
+	for i := range manyTags {
+		manyTags[i] = fmt.Sprintf("key:%d", i)
+	}
+
+	c := newTestDiskCache(t, dir, 32*MB, 1*MB)
+	c.Set(1, []byte("hello"), time.Now().Add(1*time.Hour), longTag)
+	c.Set(2, []byte("world"), time.Now().Add(1*time.Hour), manyTags...)
+
+	c = newTestDiskCache(t, dir, 32*MB, 1*MB)
+	assert.Equal(t, []string{longTag}, c.items[1].tags)
+	assert.Equal(t, manyTags, c.items[2].tags)
+
+	read, ok := c.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("world"), read)
+}
+
+func TestDiskCache_delete_and_clear(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 32*MB, 1*MB)
+	c.Set(1, []byte("hello"), time.Now().Add(1*time.Hour))
+	c.Set(2, []byte("world"), time.Now().Add(1*time.Hour))
+	c.Set(3, []byte("again"), time.Now().Add(1*time.Hour))
+
+	assert.True(t, c.Delete(1))
+	assert.False(t, c.Delete(1))
+	assert.NoFileExists(t, c.filename(1))
+	assert.Equal(t, 10, c.size)
+
+	assert.Equal(t, 2, c.Clear())
+	assert.NoFileExists(t, c.filename(2))
+	assert.NoFileExists(t, c.filename(3))
+	assert.Equal(t, 0, c.size)
+	assert.Equal(t, 0, len(c.policy.keys))
+}
+
+func TestDiskCache_delete_tagged_keeps_keys_indexed(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 32*MB, 1*MB)
+	for i := range 100 {
+		tag := surrogateCacheTag("odd")
+		if i%2 == 0 {
+			tag = surrogateCacheTag("even")
+		}
+		c.Set(CacheKey(i), []byte("hello"), time.Now().Add(1*time.Hour), tag)
+	}
+
+	assert.Equal(t, 50, c.DeleteTagged(matchSurrogateKey("even")))
+	assert.Equal(t, 50, len(c.policy.keys))
+
+	for index, key := range c.policy.keys {
+		assert.Equal(t, 1, int(key)%2)
+		assert.Equal(t, index, c.policy.indexes[key])
+	}
+}
+
+func TestDiskCache_expired_items_are_removed_when_reopened(t *testing.T) {
+	dir := t.TempDir()
+
+	c := newTestDiskCache(t, dir, 32*MB, 1*MB)
+	c.Set(1, []byte("hello world"), time.Now().Add(-1*time.Second))
+	c.Set(2, []byte("goodbye"), time.Now().Add(1*time.Hour))
+
+	c = newTestDiskCache(t, dir, 32*MB, 1*MB)
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	assert.NoFileExists(t, c.filename(1))
+
+	_, ok = c.Get(2)
+	assert.True(t, ok)
+}
+
+func TestDiskCache_reopening_with_smaller_capacity_evicts_items(t *testing.T) {
+	dir := t.TempDir()
+
+	c := newTestDiskCache(t, dir, 10*KB, 1*KB)
+	for i := range CacheKey(10) {
+		c.Set(i, bytes.Repeat([]byte{byte(i)}, 1*KB), time.Now().Add(1*time.Hour))
+	}
+	assert.Equal(t, 10*KB, c.size)
+
+	c = newTestDiskCache(t, dir, 5*KB, 1*KB)
+	assert.Equal(t, 5*KB, c.size)
+	assert.Equal(t, 5, len(c.policy.keys))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 5, len(files))
+}
+
+func TestDiskCache_ignores_unknown_and_invalid_files(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0000000000000001"), []byte("not a cache entry"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "123"+diskCacheTempSuffix), []byte("partial"), 0644))
+
+	c := newTestDiskCache(t, dir, 32*MB, 1*MB)
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 0, len(c.policy.keys))
+	assert.FileExists(t, filepath.Join(dir, "README"))
+	assert.NoFileExists(t, filepath.Join(dir, "0000000000000001"))
+	assert.NoFileExists(t, filepath.Join(dir, "123"+diskCacheTempSuffix))
+}
+
+func TestDiskCache_does_not_store_items_over_cache_limit(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 3*KB, 50*KB)
+
+	payload := make([]byte, 10*KB)
+	c.Set(1, payload, time.Now().Add(1*time.Hour))
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+}
+
+func TestDiskCache_does_not_store_items_over_item_limit(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 50*KB, 3*KB)
+
+	payload := make([]byte, 10*KB)
+	c.Set(1, payload, time.Now().Add(1*time.Hour))
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+}
+
+func TestDiskCache_items_are_evicted_to_make_space(t *testing.T) {
+	dir := t.TempDir()
+	maxCacheSize := 10 * KB
+	c := newTestDiskCache(t, dir, maxCacheSize, 1*KB)
+
+	for i := range CacheKey(20) {
+		payload := bytes.Repeat([]byte{byte(i)}, 1*KB)
+		c.Set(i, payload, time.Now().Add(1*time.Hour))
+
+		retrieved, ok := c.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, payload, retrieved)
+	}
+
+	assert.Equal(t, maxCacheSize, c.size)
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 10, len(files))
+}
+
+func TestDiskCache_stats(t *testing.T) {
+	c := newTestDiskCache(t, t.TempDir(), 2*KB, 1*KB)
+
+	c.Set(1, make([]byte, 1*KB), time.Now().Add(1*time.Hour), "url:example.com/1")
+	c.Set(2, make([]byte, 1*KB), time.Now().Add(1*time.Hour))
+	c.Set(3, make([]byte, 1*KB), time.Now().Add(1*time.Hour))
+	c.Set(4, make([]byte, 2*KB), time.Now().Add(1*time.Hour))
+
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Items)
+	assert.Equal(t, 2*KB, stats.SizeBytes)
+	assert.Equal(t, int64(3), stats.Stores)
+	assert.Equal(t, CacheEvictionStats{Capacity: 1, TooLarge: 1}, stats.Evictions)
+
+	c.Get(3)
+	for _, entry := range c.Entries() {
+		if entry.Key == 3 {
+			assert.Equal(t, int64(1), entry.Hits)
+		}
+	}
+}
+
+// Helpers
+
+func newTestDiskCache(t *testing.T, path string, capacity, maxItemSize int) *DiskCache {
+	c, err := NewDiskCache(path, capacity, maxItemSize)
+	require.NoError(t, err)
+
+	return c
+}
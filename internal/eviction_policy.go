@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"container/list"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+const (
+	EvictionPolicySample  = "sample"
+	EvictionPolicyLRU     = "lru"
+	EvictionPolicyTinyLFU = "tinylfu"
+)
+
+// evictionPolicy decides which items a MemoryCache removes when it needs to
+// make space. Each shard of the cache has its own policy, and its methods are
+// only called while that shard is locked.
+type evictionPolicy interface {
+	// accessed is called for every lookup, whether or not the item was found.
+	accessed(key CacheKey, found bool)
+	added(key CacheKey)
+	removed(key CacheKey)
+
+	// victim returns the item that should be evicted next. It is only called
+	// when the cache contains at least one item.
+	victim() CacheKey
+
+	// admit reports whether a new item is worth storing, given that doing so
+	// means evicting victim.
+	admit(key CacheKey, victim CacheKey) bool
+}
+
+func newEvictionPolicy(name string, s *memoryCacheShard) evictionPolicy {
+	switch name {
+	case EvictionPolicyLRU:
+		return newLRUEvictionPolicy()
+	case EvictionPolicyTinyLFU:
+		return newTinyLFUEvictionPolicy(s.capacity)
+	default:
+		return newSampledEvictionPolicy(s)
+	}
+}
+
+// sampledItems gives a sampledEvictionPolicy what it needs to know about the
+// items it chooses between.
+type sampledItems interface {
+	now() time.Time
+	accessTimes(key CacheKey) (lastAccessedAt time.Time, expiresAt time.Time)
+}
+
+// sampledEvictionPolicy picks 5 random items and evicts the oldest one. On
+// average we'll evict items in the oldest 20%, which is good enough and is
+// much faster than scanning through them all.
+//
+// If we find an expired item while looking, that's a better choice to evict,
+// so we can choose it immediately.
+//
+// The DiskCache uses this policy too, to choose which files to remove.
+type sampledEvictionPolicy struct {
+	items   sampledItems
+	keys    MemoryCacheKeyList
+	indexes map[CacheKey]int
+}
+
+func newSampledEvictionPolicy(items sampledItems) *sampledEvictionPolicy {
+	return &sampledEvictionPolicy{
+		items:   items,
+		keys:    MemoryCacheKeyList{},
+		indexes: map[CacheKey]int{},
+	}
+}
+
+func (p *sampledEvictionPolicy) accessed(key CacheKey, found bool) {}
+
+func (p *sampledEvictionPolicy) added(key CacheKey) {
+	p.indexes[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *sampledEvictionPolicy) removed(key CacheKey) {
+	index, ok := p.indexes[key]
+	if !ok {
+		return
+	}
+
+	last := p.keys[len(p.keys)-1]
+	p.keys[index] = last
+	p.indexes[last] = index
+
+	p.keys = p.keys[:len(p.keys)-1]
+	delete(p.indexes, key)
+}
+
+func (p *sampledEvictionPolicy) victim() CacheKey {
+	var oldestKey CacheKey
+	var oldest time.Time
+
+	now := p.items.now()
+
+	for range 5 {
+		key := p.keys[rand.Intn(len(p.keys))]
+		lastAccessedAt, expiresAt := p.items.accessTimes(key)
+
+		if expiresAt.Before(now) {
+			return key
+		}
+
+		if lastAccessedAt.Before(oldest) || oldest.IsZero() {
+			oldest = lastAccessedAt
+			oldestKey = key
+		}
+	}
+
+	return oldestKey
+}
+
+func (p *sampledEvictionPolicy) admit(key CacheKey, victim CacheKey) bool {
+	return true
+}
+
+// lruEvictionPolicy always evicts the least recently used item.
+type lruEvictionPolicy struct {
+	order    *list.List
+	elements map[CacheKey]*list.Element
+}
+
+func newLRUEvictionPolicy() *lruEvictionPolicy {
+	return &lruEvictionPolicy{
+		order:    list.New(),
+		elements: map[CacheKey]*list.Element{},
+	}
+}
+
+func (p *lruEvictionPolicy) accessed(key CacheKey, found bool) {
+	element, ok := p.elements[key]
+	if ok {
+		p.order.MoveToFront(element)
+	}
+}
+
+func (p *lruEvictionPolicy) added(key CacheKey) {
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruEvictionPolicy) removed(key CacheKey) {
+	element, ok := p.elements[key]
+	if ok {
+		p.order.Remove(element)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruEvictionPolicy) victim() CacheKey {
+	return p.order.Back().Value.(CacheKey)
+}
+
+func (p *lruEvictionPolicy) admit(key CacheKey, victim CacheKey) bool {
+	return true
+}
+
+// tinyLFUEvictionPolicy evicts the least recently used item, but only admits
+// a new item when it has been requested more often than the item it would
+// replace. This stops a burst of one-off requests, like a crawler working
+// through every page, from pushing out the items that are used the most.
+//
+// Request frequencies are estimated with a count-min sketch, which is
+// periodically halved so that it favours recent popularity.
+type tinyLFUEvictionPolicy struct {
+	lruEvictionPolicy
+	sketch *frequencySketch
+}
+
+func newTinyLFUEvictionPolicy(capacity int) *tinyLFUEvictionPolicy {
+	return &tinyLFUEvictionPolicy{
+		lruEvictionPolicy: *newLRUEvictionPolicy(),
+		sketch:            newFrequencySketch(capacity / tinyLFUExpectedItemSize),
+	}
+}
+
+func (p *tinyLFUEvictionPolicy) accessed(key CacheKey, found bool) {
+	p.lruEvictionPolicy.accessed(key, found)
+	p.sketch.increment(key)
+}
+
+func (p *tinyLFUEvictionPolicy) admit(key CacheKey, victim CacheKey) bool {
+	return p.sketch.estimate(key) > p.sketch.estimate(victim)
+}
+
+// We size the sketch based on how many items we expect the cache to hold. It
+// only needs to be a rough guess.
+const tinyLFUExpectedItemSize = 4 * KB
+
+const (
+	frequencySketchDepth    = 4
+	frequencySketchMaxCount = 15
+	frequencySketchMinWidth = 1024
+	frequencySketchMaxWidth = 1 << 22
+)
+
+var frequencySketchSeeds = [frequencySketchDepth]uint64{
+	0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xc2b2ae3d27d4eb4f,
+}
+
+type frequencySketch struct {
+	rows       [frequencySketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newFrequencySketch(expectedItems int) *frequencySketch {
+	width := min(max(expectedItems, frequencySketchMinWidth), frequencySketchMaxWidth)
+	width = 1 << bits.Len(uint(width-1))
+
+	s := &frequencySketch{
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+func (s *frequencySketch) increment(key CacheKey) {
+	added := false
+	for i := range s.rows {
+		index := s.index(key, i)
+		if s.rows[i][index] < frequencySketchMaxCount {
+			s.rows[i][index]++
+			added = true
+		}
+	}
+
+	if added {
+		s.additions++
+		if s.additions >= s.sampleSize {
+			s.reset()
+		}
+	}
+}
+
+func (s *frequencySketch) estimate(key CacheKey) uint8 {
+	estimate := uint8(frequencySketchMaxCount)
+	for i := range s.rows {
+		estimate = min(estimate, s.rows[i][s.index(key, i)])
+	}
+
+	return estimate
+}
+
+func (s *frequencySketch) index(key CacheKey, row int) uint64 {
+	h := (uint64(key) ^ frequencySketchSeeds[row]) * frequencySketchSeeds[(row+1)%frequencySketchDepth]
+	return (h >> 32) & s.mask
+}
+
+func (s *frequencySketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrequencySketch_estimates_frequency(t *testing.T) {
+	s := newFrequencySketch(1024)
+
+	for range 5 {
+		s.increment(1)
+	}
+	s.increment(2)
+
+	assert.Equal(t, uint8(5), s.estimate(1))
+	assert.Equal(t, uint8(1), s.estimate(2))
+	assert.Equal(t, uint8(0), s.estimate(3))
+}
+
+func TestFrequencySketch_counts_are_capped(t *testing.T) {
+	s := newFrequencySketch(1024)
+
+	for range 100 {
+		s.increment(1)
+	}
+
+	assert.Equal(t, uint8(frequencySketchMaxCount), s.estimate(1))
+}
+
+func TestFrequencySketch_counts_are_halved_periodically(t *testing.T) {
+	s := newFrequencySketch(1024)
+
+	for range 8 {
+		s.increment(1)
+	}
+	s.additions = s.sampleSize - 1
+	s.increment(2)
+
+	assert.Equal(t, uint8(4), s.estimate(1))
+	assert.Equal(t, uint8(0), s.estimate(2))
+	assert.Equal(t, s.sampleSize/2, s.additions)
+}
+
+func TestFrequencySketch_width_is_a_power_of_two(t *testing.T) {
+	assert.Len(t, newFrequencySketch(0).rows[0], frequencySketchMinWidth)
+	assert.Len(t, newFrequencySketch(3000).rows[0], 4096)
+	assert.Len(t, newFrequencySketch(1 << 30).rows[0], frequencySketchMaxWidth)
+}
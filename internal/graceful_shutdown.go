@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type drainableServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+type stoppableUpstream interface {
+	Stop()
+	Kill()
+}
+
+// GracefulShutdown stops Thruster without cutting off requests that are in
+// progress. In order, it:
+//
+//  1. Fails the health check, while carrying on serving requests for delay,
+//     so that load balancers have time to stop sending us new ones.
+//  2. Stops accepting connections, and waits for in-flight requests to
+//     finish.
+//  3. Asks the upstream to stop, and waits for it to exit.
+//  4. Forces the upstream and any remaining connections to close, if all of
+//     that takes longer than timeout, or if Force is called.
+type GracefulShutdown struct {
+	delay        time.Duration
+	timeout      time.Duration
+	server       drainableServer
+	upstream     stoppableUpstream
+	upstreamDone <-chan struct{}
+	readiness    *UpstreamReadiness
+	clock        Clock
+
+	forced    chan struct{}
+	forceOnce sync.Once
+}
+
+func NewGracefulShutdown(delay, timeout time.Duration, server drainableServer, upstream stoppableUpstream, upstreamDone <-chan struct{}) *GracefulShutdown {
+	return &GracefulShutdown{
+		delay:        delay,
+		timeout:      timeout,
+		server:       server,
+		upstream:     upstream,
+		upstreamDone: upstreamDone,
+		clock:        systemClock{},
+		forced:       make(chan struct{}),
+	}
+}
+
+// Run performs the shutdown, returning once the upstream has exited.
+func (g *GracefulShutdown) Run() {
+	if g.readiness != nil {
+		g.readiness.SetDraining()
+	}
+
+	if g.delay > 0 {
+		slog.Info("Shutdown: waiting before draining requests", "delay", g.delay)
+		select {
+		case <-g.clock.After(g.delay):
+		case <-g.forced:
+		}
+	}
+
+	deadline := g.clock.After(g.timeout)
+	expired := false
+
+	slog.Info("Shutdown: draining requests", "timeout", g.timeout)
+	if !g.drain(deadline) {
+		slog.Warn("Shutdown: closing connections with requests still in progress")
+		_ = g.server.Close()
+		expired = true
+	}
+
+	slog.Info("Shutdown: stopping upstream process")
+	g.upstream.Stop()
+
+	if !expired {
+		select {
+		case <-g.upstreamDone:
+			return
+		case <-deadline:
+		case <-g.forced:
+		}
+	}
+
+	slog.Warn("Shutdown: killing upstream process")
+	g.upstream.Kill()
+	<-g.upstreamDone
+}
+
+// Force skips the rest of the shutdown, closing any remaining connections
+// and killing the upstream straight away.
+func (g *GracefulShutdown) Force() {
+	g.forceOnce.Do(func() { close(g.forced) })
+}
+
+// Private
+
+// drain waits for in-flight requests to finish, and reports whether they did
+// before the deadline, or before the shutdown was forced.
+func (g *GracefulShutdown) drain(deadline <-chan time.Time) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var err error
+	drained := make(chan struct{})
+	go func() {
+		err = g.server.Shutdown(ctx)
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-deadline:
+	case <-g.forced:
+	}
+
+	cancel()
+	<-drained
+	return err == nil
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGracefulShutdown_drains_then_stops_upstream(t *testing.T) {
+	events := &shutdownEvents{}
+	upstream := newFakeUpstream(events, true)
+	clock := &fakeClock{}
+
+	readiness := NewUpstreamReadiness()
+	readiness.SetReady(true)
+
+	shutdown := NewGracefulShutdown(5*time.Second, 30*time.Second, &fakeServer{events: events}, upstream, upstream.done)
+	shutdown.readiness = readiness
+	shutdown.clock = clock
+
+	done := runShutdown(shutdown)
+
+	clock.waitForTimers(t, 1)
+	assert.False(t, readiness.Healthy(), "health check should fail during the delay")
+	assert.Empty(t, events.list(), "requests should still be served during the delay")
+
+	clock.Advance(5 * time.Second)
+	waitForShutdown(t, done)
+
+	assert.Equal(t, []string{"shutdown", "stop"}, events.list())
+}
+
+func TestGracefulShutdown_closes_connections_when_drain_times_out(t *testing.T) {
+	events := &shutdownEvents{}
+	upstream := newFakeUpstream(events, true)
+	clock := &fakeClock{}
+
+	shutdown := NewGracefulShutdown(0, 30*time.Second, &fakeServer{events: events, hang: true}, upstream, upstream.done)
+	shutdown.clock = clock
+
+	done := runShutdown(shutdown)
+
+	clock.waitForTimers(t, 1)
+	require.Eventually(t, func() bool { return len(events.list()) == 1 }, time.Second, time.Millisecond)
+
+	clock.Advance(30 * time.Second)
+	waitForShutdown(t, done)
+
+	assert.Equal(t, []string{"shutdown", "close", "stop", "kill"}, events.list())
+}
+
+func TestGracefulShutdown_kills_upstream_that_does_not_stop_in_time(t *testing.T) {
+	events := &shutdownEvents{}
+	upstream := newFakeUpstream(events, false)
+	clock := &fakeClock{}
+
+	shutdown := NewGracefulShutdown(0, 30*time.Second, &fakeServer{events: events}, upstream, upstream.done)
+	shutdown.clock = clock
+
+	done := runShutdown(shutdown)
+
+	clock.waitForTimers(t, 1)
+	require.Eventually(t, func() bool { return len(events.list()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"shutdown", "stop"}, events.list())
+
+	clock.Advance(30 * time.Second)
+	waitForShutdown(t, done)
+
+	assert.Equal(t, []string{"shutdown", "stop", "kill"}, events.list())
+}
+
+func TestGracefulShutdown_can_be_forced(t *testing.T) {
+	events := &shutdownEvents{}
+	upstream := newFakeUpstream(events, false)
+	clock := &fakeClock{}
+
+	shutdown := NewGracefulShutdown(5*time.Second, 30*time.Second, &fakeServer{events: events, hang: true}, upstream, upstream.done)
+	shutdown.clock = clock
+
+	done := runShutdown(shutdown)
+
+	clock.waitForTimers(t, 1)
+	shutdown.Force()
+	waitForShutdown(t, done)
+
+	assert.Equal(t, []string{"shutdown", "close", "stop", "kill"}, events.list())
+}
+
+// Helpers
+
+func runShutdown(shutdown *GracefulShutdown) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		shutdown.Run()
+		close(done)
+	}()
+	return done
+}
+
+func waitForShutdown(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+}
+
+type shutdownEvents struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (e *shutdownEvents) add(event string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.events = append(e.events, event)
+}
+
+func (e *shutdownEvents) list() []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]string{}, e.events...)
+}
+
+type fakeServer struct {
+	events *shutdownEvents
+	hang   bool
+}
+
+func (s *fakeServer) Shutdown(ctx context.Context) error {
+	s.events.add("shutdown")
+	if s.hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *fakeServer) Close() error {
+	s.events.add("close")
+	return nil
+}
+
+type fakeUpstream struct {
+	events     *shutdownEvents
+	exitOnStop bool
+	done       chan struct{}
+	once       sync.Once
+}
+
+func newFakeUpstream(events *shutdownEvents, exitOnStop bool) *fakeUpstream {
+	return &fakeUpstream{events: events, exitOnStop: exitOnStop, done: make(chan struct{})}
+}
+
+func (u *fakeUpstream) Stop() {
+	u.events.add("stop")
+	if u.exitOnStop {
+		u.once.Do(func() { close(u.done) })
+	}
+}
+
+func (u *fakeUpstream) Kill() {
+	u.events.add("kill")
+	u.once.Do(func() { close(u.done) })
+}
+
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Duration
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Duration
+	ch chan time.Time
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{at: c.now + d, ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward, firing any timers that are now due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now += d
+
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at <= c.now {
+			timer.ch <- time.Time{}
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+}
+
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	require.Eventually(t, func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return len(c.timers) == n
+	}, time.Second, time.Millisecond)
+}
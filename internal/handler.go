@@ -3,31 +3,83 @@ package internal
 import (
 	"log/slog"
 	"net/http"
-	"net/url"
+	"time"
 )
 
 type HandlerOptions struct {
 	badGatewayPage               string
 	cache                        Cache
+	cacheRequestStats            *CacheRequestStats
+	cacheKeyRules                CacheKeyRules
 	maxCacheableResponseBody     int
 	maxRequestBody               int
-	targetUrl                    *url.URL
+	requestDecompressionEnabled  bool
+	maxDecompressedRequestBody   int
+	target                       *UpstreamTarget
+	upstreamReadiness            *UpstreamReadiness
+	upstreamReadyTimeout         time.Duration
+	startingPage                 string
+	healthCheckPath              string
 	xSendfileEnabled             bool
 	gzipCompressionEnabled       bool
 	gzipCompressionDisableOnAuth bool
 	gzipCompressionJitter        int
+	gzipCompressionLevel         int
+	brotliCompressionEnabled     bool
+	brotliCompressionLevel       int
+	zstdCompressionEnabled       bool
+	zstdCompressionLevel         int
+	compressionMinSize           int
+	compressionContentTypes      []string
+	compressionExcludedTypes     []string
+	compressionOptOutHeader      string
+	compressionGuardRules        CompressionGuardRules
 	forwardHeaders               bool
 	logRequests                  bool
 }
 
 func NewHandler(options HandlerOptions) http.Handler {
-	handler := NewProxyHandler(options.targetUrl, options.badGatewayPage, options.forwardHeaders)
-	handler = NewCacheHandler(options.cache, options.maxCacheableResponseBody, handler)
+	compressionOptions := CompressionOptions{
+		jitter:        options.gzipCompressionJitter,
+		disableOnAuth: options.gzipCompressionDisableOnAuth,
+		gzipLevel:     options.gzipCompressionLevel,
+		brotliEnabled: options.brotliCompressionEnabled,
+		brotliLevel:   options.brotliCompressionLevel,
+		zstdEnabled:   options.zstdCompressionEnabled,
+		zstdLevel:     options.zstdCompressionLevel,
+
+		minSize:              options.compressionMinSize,
+		contentTypes:         options.compressionContentTypes,
+		excludedContentTypes: options.compressionExcludedTypes,
+		optOutHeader:         options.compressionOptOutHeader,
+		guardRules:           options.compressionGuardRules,
+	}
+
+	handler := NewProxyHandler(options.target, options.badGatewayPage, options.forwardHeaders)
+	if options.upstreamReadiness != nil {
+		handler = NewUpstreamReadinessHandler(options.upstreamReadiness, options.upstreamReadyTimeout, options.startingPage, handler)
+	}
+
+	cacheHandler := NewCacheHandler(options.cache, options.maxCacheableResponseBody, handler)
+	cacheHandler.stats = options.cacheRequestStats
+	cacheHandler.keyRules = options.cacheKeyRules
+	if options.gzipCompressionEnabled {
+		cacheHandler.compressor = newCacheCompressor(compressionOptions)
+	}
+	handler = cacheHandler
 	handler = NewSendfileHandler(options.xSendfileEnabled, handler)
 	handler = NewRequestStartHandler(handler)
 
 	if options.gzipCompressionEnabled {
-		handler = NewCompressionHandler(options.gzipCompressionJitter, options.gzipCompressionDisableOnAuth, handler)
+		handler = NewCompressionHandler(compressionOptions, handler)
+	}
+
+	if options.requestDecompressionEnabled {
+		maxDecompressedRequestBody := options.maxDecompressedRequestBody
+		if maxDecompressedRequestBody <= 0 {
+			maxDecompressedRequestBody = options.maxRequestBody
+		}
+		handler = NewRequestDecompressionHandler(maxDecompressedRequestBody, handler)
 	}
 
 	if options.maxRequestBody > 0 {
@@ -38,5 +90,11 @@ func NewHandler(options HandlerOptions) http.Handler {
 		handler = NewLoggingHandler(slog.Default(), handler)
 	}
 
+	// Health checks are answered before logging, so that frequent probes
+	// don't fill the logs.
+	if options.upstreamReadiness != nil && options.healthCheckPath != "" {
+		handler = NewHealthHandler(options.healthCheckPath, options.upstreamReadiness, handler)
+	}
+
 	return handler
 }
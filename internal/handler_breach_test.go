@@ -5,7 +5,6 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"strings"
 	"testing"
 
@@ -22,12 +21,10 @@ func TestHandler_BreachMitigation(t *testing.T) {
 	upstreamServer := httptest.NewServer(upstream)
 	defer upstreamServer.Close()
 
-	upstreamURL, _ := url.Parse(upstreamServer.URL)
-
 	cache := NewMemoryCache(1024, 1024)
 
 	opts := HandlerOptions{
-		targetUrl:                    upstreamURL,
+		target:                       upstreamTarget(upstreamServer.URL, ""),
 		cache:                        cache,
 		gzipCompressionEnabled:       true,
 		gzipCompressionDisableOnAuth: false,
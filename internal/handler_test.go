@@ -2,7 +2,10 @@ package internal
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -11,7 +14,9 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestHandlerGzipCompression_when_proxying(t *testing.T) {
@@ -127,6 +132,37 @@ func TestHandlerGzipCompression_when_sendfile(t *testing.T) {
 	assert.Less(t, transferredSize, fixtureLength("loremipsum.txt"))
 }
 
+func TestHandlerCompression_serves_precompressed_sendfile_files_as_they_are(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "loremipsum.txt")
+	require.NoError(t, os.WriteFile(filename, fixtureContent("loremipsum.txt"), 0644))
+
+	var compressed bytes.Buffer
+	writer := brotli.NewWriter(&compressed)
+	_, _ = writer.Write(fixtureContent("loremipsum.txt"))
+	require.NoError(t, writer.Close())
+	require.NoError(t, os.WriteFile(filename+".br", compressed.Bytes(), 0644))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Sendfile", filename)
+	}))
+	defer upstream.Close()
+
+	h := NewHandler(handlerOptions(upstream.URL))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept-Encoding"}, w.Header().Values("Vary"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+	assert.Equal(t, strconv.Itoa(compressed.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, compressed.Bytes(), w.Body.Bytes())
+}
+
 func TestHandlerGzipCompression_does_not_compress_sendfile_png(t *testing.T) {
 	dir := t.TempDir()
 	fileContent := bytes.Repeat([]byte("A"), 2000)
@@ -211,6 +247,148 @@ func TestHandlerMaxRequestBody(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestHandlerRequestDecompression(t *testing.T) {
+	body := fixtureContent("loremipsum.txt")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		assert.Empty(t, r.Header.Get("Content-Encoding"))
+		assert.Equal(t, body, received)
+	}))
+	defer upstream.Close()
+
+	options := handlerOptions(upstream.URL)
+	options.requestDecompressionEnabled = true
+	options.maxRequestBody = 4000
+	h := NewHandler(options)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, body)))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The decompressed size is limited by the maximum request body, unless
+	// it has a limit of its own
+	options.maxRequestBody = 2000
+	h = NewHandler(options)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, body)))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	options.maxDecompressedRequestBody = 4000
+	h = NewHandler(options)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, body)))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Corrupt bodies are bad requests
+	compressed := zstdBytes(t, body)
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/", bytes.NewReader(compressed[:len(compressed)/2]))
+	r.Header.Set("Content-Encoding", "zstd")
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandlerProxiesToUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "example.org", r.Host)
+		_, _ = w.Write([]byte("Hello from the socket"))
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	defer upstream.Close()
+
+	options := handlerOptions("http://localhost:3000")
+	options.target = upstreamTarget("http://localhost:3000", socketPath)
+	h := NewHandler(options)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.org/", nil)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello from the socket", w.Body.String())
+}
+
+func TestHandlerFollowsTargetWhenItIsSwitched(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first"))
+	}))
+	defer first.Close()
+
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("second"))
+	}))
+	defer second.Close()
+
+	options := handlerOptions(first.URL)
+	h := NewHandler(options)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "first", w.Body.String())
+
+	previous := options.target.Switch(upstreamTarget(second.URL, "").Endpoint())
+	assert.Equal(t, first.URL, previous.url.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "second", w.Body.String())
+}
+
+func TestHandlerWaitsForUpstreamToBeReady(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello"))
+	}))
+	defer upstream.Close()
+
+	options := handlerOptions(upstream.URL)
+	options.upstreamReadiness = NewUpstreamReadiness()
+	options.healthCheckPath = "/_thruster/health"
+	h := NewHandler(options)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/_thruster/health", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	options.upstreamReadiness.SetReady(true)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/_thruster/health", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
 func TestHandlerPreserveInboundHostHeaderWhenProxying(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		assert.Equal(t, "example.org", r.Host)
@@ -332,16 +510,168 @@ func TestHandlerAllowsFlushingTheResponseBody(t *testing.T) {
 	assert.True(t, w.Flushed)
 }
 
+func TestHandlerServesCompressedResponsesFromCache(t *testing.T) {
+	upstreamRequests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(fixtureContent("loremipsum.txt"))
+	}))
+	defer upstream.Close()
+
+	cache := NewMemoryCache(defaultCacheSize, defaultMaxCacheItemSizeBytes)
+	options := handlerOptions(upstream.URL)
+	options.cache = cache
+	options.maxCacheableResponseBody = defaultMaxCacheItemSizeBytes
+	options.gzipCompressionJitter = 32
+	h := NewHandler(options)
+
+	serve := func(acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	miss := serve("gzip")
+	assert.Equal(t, "miss", miss.Header().Get("X-Cache"))
+	assert.Equal(t, "gzip", miss.Header().Get("Content-Encoding"))
+
+	for range 2 {
+		hit := serve("gzip")
+		assert.Equal(t, "hit", hit.Header().Get("X-Cache"))
+		assert.Equal(t, "gzip", hit.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", hit.Header().Get("Vary"))
+		assert.Equal(t, strconv.Itoa(hit.Body.Len()), hit.Header().Get("Content-Length"))
+
+		// The cached copy has the same jitter as the response compressed on
+		// the way through.
+		missComment, _ := gunzipWithComment(t, miss.Body.Bytes())
+		hitComment, body := gunzipWithComment(t, hit.Body.Bytes())
+		assert.NotEmpty(t, hitComment)
+		assert.Equal(t, missComment, hitComment)
+		assert.Equal(t, fixtureContent("loremipsum.txt"), body)
+	}
+
+	assert.Equal(t, 2, cache.Stats().Items)
+	assert.Equal(t, int64(2), cache.Stats().Stores)
+
+	zstd := serve("gzip, zstd")
+	assert.Equal(t, "hit", zstd.Header().Get("X-Cache"))
+	assert.Equal(t, "zstd", zstd.Header().Get("Content-Encoding"))
+
+	br := serve("gzip, br")
+	assert.Equal(t, "hit", br.Header().Get("X-Cache"))
+	assert.Equal(t, "br", br.Header().Get("Content-Encoding"))
+	assert.Equal(t, string(fixtureContent("loremipsum.txt")), unbrotli(t, br.Body.Bytes()))
+
+	identity := serve("")
+	assert.Equal(t, "hit", identity.Header().Get("X-Cache"))
+	assert.Empty(t, identity.Header().Get("Content-Encoding"))
+	assert.Equal(t, fixtureContent("loremipsum.txt"), identity.Body.Bytes())
+
+	assert.Equal(t, 1, upstreamRequests)
+	assert.Equal(t, 4, cache.Clear())
+}
+
+func TestHandlerCachedCompressedResponsesRespectTheCompressionGuard(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(fixtureContent("loremipsum.txt"))
+	}))
+	defer upstream.Close()
+
+	options := handlerOptions(upstream.URL)
+	options.maxCacheableResponseBody = defaultMaxCacheItemSizeBytes
+	options.gzipCompressionDisableOnAuth = true
+	h := NewHandler(options)
+
+	serve := func(cookie string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	serve("")
+
+	w := serve("session=secret")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	w = serve("")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+}
+
+func TestHandlerCachedCompressedResponsesFollowTheCompressionGuardRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write(fixtureContent("loremipsum.txt"))
+	}))
+	defer upstream.Close()
+
+	options := handlerOptions(upstream.URL)
+	options.maxCacheableResponseBody = defaultMaxCacheItemSizeBytes
+	options.gzipCompressionDisableOnAuth = true
+	options.compressionGuardRules = CompressionGuardRules{AllowedPaths: []string{"/assets/*"}}
+	h := NewHandler(options)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Cookie", "session=secret")
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, path := range []string{"/assets/app.js", "/page"} {
+		assert.Equal(t, "miss", serve(path).Header().Get("X-Cache"))
+	}
+
+	w := serve("/assets/app.js")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	w = serve("/page")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
 // Helpers
 
-func handlerOptions(targetUrl string) HandlerOptions {
+func upstreamTarget(targetUrl string, socketPath string) *UpstreamTarget {
 	url, _ := url.Parse(targetUrl)
+	return NewUpstreamTarget(newUpstreamEndpointForURL(url, 0, socketPath))
+}
+
+func gunzipWithComment(t *testing.T, b []byte) (string, []byte) {
+	reader, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
 
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	return reader.Comment, body
+}
+
+func handlerOptions(targetUrl string) HandlerOptions {
 	return HandlerOptions{
 		cache:                    NewMemoryCache(defaultCacheSize, defaultMaxCacheItemSizeBytes),
-		targetUrl:                url,
+		target:                   upstreamTarget(targetUrl, ""),
 		xSendfileEnabled:         true,
 		gzipCompressionEnabled:   true,
+		brotliCompressionEnabled: true,
+		zstdCompressionEnabled:   true,
 		maxCacheableResponseBody: 1024,
 		badGatewayPage:           "",
 		forwardHeaders:           true,
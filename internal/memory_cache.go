@@ -2,7 +2,8 @@ package internal
 
 import (
 	"log/slog"
-	"math/rand"
+	"math/bits"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -13,115 +14,348 @@ type MemoryCacheEntry struct {
 	lastAccessedAt time.Time
 	expiresAt      time.Time
 	value          []byte
+	tags           []string
+	hits           int64
 }
 
 type MemoryCacheEntryMap map[CacheKey]*MemoryCacheEntry
 type MemoryCacheKeyList []CacheKey
 
+// MemoryCacheEvictionHandler is called with any unexpired item that is evicted
+// to make space for another, or that the eviction policy declined to store.
+type MemoryCacheEvictionHandler func(key CacheKey, value []byte, expiresAt time.Time, tags []string)
+
+// MemoryCache splits its items across a number of shards, each with its own
+// lock and its own share of the capacity, so that concurrent requests for
+// different items don't have to wait for each other.
 type MemoryCache struct {
-	sync.Mutex
+	shards         []*memoryCacheShard
+	shardShift     int
 	capacity       int
 	maxItemSize    int
-	size           int
-	keys           MemoryCacheKeyList
-	items          MemoryCacheEntryMap
 	getCurrentTime GetCurrentTime
+	onEvict        MemoryCacheEvictionHandler
 }
 
+type memoryCacheShard struct {
+	sync.Mutex
+	cache     *MemoryCache
+	capacity  int
+	size      int
+	items     MemoryCacheEntryMap
+	policy    evictionPolicy
+	tags      cacheTagIndex
+	stores    int64
+	evictions CacheEvictionStats
+}
+
+const (
+	memoryCacheMaxShards = 64
+
+	// Each shard must be able to hold several of the largest items, otherwise
+	// a few large items that happen to land in the same shard would keep
+	// evicting each other.
+	memoryCacheMinItemsPerShard = 8
+)
+
 func NewMemoryCache(capacity, maxItemSize int) *MemoryCache {
-	return &MemoryCache{
+	return NewMemoryCacheWithEvictionPolicy(capacity, maxItemSize, EvictionPolicySample)
+}
+
+func NewMemoryCacheWithEvictionPolicy(capacity, maxItemSize int, evictionPolicy string) *MemoryCache {
+	return newShardedMemoryCache(capacity, maxItemSize, evictionPolicy, memoryCacheShardCount(capacity, maxItemSize))
+}
+
+func (c *MemoryCache) Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string) {
+	evicted := c.shardFor(key).set(key, value, expiresAt, tags)
+
+	if c.onEvict != nil {
+		now := c.getCurrentTime()
+		for evictedKey, item := range evicted {
+			if !item.expiresAt.Before(now) {
+				c.onEvict(evictedKey, item.value, item.expiresAt, item.tags)
+			}
+		}
+	}
+}
+
+func (c *MemoryCache) Get(key CacheKey) ([]byte, bool) {
+	return c.shardFor(key).get(key)
+}
+
+func (c *MemoryCache) Delete(key CacheKey) bool {
+	return c.shardFor(key).delete(key)
+}
+
+func (c *MemoryCache) DeleteTagged(match CacheTagMatcher) int {
+	return len(c.deleteTagged(match))
+}
+
+func (c *MemoryCache) Clear() int {
+	return len(c.clear())
+}
+
+func (c *MemoryCache) Stats() CacheStats {
+	stats := CacheStats{}
+
+	for _, s := range c.shards {
+		s.Lock()
+		stats = stats.add(CacheStats{
+			Items:         len(s.items),
+			SizeBytes:     s.size,
+			CapacityBytes: s.capacity,
+			Stores:        s.stores,
+			Evictions:     s.evictions,
+		})
+		s.Unlock()
+	}
+
+	return stats
+}
+
+func (c *MemoryCache) Entries() []CacheEntryInfo {
+	entries := []CacheEntryInfo{}
+
+	for _, s := range c.shards {
+		s.Lock()
+		for key, item := range s.items {
+			entries = append(entries, CacheEntryInfo{
+				Key:       key,
+				Size:      len(item.value),
+				Hits:      item.hits,
+				ExpiresAt: item.expiresAt,
+				Tags:      item.tags,
+			})
+		}
+		s.Unlock()
+	}
+
+	return entries
+}
+
+// Private
+
+// memoryCacheShardCount picks a power of two number of shards, with enough
+// to spread the load across the available CPUs, but few enough that each
+// shard can still hold a reasonable number of items.
+func memoryCacheShardCount(capacity, maxItemSize int) int {
+	limit := min(memoryCacheMaxShards, 4*runtime.GOMAXPROCS(0))
+	if maxItemSize > 0 {
+		limit = min(limit, capacity/(maxItemSize*memoryCacheMinItemsPerShard))
+	}
+
+	if limit <= 1 {
+		return 1
+	}
+
+	return 1 << (bits.Len(uint(limit)) - 1)
+}
+
+func newShardedMemoryCache(capacity, maxItemSize int, evictionPolicy string, shardCount int) *MemoryCache {
+	c := &MemoryCache{
+		shards:         make([]*memoryCacheShard, shardCount),
+		shardShift:     64 - bits.Len(uint(shardCount-1)),
 		capacity:       capacity,
 		maxItemSize:    maxItemSize,
-		size:           0,
-		keys:           MemoryCacheKeyList{},
-		items:          MemoryCacheEntryMap{},
 		getCurrentTime: time.Now,
 	}
-}
 
-func (c *MemoryCache) Set(key CacheKey, value []byte, expiresAt time.Time) {
-	c.Lock()
-	defer c.Unlock()
+	// Any remainder of the capacity goes to the first shard, so that the
+	// shards add up to exactly the capacity we were given.
+	shardCapacity := capacity / shardCount
 
-	itemSize := len(value)
-	if itemSize > c.maxItemSize || itemSize > c.capacity {
-		slog.Debug("Cache: item is too large to store", "len", itemSize)
-		return
-	}
+	for i := range c.shards {
+		s := &memoryCacheShard{
+			cache:    c,
+			capacity: shardCapacity,
+			items:    MemoryCacheEntryMap{},
+			tags:     cacheTagIndex{},
+		}
+		if i == 0 {
+			s.capacity += capacity - shardCapacity*shardCount
+		}
 
-	limit := c.capacity - itemSize
-	for c.size > limit {
-		slog.Debug("Cache: evicting item to make space", "current_size", c.size, "need_size", limit)
-		c.evictOldestItem()
+		s.policy = newEvictionPolicy(evictionPolicy, s)
+		c.shards[i] = s
 	}
 
-	existingItem, ok := c.items[key]
-	if ok {
-		c.size -= len(existingItem.value)
-	} else {
-		c.keys = append(c.keys, key)
+	return c
+}
+
+// shardFor picks a shard using the top bits of the key. Keys are already
+// hashes, but we mix them once more so that the shards stay balanced even when
+// the keys are not, as in our tests.
+func (c *MemoryCache) shardFor(key CacheKey) *memoryCacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
 	}
 
-	c.items[key] = &MemoryCacheEntry{
-		lastAccessedAt: c.getCurrentTime(),
-		expiresAt:      expiresAt,
-		value:          value,
+	return c.shards[(uint64(key)*0x9e3779b97f4a7c15)>>c.shardShift]
+}
+
+func (c *MemoryCache) deleteTagged(match CacheTagMatcher) []CacheKey {
+	keys := []CacheKey{}
+	for _, s := range c.shards {
+		keys = append(keys, s.deleteTagged(match)...)
 	}
 
-	c.size += itemSize
+	return keys
+}
 
-	slog.Debug("Cache: added item", "key", key, "size", itemSize, "expires_at", expiresAt)
+func (c *MemoryCache) clear() []CacheKey {
+	keys := []CacheKey{}
+	for _, s := range c.shards {
+		keys = append(keys, s.clear()...)
+	}
+
+	return keys
 }
 
-func (c *MemoryCache) Get(key CacheKey) ([]byte, bool) {
-	c.Lock()
-	defer c.Unlock()
+func (s *memoryCacheShard) get(key CacheKey) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
 
-	now := c.getCurrentTime()
+	now := s.cache.getCurrentTime()
 
-	item, ok := c.items[key]
-	if !ok || item.expiresAt.Before(now) {
+	item, ok := s.items[key]
+	found := ok && !item.expiresAt.Before(now)
+	s.policy.accessed(key, found)
+
+	if !found {
 		return nil, false
 	}
 
 	item.lastAccessedAt = now
+	item.hits++
 	return item.value, true
 }
 
-func (c *MemoryCache) evictOldestItem() {
-	var oldestKey CacheKey
-	var oldestIndex int
-	var oldest time.Time
-
-	now := c.getCurrentTime()
-
-	// Pick 5 random items and evict the oldest one, On average we'll evict items
-	// in the oldest 20%, which is good enough and is much faster than scanning
-	// through them all.
-	//
-	// If we find an expired item while looking, that's a better choice to evict,
-	// so we can choose it immediately.
-	for range 5 {
-		index := rand.Intn(len(c.keys))
-		key := c.keys[index]
-		v := c.items[key]
-
-		if v.expiresAt.Before(now) {
-			oldestKey = key
-			oldestIndex = index
-			break
+func (s *memoryCacheShard) delete(key CacheKey) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	_, ok := s.items[key]
+	if ok {
+		s.removeItem(key)
+	}
+
+	return ok
+}
+
+func (s *memoryCacheShard) deleteTagged(match CacheTagMatcher) []CacheKey {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := s.tags.matching(match)
+	for _, key := range keys {
+		s.removeItem(key)
+	}
+
+	return keys
+}
+
+func (s *memoryCacheShard) clear() []CacheKey {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := make([]CacheKey, 0, len(s.items))
+	for key := range s.items {
+		keys = append(keys, key)
+		s.policy.removed(key)
+	}
+
+	s.size = 0
+	s.items = MemoryCacheEntryMap{}
+	s.tags = cacheTagIndex{}
+
+	return keys
+}
+
+func (s *memoryCacheShard) set(key CacheKey, value []byte, expiresAt time.Time, tags []string) MemoryCacheEntryMap {
+	s.Lock()
+	defer s.Unlock()
+
+	itemSize := len(value)
+	if itemSize > s.cache.maxItemSize || itemSize > s.capacity {
+		slog.Debug("Cache: item is too large to store", "len", itemSize)
+		s.evictions.TooLarge++
+		return nil
+	}
+
+	var evicted MemoryCacheEntryMap
+
+	limit := s.capacity - itemSize
+
+	_, exists := s.items[key]
+	if !exists && s.size > limit && !s.policy.admit(key, s.policy.victim()) {
+		slog.Debug("Cache: item not admitted", "key", key, "len", itemSize)
+		s.evictions.Rejected++
+
+		if s.cache.onEvict != nil {
+			return MemoryCacheEntryMap{key: {expiresAt: expiresAt, value: value, tags: tags}}
 		}
+		return nil
+	}
 
-		if v.lastAccessedAt.Before(oldest) || oldest.IsZero() {
-			oldest = v.lastAccessedAt
-			oldestKey = key
-			oldestIndex = index
+	for s.size > limit {
+		slog.Debug("Cache: evicting item to make space", "current_size", s.size, "need_size", limit)
+		evictedKey, item := s.evictOldestItem()
+
+		if s.cache.onEvict != nil && evictedKey != key {
+			if evicted == nil {
+				evicted = MemoryCacheEntryMap{}
+			}
+			evicted[evictedKey] = item
 		}
 	}
 
-	c.keys[oldestIndex] = c.keys[len(c.keys)-1]
-	c.keys = c.keys[:len(c.keys)-1]
+	existingItem, ok := s.items[key]
+	if ok {
+		s.size -= len(existingItem.value)
+		s.tags.remove(key, existingItem.tags)
+		s.policy.removed(key)
+	}
+	s.policy.added(key)
+
+	s.items[key] = &MemoryCacheEntry{
+		lastAccessedAt: s.cache.getCurrentTime(),
+		expiresAt:      expiresAt,
+		value:          value,
+		tags:           tags,
+	}
+
+	s.size += itemSize
+	s.tags.add(key, tags)
+	s.stores++
+
+	slog.Debug("Cache: added item", "key", key, "size", itemSize, "expires_at", expiresAt)
+	return evicted
+}
+
+func (s *memoryCacheShard) evictOldestItem() (CacheKey, *MemoryCacheEntry) {
+	key := s.policy.victim()
+	item := s.items[key]
+
+	s.evictions.recordEviction(item.expiresAt.Before(s.cache.getCurrentTime()))
+	s.removeItem(key)
+
+	return key, item
+}
+
+func (s *memoryCacheShard) now() time.Time {
+	return s.cache.getCurrentTime()
+}
+
+func (s *memoryCacheShard) accessTimes(key CacheKey) (time.Time, time.Time) {
+	item := s.items[key]
+	return item.lastAccessedAt, item.expiresAt
+}
+
+func (s *memoryCacheShard) removeItem(key CacheKey) {
+	item := s.items[key]
 
-	c.size -= len(c.items[oldestKey].value)
-	delete(c.items, oldestKey)
+	s.size -= len(item.value)
+	s.tags.remove(key, item.tags)
+	s.policy.removed(key)
+	delete(s.items, key)
 }
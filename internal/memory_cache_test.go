@@ -2,6 +2,9 @@ package internal
 
 import (
 	"bytes"
+	"math/rand"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,8 +35,8 @@ func TestMemoryCache_storing_existing_value_keeps_keys_and_size_correct(t *testi
 	c.Set(1, []byte("first"), time.Now().Add(30*time.Second))
 	c.Set(1, []byte("second"), time.Now().Add(30*time.Second))
 
-	assert.Equal(t, 1, len(c.keys))
-	assert.Equal(t, 6, c.size)
+	assert.Equal(t, 1, c.Stats().Items)
+	assert.Equal(t, 6, c.Stats().SizeBytes)
 }
 
 func TestMemoryCache_expiry(t *testing.T) {
@@ -85,7 +88,7 @@ func TestMemoryCache_items_are_evicted_to_make_space(t *testing.T) {
 		assert.Equal(t, payload, retrieved)
 	}
 
-	assert.Equal(t, maxCacheSize, c.size)
+	assert.Equal(t, maxCacheSize, c.Stats().SizeBytes)
 }
 
 func TestMemoryCache_does_not_store_items_over_item_limit(t *testing.T) {
@@ -98,6 +101,273 @@ func TestMemoryCache_does_not_store_items_over_item_limit(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestMemoryCache_delete(t *testing.T) {
+	c := NewMemoryCache(32*MB, 1*MB)
+	c.Set(1, []byte("hello"), time.Now().Add(1*time.Hour))
+	c.Set(2, []byte("world"), time.Now().Add(1*time.Hour))
+
+	assert.True(t, c.Delete(1))
+	assert.False(t, c.Delete(1))
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	_, ok = c.Get(2)
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, c.Stats().Items)
+	assert.Equal(t, 5, c.Stats().SizeBytes)
+}
+
+func TestMemoryCache_delete_tagged(t *testing.T) {
+	c := NewMemoryCache(32*MB, 1*MB)
+	c.Set(1, []byte("one"), time.Now().Add(1*time.Hour), "key:a", "key:b")
+	c.Set(2, []byte("two"), time.Now().Add(1*time.Hour), "key:b")
+	c.Set(3, []byte("three"), time.Now().Add(1*time.Hour), "key:c")
+
+	assert.Equal(t, 2, c.DeleteTagged(matchSurrogateKey("b")))
+	assert.Equal(t, 0, c.DeleteTagged(matchSurrogateKey("a")))
+
+	_, ok := c.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, 5, c.Stats().SizeBytes)
+	assert.Equal(t, cacheTagIndex{"key:c": {3: {}}}, c.shardFor(3).tags)
+}
+
+func TestMemoryCache_updating_an_item_replaces_its_tags(t *testing.T) {
+	c := NewMemoryCache(32*MB, 1*MB)
+	c.Set(1, []byte("first"), time.Now().Add(1*time.Hour), "key:a")
+	c.Set(1, []byte("second"), time.Now().Add(1*time.Hour), "key:b")
+
+	assert.Equal(t, 0, c.DeleteTagged(matchSurrogateKey("a")))
+	assert.Equal(t, 1, c.DeleteTagged(matchSurrogateKey("b")))
+}
+
+func TestMemoryCache_clear(t *testing.T) {
+	c := NewMemoryCache(32*MB, 1*MB)
+	c.Set(1, []byte("hello"), time.Now().Add(1*time.Hour), "key:a")
+	c.Set(2, []byte("world"), time.Now().Add(1*time.Hour))
+
+	assert.Equal(t, 2, c.Clear())
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Stats().SizeBytes)
+	for _, s := range c.shards {
+		assert.Empty(t, s.tags)
+	}
+}
+
+func TestMemoryCache_stats(t *testing.T) {
+	now := time.Now()
+	c := NewMemoryCacheWithEvictionPolicy(2*KB, 1*KB, EvictionPolicyLRU)
+	c.getCurrentTime = func() time.Time { return now }
+
+	c.Set(1, make([]byte, 1*KB), now.Add(1*time.Second))
+	c.Set(2, make([]byte, 1*KB), now.Add(1*time.Hour))
+	c.Set(3, make([]byte, 2*KB), now.Add(1*time.Hour))
+	c.Get(2)
+
+	c.getCurrentTime = func() time.Time { return now.Add(2 * time.Second) }
+	c.Set(4, make([]byte, 1*KB), now.Add(1*time.Hour))
+
+	assert.Equal(t, CacheStats{
+		Items:         2,
+		SizeBytes:     2 * KB,
+		CapacityBytes: 2 * KB,
+		Stores:        3,
+		Evictions:     CacheEvictionStats{Expired: 1, TooLarge: 1},
+	}, c.Stats())
+
+	entries := c.Entries()
+	slices.SortFunc(entries, func(a, b CacheEntryInfo) int { return int(a.Key) - int(b.Key) })
+	assert.Equal(t, []CacheKey{2, 4}, []CacheKey{entries[0].Key, entries[1].Key})
+	assert.Equal(t, int64(1), entries[0].Hits)
+	assert.Equal(t, int64(0), entries[1].Hits)
+}
+
+func TestMemoryCache_lru_evicts_least_recently_used_item(t *testing.T) {
+	c := NewMemoryCacheWithEvictionPolicy(3*KB, 1*KB, EvictionPolicyLRU)
+	expires := time.Now().Add(1 * time.Hour)
+
+	c.Set(1, make([]byte, 1*KB), expires)
+	c.Set(2, make([]byte, 1*KB), expires)
+	c.Set(3, make([]byte, 1*KB), expires)
+	c.Get(1)
+
+	c.Set(4, make([]byte, 1*KB), expires)
+	_, ok := c.Get(2)
+	assert.False(t, ok)
+
+	c.Set(5, make([]byte, 1*KB), expires)
+	_, ok = c.Get(3)
+	assert.False(t, ok)
+
+	for _, key := range []CacheKey{1, 4, 5} {
+		_, ok := c.Get(key)
+		assert.True(t, ok)
+	}
+}
+
+func TestMemoryCache_lru_updating_an_item_marks_it_as_used(t *testing.T) {
+	c := NewMemoryCacheWithEvictionPolicy(2*KB, 1*KB, EvictionPolicyLRU)
+	expires := time.Now().Add(1 * time.Hour)
+
+	c.Set(1, make([]byte, 1*KB), expires)
+	c.Set(2, make([]byte, 1*KB), expires)
+	c.Set(1, make([]byte, 1*KB), expires)
+	c.Set(3, make([]byte, 1*KB), expires)
+
+	_, ok := c.Get(1)
+	assert.True(t, ok)
+	_, ok = c.Get(2)
+	assert.False(t, ok)
+}
+
+func TestMemoryCache_tinylfu_resists_scans(t *testing.T) {
+	c := NewMemoryCacheWithEvictionPolicy(10*KB, 1*KB, EvictionPolicyTinyLFU)
+	expires := time.Now().Add(1 * time.Hour)
+
+	getOrSet := func(key CacheKey) {
+		_, ok := c.Get(key)
+		if !ok {
+			c.Set(key, make([]byte, 1*KB), expires)
+		}
+	}
+
+	for range 5 {
+		for key := range CacheKey(10) {
+			getOrSet(key)
+		}
+	}
+
+	for key := CacheKey(1000); key < 2000; key++ {
+		getOrSet(key)
+	}
+
+	for key := range CacheKey(10) {
+		_, ok := c.Get(key)
+		assert.True(t, ok, "hot item %d should not be evicted", key)
+	}
+	assert.Equal(t, int64(1000), c.Stats().Evictions.Rejected)
+}
+
+func TestMemoryCache_tinylfu_admits_items_that_become_popular(t *testing.T) {
+	c := NewMemoryCacheWithEvictionPolicy(2*KB, 1*KB, EvictionPolicyTinyLFU)
+	expires := time.Now().Add(1 * time.Hour)
+
+	c.Set(1, make([]byte, 1*KB), expires)
+	c.Set(2, make([]byte, 1*KB), expires)
+	c.Get(1)
+	c.Get(2)
+
+	for range 3 {
+		c.Get(3)
+	}
+	c.Set(3, make([]byte, 1*KB), expires)
+
+	_, ok := c.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Stats().Items)
+}
+
+func TestMemoryCache_all_eviction_policies_keep_within_capacity(t *testing.T) {
+	for _, policy := range []string{EvictionPolicySample, EvictionPolicyLRU, EvictionPolicyTinyLFU} {
+		t.Run(policy, func(t *testing.T) {
+			c := NewMemoryCacheWithEvictionPolicy(10*KB, 1*KB, policy)
+
+			for i := range CacheKey(100) {
+				c.Get(i)
+				c.Get(i)
+				c.Set(i, bytes.Repeat([]byte{byte(i)}, 1*KB), time.Now().Add(1*time.Hour))
+				if i%7 == 0 {
+					c.Delete(i)
+				}
+			}
+
+			assert.LessOrEqual(t, c.Stats().SizeBytes, 10*KB)
+			assert.Equal(t, c.Stats().SizeBytes, c.Stats().Items*KB)
+			assert.Equal(t, 10, c.Clear())
+		})
+	}
+}
+
+func TestMemoryCache_shard_count(t *testing.T) {
+	assert.Equal(t, 1, memoryCacheShardCount(10*KB, 1*KB))
+	assert.Equal(t, 1, memoryCacheShardCount(1*KB, 1*MB))
+	assert.Equal(t, 2, memoryCacheShardCount(16*MB, 1*MB))
+	assert.Equal(t, 2, memoryCacheShardCount(31*MB, 1*MB))
+	assert.LessOrEqual(t, memoryCacheShardCount(64*1024*MB, 1*MB), memoryCacheMaxShards)
+}
+
+func TestMemoryCache_shards_share_the_capacity(t *testing.T) {
+	c := newShardedMemoryCache(10*KB+3, 1*KB, EvictionPolicySample, 4)
+
+	total := 0
+	for _, s := range c.shards {
+		total += s.capacity
+	}
+	assert.Equal(t, 10*KB+3, total)
+
+	for i := range CacheKey(100) {
+		c.Set(i, make([]byte, 1*KB), time.Now().Add(1*time.Hour))
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, 10*KB+3, stats.CapacityBytes)
+	assert.LessOrEqual(t, stats.SizeBytes, 10*KB)
+	assert.Equal(t, int64(100), stats.Stores)
+	assert.Equal(t, int64(100-stats.Items), stats.Evictions.Capacity)
+
+	for _, s := range c.shards {
+		assert.NotEmpty(t, s.items, "keys should be spread across all shards")
+	}
+}
+
+func TestMemoryCache_sharded_operations_cover_all_shards(t *testing.T) {
+	c := newShardedMemoryCache(1*MB, 1*KB, EvictionPolicyLRU, 8)
+	expires := time.Now().Add(1 * time.Hour)
+
+	for i := range CacheKey(64) {
+		c.Set(i, []byte("hello"), expires, "key:all")
+	}
+
+	assert.Len(t, c.Entries(), 64)
+	assert.Equal(t, 64, c.DeleteTagged(matchSurrogateKey("all")))
+
+	for i := range CacheKey(64) {
+		c.Set(i, []byte("hello"), expires)
+	}
+	assert.Equal(t, 64, c.Clear())
+	assert.Equal(t, 0, c.Stats().Items)
+}
+
+func TestMemoryCache_concurrent_access(t *testing.T) {
+	c := newShardedMemoryCache(64*KB, 1*KB, EvictionPolicyTinyLFU, 8)
+	expires := time.Now().Add(1 * time.Hour)
+
+	var wg sync.WaitGroup
+	for worker := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				key := CacheKey((worker*1000 + i) % 200)
+				if _, ok := c.Get(key); !ok {
+					c.Set(key, make([]byte, 512), expires)
+				}
+				if i%50 == 0 {
+					c.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.SizeBytes, 64*KB)
+	assert.Equal(t, stats.SizeBytes, stats.Items*512)
+}
+
 func BenchmarkCache_populating_small_objects(b *testing.B) {
 	c := NewMemoryCache(32*MB, 1*MB)
 	payload := make([]byte, KB)
@@ -119,3 +389,98 @@ func BenchmarkCache_populating_large_objects(b *testing.B) {
 		c.Get(i)
 	}
 }
+
+// The parallel benchmarks serve a working set that fits in the cache from
+// many goroutines at once, to compare the lock contention of a single shard
+// against the default sharding.
+
+func BenchmarkCache_parallel_get_single_shard(b *testing.B) {
+	benchmarkParallelGet(b, newShardedMemoryCache(256*MB, 1*MB, EvictionPolicySample, 1))
+}
+
+func BenchmarkCache_parallel_get_sharded(b *testing.B) {
+	benchmarkParallelGet(b, newShardedMemoryCache(256*MB, 1*MB, EvictionPolicySample, memoryCacheShardCount(256*MB, 1*MB)))
+}
+
+func BenchmarkCache_parallel_get_and_set_single_shard(b *testing.B) {
+	benchmarkParallelGetAndSet(b, newShardedMemoryCache(256*MB, 1*MB, EvictionPolicySample, 1))
+}
+
+func BenchmarkCache_parallel_get_and_set_sharded(b *testing.B) {
+	benchmarkParallelGetAndSet(b, newShardedMemoryCache(256*MB, 1*MB, EvictionPolicySample, memoryCacheShardCount(256*MB, 1*MB)))
+}
+
+func benchmarkParallelGet(b *testing.B, c *MemoryCache) {
+	payload := make([]byte, KB)
+	expires := time.Now().Add(1 * time.Hour)
+
+	for i := range CacheKey(10_000) {
+		c.Set(i, payload, expires)
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			c.Get(CacheKey(random.Intn(10_000)))
+		}
+	})
+}
+
+func benchmarkParallelGetAndSet(b *testing.B, c *MemoryCache) {
+	payload := make([]byte, KB)
+	expires := time.Now().Add(1 * time.Hour)
+
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := CacheKey(random.Intn(10_000))
+			if _, ok := c.Get(key); !ok {
+				c.Set(key, payload, expires)
+			}
+		}
+	})
+}
+
+// The eviction benchmarks use a skewed workload, where a few keys are much
+// more popular than the rest, interleaved with one-off requests like those
+// from a crawler. They report the hit ratio each policy achieves.
+
+func BenchmarkCache_eviction_sample(b *testing.B) {
+	benchmarkEvictionPolicy(b, EvictionPolicySample)
+}
+
+func BenchmarkCache_eviction_lru(b *testing.B) {
+	benchmarkEvictionPolicy(b, EvictionPolicyLRU)
+}
+
+func BenchmarkCache_eviction_tinylfu(b *testing.B) {
+	benchmarkEvictionPolicy(b, EvictionPolicyTinyLFU)
+}
+
+func benchmarkEvictionPolicy(b *testing.B, policy string) {
+	c := NewMemoryCacheWithEvictionPolicy(1*MB, 1*MB, policy)
+	payload := make([]byte, KB)
+	expires := time.Now().Add(1 * time.Hour)
+
+	random := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(random, 1.1, 1, 100_000)
+	oneOff := CacheKey(1 << 32)
+
+	var hits, requests int
+	for i := 0; b.Loop(); i++ {
+		key := CacheKey(zipf.Uint64())
+		if i%4 == 0 {
+			key = oneOff
+			oneOff++
+		}
+
+		requests++
+		if _, ok := c.Get(key); ok {
+			hits++
+		} else {
+			c.Set(key, payload, expires)
+		}
+	}
+
+	b.ReportMetric(float64(hits)/float64(requests), "hit-ratio")
+}
@@ -1,23 +1,29 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 )
 
-func NewProxyHandler(targetUrl *url.URL, badGatewayPage string, forwardHeaders bool) http.Handler {
+func NewProxyHandler(target *UpstreamTarget, badGatewayPage string, forwardHeaders bool) http.Handler {
 	return &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
-			r.SetURL(targetUrl)
+			// The target can be switched while we're proxying, so we remember
+			// which endpoint this request was addressed to.
+			endpoint := target.Endpoint()
+			r.Out = r.Out.WithContext(withUpstreamEndpoint(r.Out.Context(), endpoint))
+
+			r.SetURL(endpoint.url)
 			r.Out.Host = r.In.Host
 			setXForwarded(r, forwardHeaders)
 		},
 		ErrorHandler: ProxyErrorHandler(badGatewayPage),
-		Transport:    createProxyTransport(),
+		Transport:    target,
 	}
 }
 
@@ -36,6 +42,11 @@ func ProxyErrorHandler(badGatewayPage string) func(w http.ResponseWriter, r *htt
 			return
 		}
 
+		if isRequestDecompressionError(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
 		if content != nil {
 			w.Header().Set("Content-Type", "text/html")
 			w.WriteHeader(http.StatusBadGateway)
@@ -69,7 +80,7 @@ func isRequestEntityTooLarge(err error) bool {
 	return errors.As(err, &maxBytesError)
 }
 
-func createProxyTransport() *http.Transport {
+func createProxyTransport(socketPath string) *http.Transport {
 	// The default transport requests compressed responses even if the client
 	// didn't. If it receives a compressed response but the client wants
 	// uncompressed, the transport decompresses the response transparently.
@@ -91,5 +102,14 @@ func createProxyTransport() *http.Transport {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.DisableCompression = true
 
+	// When the upstream listens on a Unix socket, every connection goes there,
+	// whatever the host in the request URL.
+	if socketPath != "" {
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
 	return transport
 }
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// How long to stop coalescing requests for a key after its response turned
+// out not to be cacheable. Waiting for another request's response is only
+// worthwhile when we expect to be able to serve it from the cache afterwards.
+const hitForPassDuration = 30 * time.Second
+
+type coalescedRequest struct {
+	done    chan struct{}
+	waiters int
+}
+
+// requestCoalescer tracks the requests that are currently being fetched to
+// fill the cache, so that concurrent requests for the same key can wait for
+// the first one to finish instead of all going to the upstream at once.
+type requestCoalescer struct {
+	sync.Mutex
+	inflight map[CacheKey]*coalescedRequest
+	passing  map[CacheKey]time.Time
+}
+
+func newRequestCoalescer() *requestCoalescer {
+	return &requestCoalescer{
+		inflight: map[CacheKey]*coalescedRequest{},
+		passing:  map[CacheKey]time.Time{},
+	}
+}
+
+// Join registers interest in fetching key. The first caller becomes the
+// leader, and must call Finish once the cache has been filled. Other callers
+// are returned a channel that is closed when the leader finishes.
+//
+// Keys that were recently passed are not coalesced, and their callers are
+// returned a channel that is already closed.
+func (c *requestCoalescer) Join(key CacheKey, now time.Time) (<-chan struct{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	until, ok := c.passing[key]
+	if ok {
+		if now.Before(until) {
+			return closedChannel, false
+		}
+		delete(c.passing, key)
+	}
+
+	req, ok := c.inflight[key]
+	if ok {
+		req.waiters++
+		return req.done, false
+	}
+
+	req = &coalescedRequest{done: make(chan struct{})}
+	c.inflight[key] = req
+
+	return req.done, true
+}
+
+func (c *requestCoalescer) Finish(key CacheKey) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.finish(key)
+}
+
+// Pass records that the response for key can't be cached, so there is no
+// point in waiting for it. Any requests that are waiting are released
+// straight away, and later requests are not coalesced for hitForPassDuration.
+//
+// Expired passes for other keys are pruned at the same time, so that keys
+// which are never requested again don't stay in the map forever.
+func (c *requestCoalescer) Pass(key CacheKey, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	for k, until := range c.passing {
+		if !now.Before(until) {
+			delete(c.passing, k)
+		}
+	}
+
+	c.passing[key] = now.Add(hitForPassDuration)
+	c.finish(key)
+}
+
+// Private
+
+var closedChannel = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+func (c *requestCoalescer) finish(key CacheKey) {
+	req, ok := c.inflight[key]
+	if ok {
+		close(req.done)
+		delete(c.inflight, key)
+	}
+}
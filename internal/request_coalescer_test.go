@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestCoalescer(t *testing.T) {
+	c := newRequestCoalescer()
+	now := time.Now()
+
+	leaderDone, leader := c.Join(1, now)
+	assert.True(t, leader)
+
+	followerDone, leader := c.Join(1, now)
+	assert.False(t, leader)
+	assert.Equal(t, 1, coalescedWaiters(c, 1))
+
+	_, leader = c.Join(2, now)
+	assert.True(t, leader, "different keys should not be coalesced")
+
+	c.Finish(1)
+
+	assert.Equal(t, 0, coalescedWaiters(c, 1))
+	assert.True(t, isClosed(leaderDone))
+	assert.True(t, isClosed(followerDone))
+
+	_, leader = c.Join(1, now)
+	assert.True(t, leader, "a new leader is chosen once the previous one finishes")
+}
+
+func TestRequestCoalescer_pass(t *testing.T) {
+	c := newRequestCoalescer()
+	now := time.Now()
+
+	_, leader := c.Join(1, now)
+	assert.True(t, leader)
+
+	followerDone, _ := c.Join(1, now)
+	assert.False(t, isClosed(followerDone))
+
+	c.Pass(1, now)
+	assert.True(t, isClosed(followerDone), "waiting requests should be released")
+
+	done, leader := c.Join(1, now.Add(10*time.Second))
+	assert.False(t, leader, "passed keys should not be coalesced")
+	assert.True(t, isClosed(done))
+
+	c.Finish(1)
+
+	_, leader = c.Join(1, now.Add(2*time.Minute))
+	assert.True(t, leader, "keys are coalesced again once the pass expires")
+}
+
+func TestRequestCoalescer_pass_prunes_expired_keys(t *testing.T) {
+	c := newRequestCoalescer()
+	now := time.Now()
+
+	c.Pass(1, now)
+	c.Pass(2, now.Add(10*time.Second))
+	c.Pass(3, now.Add(hitForPassDuration))
+
+	assert.Equal(t, []CacheKey{2, 3}, passingKeys(c), "expired passes should be pruned")
+}
+
+// Helpers
+
+func passingKeys(c *requestCoalescer) []CacheKey {
+	c.Lock()
+	defer c.Unlock()
+
+	return slices.Sorted(maps.Keys(c.passing))
+}
+
+func coalescedWaiters(c *requestCoalescer, key CacheKey) int {
+	c.Lock()
+	defer c.Unlock()
+
+	req, ok := c.inflight[key]
+	if !ok {
+		return 0
+	}
+
+	return req.waiters
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
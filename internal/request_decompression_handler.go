@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	defaultMaxDecompressedRequestBody = 64 * MB
+
+	// zstd lets the sender choose how much memory the decoder needs. We cap
+	// it so that a small request can't make us allocate a huge window.
+	requestDecompressionMaxZstdWindow = 8 * MB
+)
+
+// RequestDecompressionHandler decodes request bodies that the client has
+// compressed with gzip, zstd or Brotli, so that the upstream receives them
+// uncompressed.
+//
+// Decompressed bodies are limited to maxSize bytes, which protects against
+// small requests that expand into very large ones. The compressed body is
+// still subject to any limit that applies before this handler.
+type RequestDecompressionHandler struct {
+	maxSize int
+	next    http.Handler
+}
+
+func NewRequestDecompressionHandler(maxSize int, next http.Handler) *RequestDecompressionHandler {
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedRequestBody
+	}
+
+	return &RequestDecompressionHandler{
+		maxSize: maxSize,
+		next:    next,
+	}
+}
+
+func (h *RequestDecompressionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	switch encoding {
+	case "":
+		h.next.ServeHTTP(w, r)
+		return
+	case "identity":
+		r.Header.Del("Content-Encoding")
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	decoder, err := newRequestBodyDecoder(encoding, r.Body)
+	if errors.Is(err, errUnsupportedRequestEncoding) {
+		// Leave anything we don't understand for the upstream to deal with.
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		if isRequestEntityTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, &decompressedRequestBody{decoder: decoder, body: r.Body}, int64(h.maxSize))
+	r.ContentLength = -1
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+
+	h.next.ServeHTTP(w, r)
+}
+
+// Private
+
+var errUnsupportedRequestEncoding = errors.New("unsupported request content encoding")
+
+// requestDecompressionError is returned when reading a request body that
+// could not be decompressed.
+type requestDecompressionError struct {
+	err error
+}
+
+func (e *requestDecompressionError) Error() string {
+	return "unable to decompress request body: " + e.err.Error()
+}
+
+func (e *requestDecompressionError) Unwrap() error {
+	return e.err
+}
+
+func isRequestDecompressionError(err error) bool {
+	var decompressionError *requestDecompressionError
+	return errors.As(err, &decompressionError)
+}
+
+func newRequestBodyDecoder(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, wrapRequestDecompressionError(err)
+		}
+		return reader, nil
+
+	case "zstd":
+		reader, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxWindow(requestDecompressionMaxZstdWindow))
+		if err != nil {
+			return nil, wrapRequestDecompressionError(err)
+		}
+		return reader.IOReadCloser(), nil
+
+	case "br":
+		return io.NopCloser(brotli.NewReader(body)), nil
+	}
+
+	return nil, errUnsupportedRequestEncoding
+}
+
+// wrapRequestDecompressionError marks errors that come from the decoder, so
+// that they can be reported as bad requests. Errors from reading the
+// compressed body itself, like exceeding its size limit, are left alone.
+func wrapRequestDecompressionError(err error) error {
+	if err == nil || err == io.EOF || isRequestEntityTooLarge(err) {
+		return err
+	}
+	return &requestDecompressionError{err: err}
+}
+
+type decompressedRequestBody struct {
+	decoder io.ReadCloser
+	body    io.Closer
+}
+
+func (b *decompressedRequestBody) Read(p []byte) (int, error) {
+	n, err := b.decoder.Read(p)
+	return n, wrapRequestDecompressionError(err)
+}
+
+func (b *decompressedRequestBody) Close() error {
+	_ = b.decoder.Close()
+	return b.body.Close()
+}
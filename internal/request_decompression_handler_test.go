@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestDecompressionHandler(t *testing.T) {
+	body := fixtureContent("loremipsum.txt")
+
+	tests := []struct {
+		encoding string
+		compress func(*testing.T, []byte) []byte
+	}{
+		{"gzip", gzipBytes},
+		{"zstd", zstdBytes},
+		{"br", brotliBytes},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.encoding, func(t *testing.T) {
+			var received []byte
+			h := NewRequestDecompressionHandler(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Empty(t, r.Header.Get("Content-Encoding"))
+				assert.Empty(t, r.Header.Get("Content-Length"))
+				assert.Equal(t, int64(-1), r.ContentLength)
+
+				var err error
+				received, err = io.ReadAll(r.Body)
+				require.NoError(t, err)
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(tc.compress(t, body)))
+			r.Header.Set("Content-Encoding", tc.encoding)
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, body, received)
+		})
+	}
+}
+
+func TestRequestDecompressionHandler_leaves_other_requests_alone(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+	}{
+		{"no encoding", ""},
+		{"unsupported encoding", "deflate"},
+		{"multiple encodings", "gzip, br"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewRequestDecompressionHandler(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tc.encoding, r.Header.Get("Content-Encoding"))
+
+				received, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, "Hello", string(received))
+			}))
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", strings.NewReader("Hello"))
+			if tc.encoding != "" {
+				r.Header.Set("Content-Encoding", tc.encoding)
+			}
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestRequestDecompressionHandler_limits_the_decompressed_size(t *testing.T) {
+	var readErr error
+	h := NewRequestDecompressionHandler(100, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, bytes.Repeat([]byte("a"), 1000))))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	assert.True(t, isRequestEntityTooLarge(readErr))
+}
+
+func TestRequestDecompressionHandler_rejects_invalid_bodies(t *testing.T) {
+	h := NewRequestDecompressionHandler(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("should not be called")
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader("not really gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRequestDecompressionHandler_reports_corrupt_streams_as_decompression_errors(t *testing.T) {
+	var readErr error
+	h := NewRequestDecompressionHandler(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+
+	compressed := zstdBytes(t, fixtureContent("loremipsum.txt"))
+	compressed = compressed[:len(compressed)/2]
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(compressed))
+	r.Header.Set("Content-Encoding", "zstd")
+	h.ServeHTTP(w, r)
+
+	assert.True(t, isRequestDecompressionError(readErr))
+}
+
+// Helpers
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, b []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+
+	return encoder.EncodeAll(b, nil)
+}
+
+func brotliBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	writer := brotli.NewWriter(&buf)
+	_, err := writer.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	return buf.Bytes()
+}
@@ -4,12 +4,23 @@ import (
 	"bufio"
 	"errors"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
+// The extensions of precompressed copies of static files, like those written
+// by the Rails asset pipeline, for each encoding.
+var precompressedFileExtensions = map[string]string{
+	"zstd": ".zst",
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
 type SendfileHandler struct {
 	enabled bool
 	next    http.Handler
@@ -91,6 +102,7 @@ func (w *sendfileWriter) sendingFilename() string {
 }
 
 func (w *sendfileWriter) serveFile(filename string) {
+	filename = w.precompressedFilename(filename)
 	slog.Debug("X-Sendfile sending file", "path", filename)
 
 	w.setContentLength(filename)
@@ -117,3 +129,67 @@ func (w *sendfileWriter) setContentLength(filename string) {
 		w.w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
 	}
 }
+
+// precompressedFilename looks for a precompressed copy of the file in an
+// encoding the client accepts. If there is one, it sets the headers to serve
+// it in place of the original, and returns its name. Otherwise it returns the
+// original name.
+//
+// Responses that already have a Content-Encoding are left alone, since the
+// upstream has chosen what to serve.
+func (w *sendfileWriter) precompressedFilename(filename string) string {
+	header := w.w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return filename
+	}
+
+	available := map[string]string{}
+	for encoding, extension := range precompressedFileExtensions {
+		fi, err := os.Stat(filename + extension)
+		if err == nil && fi.Mode().IsRegular() {
+			available[encoding] = filename + extension
+		}
+	}
+
+	if len(available) == 0 {
+		return filename
+	}
+
+	// The response depends on Accept-Encoding whichever file we choose.
+	addVaryHeader(header, "Accept-Encoding")
+
+	encoding := preferredEncoding(w.r.Header.Get("Accept-Encoding"), func(encoding string) bool {
+		_, ok := available[encoding]
+		return ok
+	})
+	if encoding == "" {
+		return filename
+	}
+
+	// `http.ServeFile` would otherwise take the content type from the
+	// compressed file's extension, or sniff the compressed content.
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if contentType == "" {
+		return filename
+	}
+
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Encoding", encoding)
+
+	return available[encoding]
+}
+
+func addVaryHeader(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), name) {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", name)
+}
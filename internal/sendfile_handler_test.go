@@ -3,10 +3,13 @@ package internal
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSendfileHandler(t *testing.T) {
@@ -91,3 +94,92 @@ func TestSendFileHandler_when_not_enabled(t *testing.T) {
 	assert.Equal(t, "application/custom", w.Header().Get("Content-Type"))
 	assert.Equal(t, "This body should be seen", w.Body.String())
 }
+
+func TestSendfileHandler_serves_precompressed_files(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "application.js")
+	files := map[string]string{
+		"application.js":    "plain",
+		"application.js.br": "brotli",
+		"application.js.gz": "gzip",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	serve := func(acceptEncoding string, upstreamHeaders map[string]string) *httptest.ResponseRecorder {
+		h := NewSendfileHandler(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range upstreamHeaders {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("X-Sendfile", filename)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(w, r)
+
+		return w
+	}
+
+	tests := map[string]struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		"brotli":                              {"gzip, br", "br", "brotli"},
+		"gzip":                                {"gzip, deflate", "gzip", "gzip"},
+		"higher quality":                      {"br;q=0.5, gzip", "gzip", "gzip"},
+		"best available when zstd is missing": {"zstd, br, gzip", "br", "brotli"},
+		"no accepted encoding":                {"deflate", "", "plain"},
+		"no Accept-Encoding":                  {"", "", "plain"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := serve(tc.acceptEncoding, nil)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.encoding, w.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, "text/javascript; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Equal(t, strconv.Itoa(len(tc.body)), w.Header().Get("Content-Length"))
+			assert.Equal(t, tc.body, w.Body.String())
+		})
+	}
+
+	t.Run("keeps the upstream's content type", func(t *testing.T) {
+		w := serve("br", map[string]string{"Content-Type": "application/javascript"})
+
+		assert.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		assert.Equal(t, "application/javascript", w.Header().Get("Content-Type"))
+	})
+
+	t.Run("leaves responses that already have an encoding alone", func(t *testing.T) {
+		w := serve("br", map[string]string{"Content-Encoding": "gzip"})
+
+		assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		assert.Empty(t, w.Header().Get("Vary"))
+		assert.Equal(t, "plain", w.Body.String())
+	})
+}
+
+func TestSendfileHandler_does_not_vary_without_precompressed_files(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Sendfile", fixturePath("loremipsum.txt"))
+		w.WriteHeader(http.StatusOK)
+	}
+
+	h := NewSendfileHandler(true, http.HandlerFunc(upstream))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip, br")
+	h.ServeHTTP(w, r)
+
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Header().Get("Vary"))
+	assert.Equal(t, fixtureContent("loremipsum.txt"), w.Body.Bytes())
+}
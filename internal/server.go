@@ -3,11 +3,11 @@ package internal
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
-	"time"
 
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
@@ -80,16 +80,41 @@ func (s *Server) Start() error {
 }
 
 func (s *Server) Stop() {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
 	defer cancel()
-	defer slog.Info("Server stopped")
 
+	if err := s.Shutdown(ctx); err != nil {
+		_ = s.Close()
+	}
+}
+
+// Shutdown stops accepting new connections, and waits for in-flight requests
+// to finish, or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
 	slog.Info("Server stopping")
 
-	_ = s.httpServer.Shutdown(ctx)
+	err := s.httpServer.Shutdown(ctx)
+	if s.httpsServer != nil {
+		err = errors.Join(err, s.httpsServer.Shutdown(ctx))
+	}
+
+	if err != nil {
+		slog.Warn("Server did not stop in time", "error", err)
+		return err
+	}
+
+	slog.Info("Server stopped")
+	return nil
+}
+
+// Close closes all connections immediately, including those with requests
+// still in progress.
+func (s *Server) Close() error {
+	err := s.httpServer.Close()
 	if s.httpsServer != nil {
-		_ = s.httpsServer.Shutdown(ctx)
+		err = errors.Join(err, s.httpsServer.Close())
 	}
+	return err
 }
 
 func (s *Server) certManager() *autocert.Manager {
@@ -1,10 +1,12 @@
 package internal
 
 import (
-	"fmt"
+	"context"
 	"log/slog"
-	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 )
 
 type Service struct {
@@ -18,32 +20,125 @@ func NewService(config *Config) *Service {
 }
 
 func (s *Service) Run() int {
+	cache := s.cache()
+	cacheRequestStats := NewCacheRequestStats()
+	upstreamReadiness := NewUpstreamReadiness()
+	target := NewUpstreamTarget(s.targetEndpoint())
+
 	handlerOptions := HandlerOptions{
-		cache:                        s.cache(),
-		targetUrl:                    s.targetUrl(),
+		cache:                        cache,
+		cacheRequestStats:            cacheRequestStats,
+		cacheKeyRules:                s.config.CacheKeyRules,
+		target:                       target,
+		upstreamReadiness:            upstreamReadiness,
+		upstreamReadyTimeout:         s.config.UpstreamReadyTimeout,
+		startingPage:                 s.config.StartingPage,
+		healthCheckPath:              s.config.HealthCheckPath,
 		xSendfileEnabled:             s.config.XSendfileEnabled,
 		gzipCompressionEnabled:       s.config.GzipCompressionEnabled,
 		maxCacheableResponseBody:     s.config.MaxCacheItemSizeBytes,
 		maxRequestBody:               s.config.MaxRequestBody,
+		requestDecompressionEnabled:  s.config.RequestDecompressionEnabled,
+		maxDecompressedRequestBody:   s.config.MaxDecompressedRequestBody,
 		badGatewayPage:               s.config.BadGatewayPage,
 		forwardHeaders:               s.config.ForwardHeaders,
 		logRequests:                  s.config.LogRequests,
 		gzipCompressionDisableOnAuth: s.config.GzipCompressionDisableOnAuth,
 		gzipCompressionJitter:        s.config.GzipCompressionJitter,
+		gzipCompressionLevel:         s.config.GzipCompressionLevel,
+		brotliCompressionEnabled:     s.config.BrotliCompressionEnabled,
+		brotliCompressionLevel:       s.config.BrotliCompressionLevel,
+		zstdCompressionEnabled:       s.config.ZstdCompressionEnabled,
+		zstdCompressionLevel:         s.config.ZstdCompressionLevel,
+		compressionMinSize:           s.config.GzipCompressionMinSize,
+		compressionContentTypes:      s.config.GzipCompressionContentTypes,
+		compressionExcludedTypes:     s.config.GzipCompressionExcludedContentTypes,
+		compressionOptOutHeader:      s.config.GzipCompressionOptOutHeader,
+		compressionGuardRules:        s.config.GzipCompressionGuardRules,
 	}
 
 	handler := NewHandler(handlerOptions)
 	server := NewServer(s.config, handler)
-	upstream := NewUpstreamProcess(s.config.UpstreamCommand, s.config.UpstreamArgs...)
+	upstream := NewUpstreamSupervisor(s.config.UpstreamRestartPolicy, s.config.UpstreamCommand, s.config.UpstreamArgs...)
+	upstream.backoff = s.config.UpstreamRestartBackoff
+	upstream.maxBackoff = s.config.UpstreamRestartMaxBackoff
+	upstream.maxRestarts = s.config.UpstreamMaxRestarts
+	upstream.window = s.config.UpstreamRestartWindow
+	upstream.target = target
+	upstream.reloadEndpoint = s.reloadEndpoint()
+	upstream.healthCheckPath = s.config.UpstreamHealthCheckPath
+	upstream.reloadTimeout = s.config.UpstreamReloadTimeout
 
 	if err := server.Start(); err != nil {
 		return 1
 	}
-	defer server.Stop()
 
-	s.setEnvironment()
+	if s.config.AdminPort != 0 {
+		adminHandler := NewAdminHandler(cache, cacheRequestStats)
+		adminHandler.keyRules = s.config.CacheKeyRules
+
+		adminServer := NewAdminServer(s.config, adminHandler)
+		if err := adminServer.Start(); err != nil {
+			return 1
+		}
+		defer adminServer.Stop()
+	}
+
+	if s.config.CacheStatsLogInterval > 0 {
+		stopLogging := logCacheStats(s.config.CacheStatsLogInterval, cache, cacheRequestStats)
+		defer stopLogging()
+	}
+
+	// Each time the upstream starts, we wait for it to become ready again.
+	stopWaiting := func() {}
+	upstream.processStarting = func() {
+		var ctx context.Context
+		ctx, stopWaiting = context.WithCancel(context.Background())
+		check := NewUpstreamCheck(target.Endpoint(), s.config.UpstreamHealthCheckPath)
+		go upstreamReadiness.WaitForUpstream(ctx, upstreamReadinessCheckInterval, check)
+	}
+	upstream.processExited = func() {
+		stopWaiting()
+		upstreamReadiness.SetReady(false)
+	}
+
+	var exitCode int
+	var err error
+	upstreamDone := make(chan struct{})
+	go func() {
+		exitCode, err = upstream.Run()
+		close(upstreamDone)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case <-upstreamDone:
+		server.Stop()
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig)
+
+		shutdown := NewGracefulShutdown(s.config.ShutdownDelay, s.config.ShutdownTimeout, server, upstream, upstreamDone)
+		shutdown.readiness = upstreamReadiness
+
+		shutdownDone := make(chan struct{})
+		go func() {
+			shutdown.Run()
+			close(shutdownDone)
+		}()
+
+		// A second signal means we shouldn't wait any longer.
+		select {
+		case <-shutdownDone:
+		case sig := <-signals:
+			slog.Warn("Shutting down immediately", "signal", sig)
+			shutdown.Force()
+			<-shutdownDone
+		}
+	}
 
-	exitCode, err := upstream.Run()
 	if err != nil {
 		slog.Error("Failed to start wrapped process", "command", s.config.UpstreamCommand, "args", s.config.UpstreamArgs, "error", err)
 		return 1
@@ -55,15 +150,42 @@ func (s *Service) Run() int {
 // Private
 
 func (s *Service) cache() Cache {
-	return NewMemoryCache(s.config.CacheSizeBytes, s.config.MaxCacheItemSizeBytes)
+	memoryCache := NewMemoryCacheWithEvictionPolicy(s.config.CacheSizeBytes, s.config.MaxCacheItemSizeBytes, s.config.CacheEvictionPolicy)
+
+	if s.config.CacheStorage != CacheStorageDisk && s.config.CacheStorage != CacheStorageTiered {
+		return memoryCache
+	}
+
+	diskCache, err := NewDiskCache(s.diskCachePath(), s.config.DiskCacheSizeBytes, s.config.MaxCacheItemSizeBytes)
+	if err != nil {
+		slog.Error("Failed to open disk cache, using memory cache instead", "path", s.diskCachePath(), "error", err)
+		return memoryCache
+	}
+
+	if s.config.CacheStorage == CacheStorageTiered {
+		return NewTieredCache(memoryCache, diskCache)
+	}
+
+	return diskCache
+}
+
+func (s *Service) diskCachePath() string {
+	return filepath.Join(s.config.StoragePath, "cache")
 }
 
-func (s *Service) targetUrl() *url.URL {
-	url, _ := url.Parse(fmt.Sprintf("http://localhost:%d", s.config.TargetPort))
-	return url
+func (s *Service) targetEndpoint() *UpstreamEndpoint {
+	return NewUpstreamEndpoint(s.config.TargetPort, s.socketPath("upstream.sock"))
 }
 
-func (s *Service) setEnvironment() {
-	// Set PORT to be inherited by the upstream process.
-	os.Setenv("PORT", fmt.Sprintf("%d", s.config.TargetPort))
+// reloadEndpoint is where a new upstream process listens while the current
+// one is still serving requests during a reload.
+func (s *Service) reloadEndpoint() *UpstreamEndpoint {
+	return NewUpstreamEndpoint(s.config.ReloadTargetPort, s.socketPath("upstream-reload.sock"))
+}
+
+func (s *Service) socketPath(name string) string {
+	if !s.config.TargetSocketEnabled {
+		return ""
+	}
+	return filepath.Join(s.config.StoragePath, name)
 }
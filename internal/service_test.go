@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_cache(t *testing.T) {
+	tests := map[string]struct {
+		storage  string
+		expected Cache
+	}{
+		"memory":  {CacheStorageMemory, &MemoryCache{}},
+		"disk":    {CacheStorageDisk, &DiskCache{}},
+		"tiered":  {CacheStorageTiered, &TieredCache{}},
+		"unknown": {"other", &MemoryCache{}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			service := NewService(&Config{
+				CacheStorage:          tc.storage,
+				CacheSizeBytes:        1 * MB,
+				DiskCacheSizeBytes:    1 * MB,
+				MaxCacheItemSizeBytes: 1 * KB,
+				StoragePath:           t.TempDir(),
+			})
+
+			assert.IsType(t, tc.expected, service.cache())
+		})
+	}
+}
+
+func TestService_target_endpoints(t *testing.T) {
+	storagePath := t.TempDir()
+
+	service := NewService(&Config{TargetPort: 3000, ReloadTargetPort: 3001, StoragePath: storagePath})
+	assert.Equal(t, "http://localhost:3000", service.targetEndpoint().String())
+	assert.Equal(t, "http://localhost:3001", service.reloadEndpoint().String())
+
+	service = NewService(&Config{TargetPort: 3000, ReloadTargetPort: 3001, StoragePath: storagePath, TargetSocketEnabled: true})
+	assert.Equal(t, "unix://"+filepath.Join(storagePath, "upstream.sock"), service.targetEndpoint().String())
+	assert.Equal(t, "unix://"+filepath.Join(storagePath, "upstream-reload.sock"), service.reloadEndpoint().String())
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// TieredCache serves items from a MemoryCache where possible, falling back to
+// a larger DiskCache. Items found on disk are promoted into memory, and items
+// that are evicted from memory to make space are demoted to disk.
+//
+// Changes to the cache are made under a lock, so that a concurrent promotion
+// can't copy an old value from disk over a new one, or bring back an item
+// that has just been deleted. Promotions read from disk without the lock,
+// and are abandoned if the cache has changed in the meantime.
+type TieredCache struct {
+	lock       sync.Mutex
+	generation uint64
+	memory     *MemoryCache
+	disk       *DiskCache
+}
+
+func NewTieredCache(memory *MemoryCache, disk *DiskCache) *TieredCache {
+	c := &TieredCache{
+		memory: memory,
+		disk:   disk,
+	}
+
+	memory.onEvict = c.demote
+
+	return c
+}
+
+func (c *TieredCache) Set(key CacheKey, value []byte, expiresAt time.Time, tags ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+
+	// Any copy on disk is now out of date, and must not be served if the new
+	// value is evicted from memory before being demoted.
+	c.disk.Delete(key)
+	c.memory.Set(key, value, expiresAt, tags...)
+}
+
+func (c *TieredCache) Get(key CacheKey) ([]byte, bool) {
+	value, ok := c.memory.Get(key)
+	if ok {
+		return value, true
+	}
+
+	c.lock.Lock()
+	generation := c.generation
+	c.lock.Unlock()
+
+	value, expiresAt, tags, ok := c.disk.get(key)
+	if !ok {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.generation != generation {
+		// The item may have been replaced or deleted while we were reading
+		// it, so we can't tell whether the value we read is still current.
+		return c.memory.Get(key)
+	}
+
+	slog.Debug("Cache: promoting item to memory", "key", key, "size", len(value))
+	c.memory.Set(key, value, expiresAt, tags...)
+	return value, true
+}
+
+func (c *TieredCache) Delete(key CacheKey) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+
+	onDisk := c.disk.Delete(key)
+	inMemory := c.memory.Delete(key)
+
+	return inMemory || onDisk
+}
+
+// DeleteTagged removes matching items from both tiers. Promoted items can be
+// present in both, so they are only counted once.
+func (c *TieredCache) DeleteTagged(match CacheTagMatcher) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+
+	onDisk := c.disk.deleteTagged(match)
+	return countDistinctKeys(c.memory.deleteTagged(match), onDisk)
+}
+
+func (c *TieredCache) Clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+
+	onDisk := c.disk.clear()
+	return countDistinctKeys(c.memory.clear(), onDisk)
+}
+
+// Stats combines the stats of both tiers. Items that have been promoted to
+// memory are counted in both.
+func (c *TieredCache) Stats() CacheStats {
+	return c.memory.Stats().add(c.disk.Stats())
+}
+
+// Entries lists each item once, combining the hits from both tiers.
+func (c *TieredCache) Entries() []CacheEntryInfo {
+	entries := c.memory.Entries()
+
+	index := make(map[CacheKey]int, len(entries))
+	for i, entry := range entries {
+		index[entry.Key] = i
+	}
+
+	for _, entry := range c.disk.Entries() {
+		i, ok := index[entry.Key]
+		if ok {
+			entries[i].Hits += entry.Hits
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Private
+
+func (c *TieredCache) demote(key CacheKey, value []byte, expiresAt time.Time, tags []string) {
+	if c.disk.contains(key, expiresAt) {
+		return
+	}
+
+	slog.Debug("Cache: demoting item to disk", "key", key, "size", len(value))
+	c.disk.Set(key, value, expiresAt, tags...)
+}
+
+func countDistinctKeys(lists ...[]CacheKey) int {
+	keys := map[CacheKey]struct{}{}
+	for _, list := range lists {
+		for _, key := range list {
+			keys[key] = struct{}{}
+		}
+	}
+
+	return len(keys)
+}
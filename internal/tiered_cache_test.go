@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTieredCache_store_and_retrieve(t *testing.T) {
+	c := newTestTieredCache(t, 32*MB, 32*MB, 1*MB)
+	c.Set(1, []byte("hello world"), time.Now().Add(30*time.Second))
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+
+	_, _, _, ok = c.disk.get(1)
+	assert.False(t, ok, "new items should only be stored in memory")
+}
+
+func TestTieredCache_evicted_items_are_demoted_to_disk(t *testing.T) {
+	c := newTestTieredCache(t, 2*KB, 32*KB, 1*KB)
+
+	for i := range CacheKey(10) {
+		c.Set(i, bytes.Repeat([]byte{byte(i)}, 1*KB), time.Now().Add(1*time.Hour))
+	}
+
+	assert.Equal(t, 2*KB, c.memory.Stats().SizeBytes)
+	assert.Equal(t, 8*KB, c.disk.size)
+
+	for i := range CacheKey(10) {
+		read, ok := c.Get(i)
+		assert.True(t, ok)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1*KB), read)
+	}
+}
+
+func TestTieredCache_disk_hits_are_promoted_to_memory(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	expiresAt := time.Now().Add(1 * time.Hour)
+	c.disk.Set(1, []byte("hello world"), expiresAt)
+
+	_, ok := c.memory.Get(1)
+	assert.False(t, ok)
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+
+	read, ok = c.memory.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hello world"), read)
+	assert.True(t, expiresAt.Equal(c.memory.shardFor(1).items[1].expiresAt))
+}
+
+func TestTieredCache_expired_items_are_not_demoted(t *testing.T) {
+	c := newTestTieredCache(t, 1*KB, 32*KB, 1*KB)
+	now := time.Now()
+
+	c.Set(1, make([]byte, 1*KB), now.Add(1*time.Second))
+	c.memory.getCurrentTime = func() time.Time { return now.Add(2 * time.Second) }
+	c.Set(2, make([]byte, 1*KB), now.Add(1*time.Hour))
+
+	_, _, _, ok := c.disk.get(1)
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.disk.size)
+}
+
+func TestTieredCache_updating_an_item_replaces_the_copy_on_disk(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	c.disk.Set(1, []byte("first"), time.Now().Add(1*time.Hour))
+
+	c.Set(1, []byte("second"), time.Now().Add(1*time.Hour))
+
+	_, _, _, ok := c.disk.get(1)
+	assert.False(t, ok)
+
+	read, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("second"), read)
+}
+
+func TestTieredCache_tags_are_kept_when_moving_between_tiers(t *testing.T) {
+	c := newTestTieredCache(t, 1*KB, 32*KB, 1*KB)
+
+	c.Set(1, make([]byte, 1*KB), time.Now().Add(1*time.Hour), "key:a")
+	c.Set(2, make([]byte, 1*KB), time.Now().Add(1*time.Hour), "key:b")
+	assert.Equal(t, []string{"key:a"}, c.disk.items[1].tags)
+
+	_, ok := c.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"key:a"}, c.memory.shardFor(1).items[1].tags)
+}
+
+func TestTieredCache_delete_removes_from_both_tiers(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	c.disk.Set(1, []byte("hello"), time.Now().Add(1*time.Hour), "key:a")
+	c.Get(1)
+
+	assert.True(t, c.Delete(1))
+	assert.False(t, c.Delete(1))
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+}
+
+func TestTieredCache_concurrent_reads_do_not_restore_old_values(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	expiresAt := time.Now().Add(1 * time.Hour)
+
+	for i := range CacheKey(100) {
+		c.disk.Set(i, []byte("old"), expiresAt)
+		c.disk.Set(i+1000, []byte("old"), expiresAt)
+
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Go(func() {
+				c.Get(i)
+				c.Get(i + 1000)
+			})
+		}
+
+		c.Delete(i)
+		c.Set(i+1000, []byte("new"), expiresAt)
+		wg.Wait()
+
+		_, ok := c.Get(i)
+		assert.False(t, ok, "deleted items should not come back")
+
+		read, _ := c.Get(i + 1000)
+		assert.Equal(t, []byte("new"), read, "updated items should keep their new value")
+	}
+}
+
+func TestTieredCache_delete_tagged_counts_each_item_once(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	c.disk.Set(1, []byte("hello"), time.Now().Add(1*time.Hour), "key:a")
+	c.disk.Set(2, []byte("world"), time.Now().Add(1*time.Hour), "key:a")
+	c.Set(3, []byte("other"), time.Now().Add(1*time.Hour), "key:b")
+	c.Get(1)
+
+	assert.Equal(t, 2, c.DeleteTagged(matchSurrogateKey("a")))
+
+	_, ok := c.Get(1)
+	assert.False(t, ok)
+	_, ok = c.Get(2)
+	assert.False(t, ok)
+	_, ok = c.Get(3)
+	assert.True(t, ok)
+
+	assert.Equal(t, 1, c.Clear())
+}
+
+func TestTieredCache_entries_combine_both_tiers(t *testing.T) {
+	c := newTestTieredCache(t, 32*KB, 32*KB, 1*KB)
+	c.disk.Set(1, []byte("hello"), time.Now().Add(1*time.Hour), "url:example.com/")
+	c.Set(2, []byte("world"), time.Now().Add(1*time.Hour))
+	c.Get(1)
+	c.Get(1)
+
+	entries := c.Entries()
+	assert.Len(t, entries, 2)
+
+	for _, entry := range entries {
+		if entry.Key == 1 {
+			assert.Equal(t, int64(2), entry.Hits)
+			assert.Equal(t, []string{"url:example.com/"}, entry.Tags)
+		}
+	}
+
+	stats := c.Stats()
+	assert.Equal(t, 3, stats.Items)
+	assert.Equal(t, int64(3), stats.Stores)
+	assert.Equal(t, 64*KB, stats.CapacityBytes)
+}
+
+func TestTieredCache_items_not_admitted_to_memory_are_stored_on_disk(t *testing.T) {
+	memory := NewMemoryCacheWithEvictionPolicy(1*KB, 1*KB, EvictionPolicyTinyLFU)
+	c := NewTieredCache(memory, newTestDiskCache(t, t.TempDir(), 32*KB, 1*KB))
+
+	c.Set(1, make([]byte, 1*KB), time.Now().Add(1*time.Hour))
+	c.Get(1)
+	c.Get(1)
+
+	c.Set(2, make([]byte, 1*KB), time.Now().Add(1*time.Hour))
+
+	_, ok := c.memory.Get(1)
+	assert.True(t, ok)
+	_, _, _, ok = c.disk.get(2)
+	assert.True(t, ok)
+}
+
+// Helpers
+
+func newTestTieredCache(t *testing.T, memoryCapacity, diskCapacity, maxItemSize int) *TieredCache {
+	memory := NewMemoryCache(memoryCapacity, maxItemSize)
+	disk := newTestDiskCache(t, t.TempDir(), diskCapacity, maxItemSize)
+
+	return NewTieredCache(memory, disk)
+}
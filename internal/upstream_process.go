@@ -2,16 +2,15 @@ package internal
 
 import (
 	"errors"
-	"log/slog"
 	"os"
 	"os/exec"
-	"os/signal"
 	"syscall"
 )
 
 type UpstreamProcess struct {
-	Started chan struct{}
-	cmd     *exec.Cmd
+	Started    chan struct{}
+	cmd        *exec.Cmd
+	exitSignal syscall.Signal
 }
 
 func NewUpstreamProcess(name string, arg ...string) *UpstreamProcess {
@@ -33,7 +32,6 @@ func (p *UpstreamProcess) Run() (int, error) {
 
 	p.Started <- struct{}{}
 
-	go p.handleSignals()
 	err = p.cmd.Wait()
 
 	return p.handleExitCode(err)
@@ -43,20 +41,12 @@ func (p *UpstreamProcess) Signal(sig os.Signal) error {
 	return p.cmd.Process.Signal(sig)
 }
 
-func (p *UpstreamProcess) handleSignals() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-
-	sig := <-ch
-	slog.Info("Relaying signal to upstream process", "signal", sig.String())
-	_ = p.Signal(sig)
-}
-
 func (p *UpstreamProcess) handleExitCode(err error) (int, error) {
 	var exitErr *exec.ExitError
 	if errors.As(err, &exitErr) {
 		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 			if status.Signaled() {
+				p.exitSignal = status.Signal()
 				return 128 + int(status.Signal()), nil
 			}
 		}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamReadinessCheckInterval = 100 * time.Millisecond
+	upstreamReadinessCheckTimeout  = 1 * time.Second
+)
+
+// UpstreamReadiness tracks whether the upstream is ready to receive requests,
+// and lets requests wait until it is. While we are shutting down it is
+// draining, which fails health checks but still lets requests through.
+type UpstreamReadiness struct {
+	lock     sync.Mutex
+	ready    bool
+	draining bool
+	wait     chan struct{}
+}
+
+func NewUpstreamReadiness() *UpstreamReadiness {
+	return &UpstreamReadiness{
+		wait: make(chan struct{}),
+	}
+}
+
+func (u *UpstreamReadiness) Ready() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.ready
+}
+
+// Healthy reports whether we should be sent new requests: the upstream is
+// ready, and we are not shutting down.
+func (u *UpstreamReadiness) Healthy() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.ready && !u.draining
+}
+
+func (u *UpstreamReadiness) SetDraining() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.draining = true
+}
+
+func (u *UpstreamReadiness) SetReady(ready bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if ready == u.ready {
+		return
+	}
+
+	u.ready = ready
+	if ready {
+		close(u.wait)
+	} else {
+		u.wait = make(chan struct{})
+	}
+}
+
+// Wait blocks until the upstream is ready, the timeout passes, or the context
+// is done, and reports whether the upstream is ready.
+func (u *UpstreamReadiness) Wait(ctx context.Context, timeout time.Duration) bool {
+	u.lock.Lock()
+	ready, wait := u.ready, u.wait
+	u.lock.Unlock()
+
+	if ready || timeout <= 0 {
+		return ready
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-wait:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	return u.Ready()
+}
+
+// WaitForUpstream runs check at every interval until it succeeds, and then
+// marks the upstream as ready. It gives up if the context is cancelled first.
+func (u *UpstreamReadiness) WaitForUpstream(ctx context.Context, interval time.Duration, check func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := runUpstreamCheck(ctx, check)
+		if err == nil {
+			slog.Info("Upstream is ready")
+			u.SetReady(true)
+			return
+		}
+		slog.Debug("Upstream is not ready yet", "error", err)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// NewUpstreamCheck returns a function that checks whether the upstream at
+// endpoint is accepting requests. When path is empty, being able to connect
+// is enough; otherwise a GET request for path must succeed.
+func NewUpstreamCheck(endpoint *UpstreamEndpoint, path string) func(context.Context) error {
+	if path == "" {
+		return func(ctx context.Context) error {
+			var dialer net.Dialer
+
+			network, address := "tcp", endpoint.url.Host
+			if endpoint.socketPath != "" {
+				network, address = "unix", endpoint.socketPath
+			}
+
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	}
+
+	client := &http.Client{
+		Transport: endpoint.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	checkUrl := endpoint.url.JoinPath(path)
+
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, checkUrl.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("health check returned status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Private
+
+func runUpstreamCheck(ctx context.Context, check func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamReadinessCheckTimeout)
+	defer cancel()
+
+	return check(ctx)
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const upstreamStartingRetryAfter = 5 * time.Second
+
+// NewUpstreamReadinessHandler holds requests until the upstream is ready, for
+// up to timeout. Requests that are still waiting after that are answered with
+// a 503 and the starting page, if there is one, so that clients know to try
+// again shortly rather than seeing a bad gateway error.
+//
+// Requests that have a stale response to fall back on are not held at all,
+// so that the stale response can be served straight away.
+func NewUpstreamReadinessHandler(readiness *UpstreamReadiness, timeout time.Duration, startingPage string, next http.Handler) http.Handler {
+	content, err := os.ReadFile(startingPage)
+	if err != nil {
+		slog.Debug("No custom starting page found", "path", startingPage)
+		content = nil
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := timeout
+		if hasStaleFallback(r.Context()) {
+			wait = 0
+		}
+
+		if readiness.Wait(r.Context(), wait) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(upstreamStartingRetryAfter.Seconds())))
+		w.Header().Set("Cache-Control", "no-store")
+
+		if content != nil {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write(content)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// NewHealthHandler answers requests for path with whether the upstream is
+// ready, without passing them on to it. Everything else goes to next. The
+// check fails once we start shutting down.
+func NewHealthHandler(path string, readiness *UpstreamReadiness, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		switch {
+		case readiness.Healthy():
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("ready\n"))
+		case readiness.Ready():
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining\n"))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("starting\n"))
+		}
+	})
+}
+
+// Private
+
+type staleFallbackContextKey struct{}
+
+// withStaleFallback marks a request as having a stale response that can be
+// served in place of an error.
+func withStaleFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleFallbackContextKey{}, true)
+}
+
+func hasStaleFallback(ctx context.Context) bool {
+	fallback, _ := ctx.Value(staleFallbackContextKey{}).(bool)
+	return fallback
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamReadinessHandler_passes_requests_through_when_ready(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+	readiness.SetReady(true)
+
+	h := NewUpstreamReadinessHandler(readiness, 0, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello"))
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello", w.Body.String())
+}
+
+func TestUpstreamReadinessHandler_holds_requests_until_ready(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+
+	h := NewUpstreamReadinessHandler(readiness, time.Second, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello"))
+	}))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		readiness.SetReady(true)
+	}()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "Hello", w.Body.String())
+}
+
+func TestUpstreamReadinessHandler_serves_starting_page_when_not_ready_in_time(t *testing.T) {
+	startingPage := filepath.Join(t.TempDir(), "503.html")
+	require.NoError(t, os.WriteFile(startingPage, []byte("<h1>Starting</h1>"), 0644))
+
+	h := NewUpstreamReadinessHandler(NewUpstreamReadiness(), 10*time.Millisecond, startingPage, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("should not be called")
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>Starting</h1>", w.Body.String())
+
+	h = NewUpstreamReadinessHandler(NewUpstreamReadiness(), 0, "/not/a/file.html", nil)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	assert.Empty(t, w.Body.String())
+}
+
+func TestUpstreamReadinessHandler_does_not_hold_requests_with_a_stale_fallback(t *testing.T) {
+	h := NewUpstreamReadinessHandler(NewUpstreamReadiness(), 10*time.Second, "", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("should not be called")
+	}))
+
+	started := time.Now()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r.WithContext(withStaleFallback(r.Context())))
+
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestHealthHandler(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+
+	h := NewHealthHandler("/_thruster/health", readiness, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Hello"))
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/_thruster/health", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "starting\n", w.Body.String())
+
+	readiness.SetReady(true)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ready\n", w.Body.String())
+
+	readiness.SetDraining()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "draining\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/other", nil)
+	h.ServeHTTP(w, r)
+	assert.Equal(t, "Hello", w.Body.String())
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamReadiness_wait(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+
+	assert.False(t, readiness.Ready())
+	assert.False(t, readiness.Wait(context.Background(), 0))
+	assert.False(t, readiness.Wait(context.Background(), 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		readiness.SetReady(true)
+	}()
+	assert.True(t, readiness.Wait(context.Background(), time.Second))
+	assert.True(t, readiness.Wait(context.Background(), 0))
+
+	readiness.SetReady(false)
+	assert.False(t, readiness.Wait(context.Background(), 10*time.Millisecond))
+}
+
+func TestUpstreamReadiness_wait_stops_when_the_request_is_cancelled(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	started := time.Now()
+	assert.False(t, readiness.Wait(ctx, time.Minute))
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestUpstreamReadiness_wait_for_upstream(t *testing.T) {
+	readiness := NewUpstreamReadiness()
+
+	attempts := 0
+	readiness.WaitForUpstream(context.Background(), time.Millisecond, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	assert.Equal(t, 3, attempts)
+	assert.True(t, readiness.Ready())
+}
+
+func TestUpstreamCheck_connect(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	check := NewUpstreamCheck(upstreamTarget(upstream.URL, "").Endpoint(), "")
+	assert.NoError(t, check(context.Background()))
+
+	upstream.Close()
+	assert.Error(t, check(context.Background()))
+}
+
+func TestUpstreamCheck_connect_to_socket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "upstream.sock")
+
+	check := NewUpstreamCheck(NewUpstreamEndpoint(3000, socketPath), "")
+	assert.Error(t, check(context.Background()))
+
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestUpstreamCheck_path(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/up", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer upstream.Close()
+
+	check := NewUpstreamCheck(upstreamTarget(upstream.URL, "").Endpoint(), "/up")
+	assert.Error(t, check(context.Background()))
+
+	status = http.StatusOK
+	assert.NoError(t, check(context.Background()))
+
+	status = http.StatusFound
+	assert.NoError(t, check(context.Background()))
+}
@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyAlways    = "always"
+	RestartPolicyOnFailure = "on-failure"
+)
+
+// UpstreamSupervisor runs the upstream process, starting it again when it
+// exits if the restart policy allows. Restarts are delayed with an
+// exponential backoff, and limited to maxRestarts in any window, after which
+// we give up and return the process's exit code.
+//
+// Once Stop has been called, we stop the process and don't restart it.
+//
+// On SIGHUP or SIGUSR2 the upstream is reloaded without dropping requests: a
+// new process is started on the spare endpoint, and once it is ready the
+// target is switched over to it and the old process is stopped.
+type UpstreamSupervisor struct {
+	name        string
+	args        []string
+	policy      string
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxRestarts int
+	window      time.Duration
+
+	// target is where the upstream listens, and reloadEndpoint is the spare
+	// endpoint that we alternate with when reloading. Without them, processes
+	// inherit our environment and can't be reloaded.
+	target          *UpstreamTarget
+	reloadEndpoint  *UpstreamEndpoint
+	healthCheckPath string
+	reloadTimeout   time.Duration
+
+	// processStarting and processExited are called around each run of the
+	// process, other than the runs started by a reload.
+	processStarting func()
+	processExited   func()
+
+	primaryEndpoint *UpstreamEndpoint
+	reloads         chan struct{}
+	stopping        atomic.Bool
+	stopped         chan struct{}
+	stopOnce        sync.Once
+
+	// running holds every process that has started and not yet exited. There
+	// can be two while reloading.
+	lock    sync.Mutex
+	running map[*UpstreamProcess]struct{}
+}
+
+func NewUpstreamSupervisor(policy string, name string, arg ...string) *UpstreamSupervisor {
+	return &UpstreamSupervisor{
+		name:    name,
+		args:    arg,
+		policy:  policy,
+		reloads: make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+		running: map[*UpstreamProcess]struct{}{},
+	}
+}
+
+// Reload asks for the upstream to be reloaded, as SIGHUP and SIGUSR2 do.
+func (s *UpstreamSupervisor) Reload() {
+	select {
+	case s.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// Stop asks the running process to exit with SIGTERM, and stops it from
+// being restarted. Run returns once it has exited.
+func (s *UpstreamSupervisor) Stop() {
+	s.stopOnce.Do(func() {
+		s.stopping.Store(true)
+		close(s.stopped)
+	})
+
+	s.signalRunning(syscall.SIGTERM)
+}
+
+// Kill stops the running process immediately.
+func (s *UpstreamSupervisor) Kill() {
+	s.signalRunning(syscall.SIGKILL)
+}
+
+func (s *UpstreamSupervisor) Run() (int, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	var restarts []time.Time
+
+	s.primaryEndpoint = s.endpoint()
+	current, err := s.startSupervised(s.primaryEndpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		select {
+		case <-current.done:
+			if s.processExited != nil {
+				s.processExited()
+			}
+			s.logExit(current.process, current.exitCode)
+
+			if !s.shouldRestart(current.exitCode) {
+				return current.exitCode, nil
+			}
+
+			restarts = s.recentRestarts(restarts, time.Now())
+			if s.maxRestarts > 0 && len(restarts) >= s.maxRestarts {
+				slog.Error("Upstream process restarted too often, giving up", "restarts", len(restarts), "window", s.window)
+				return current.exitCode, nil
+			}
+
+			delay := s.backoffDelay(len(restarts))
+			slog.Info("Restarting upstream process", "delay", delay, "restarts", len(restarts)+1)
+
+			if !s.waitToRestart(delay) {
+				return current.exitCode, nil
+			}
+			restarts = append(restarts, time.Now())
+
+			current, err = s.startSupervised(current.endpoint)
+			if err != nil {
+				return 0, err
+			}
+
+		case <-signals:
+			current = s.reload(current)
+
+		case <-s.reloads:
+			current = s.reload(current)
+		}
+	}
+}
+
+// Private
+
+// supervisedProcess is a running upstream process. Once done is closed, the
+// process has exited and exitCode and err are set.
+type supervisedProcess struct {
+	process  *UpstreamProcess
+	endpoint *UpstreamEndpoint
+	done     chan struct{}
+	exitCode int
+	err      error
+}
+
+func (s *UpstreamSupervisor) endpoint() *UpstreamEndpoint {
+	if s.target == nil {
+		return nil
+	}
+	return s.target.Endpoint()
+}
+
+func (s *UpstreamSupervisor) startSupervised(endpoint *UpstreamEndpoint) (*supervisedProcess, error) {
+	if s.processStarting != nil {
+		s.processStarting()
+	}
+
+	return s.start(endpoint)
+}
+
+// start runs a new process that listens on endpoint, and returns once it has
+// started.
+func (s *UpstreamSupervisor) start(endpoint *UpstreamEndpoint) (*supervisedProcess, error) {
+	process := NewUpstreamProcess(s.name, s.args...)
+
+	if endpoint != nil {
+		err := endpoint.Prepare()
+		if err != nil {
+			return nil, err
+		}
+		process.cmd.Env = append(os.Environ(), endpoint.Environment()...)
+	}
+
+	p := &supervisedProcess{process: process, endpoint: endpoint, done: make(chan struct{})}
+	go func() {
+		p.exitCode, p.err = process.Run()
+
+		s.lock.Lock()
+		delete(s.running, process)
+		close(p.done)
+		s.lock.Unlock()
+	}()
+
+	select {
+	case <-process.Started:
+		s.lock.Lock()
+		select {
+		case <-p.done:
+		default:
+			s.running[process] = struct{}{}
+		}
+		s.lock.Unlock()
+
+		// We may have been asked to stop while the process was starting.
+		if s.stopping.Load() {
+			_ = process.Signal(syscall.SIGTERM)
+		}
+		return p, nil
+	case <-p.done:
+		return nil, p.err
+	}
+}
+
+// stop asks a process to exit, and waits for it to do so. If it takes longer
+// than the reload timeout, it is killed.
+func (s *UpstreamSupervisor) stop(p *supervisedProcess) {
+	_ = p.process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-p.done:
+	case <-time.After(s.reloadTimeout):
+		slog.Warn("Upstream process did not stop in time, killing it")
+		_ = p.process.Signal(syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// reload replaces current with a new process, and returns whichever process
+// is now serving requests. If the new process doesn't become ready in time,
+// we keep the current one.
+func (s *UpstreamSupervisor) reload(current *supervisedProcess) *supervisedProcess {
+	if s.stopping.Load() {
+		return current
+	}
+
+	if s.target == nil || s.reloadEndpoint == nil {
+		slog.Warn("Upstream reload is not available")
+		return current
+	}
+
+	endpoint := s.reloadEndpoint
+	if current.endpoint == s.reloadEndpoint {
+		endpoint = s.primaryEndpoint
+	}
+
+	slog.Info("Reloading upstream process", "endpoint", endpoint.String())
+
+	next, err := s.start(endpoint)
+	if err != nil {
+		slog.Error("Failed to start new upstream process", "error", err)
+		return current
+	}
+
+	if !s.waitUntilReady(next) {
+		slog.Error("New upstream process did not become ready, keeping the current one", "endpoint", endpoint.String())
+		s.stop(next)
+		return current
+	}
+
+	previous := s.target.Switch(endpoint)
+	s.stop(current)
+	previous.transport.CloseIdleConnections()
+
+	slog.Info("Reloaded upstream process", "endpoint", endpoint.String())
+	return next
+}
+
+func (s *UpstreamSupervisor) waitUntilReady(p *supervisedProcess) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	readiness := NewUpstreamReadiness()
+	go readiness.WaitForUpstream(ctx, upstreamReadinessCheckInterval, NewUpstreamCheck(p.endpoint, s.healthCheckPath))
+
+	return readiness.Wait(ctx, s.reloadTimeout)
+}
+
+// waitToRestart waits for delay, and reports whether we should still restart
+// the process afterwards.
+func (s *UpstreamSupervisor) waitToRestart(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stopped:
+		return false
+	}
+}
+
+func (s *UpstreamSupervisor) signalRunning(sig os.Signal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for process := range s.running {
+		_ = process.Signal(sig)
+	}
+}
+
+func (s *UpstreamSupervisor) shouldRestart(exitCode int) bool {
+	if s.stopping.Load() {
+		return false
+	}
+
+	switch s.policy {
+	case RestartPolicyAlways:
+		return true
+	case RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// recentRestarts drops the restarts that are now outside the window.
+func (s *UpstreamSupervisor) recentRestarts(restarts []time.Time, now time.Time) []time.Time {
+	if s.window <= 0 {
+		return restarts
+	}
+
+	for len(restarts) > 0 && now.Sub(restarts[0]) > s.window {
+		restarts = restarts[1:]
+	}
+	return restarts
+}
+
+// backoffDelay doubles the delay for every restart in the window, up to the
+// maximum.
+func (s *UpstreamSupervisor) backoffDelay(restarts int) time.Duration {
+	delay := s.backoff
+	for range restarts {
+		if s.maxBackoff > 0 && delay >= s.maxBackoff {
+			break
+		}
+		delay *= 2
+	}
+
+	if s.maxBackoff > 0 {
+		delay = min(delay, s.maxBackoff)
+	}
+	return delay
+}
+
+func (s *UpstreamSupervisor) logExit(process *UpstreamProcess, exitCode int) {
+	if process.exitSignal != 0 {
+		slog.Warn("Upstream process exited", "exit_code", exitCode, "signal", process.exitSignal.String())
+	} else if exitCode != 0 {
+		slog.Warn("Upstream process exited", "exit_code", exitCode)
+	} else {
+		slog.Info("Upstream process exited", "exit_code", exitCode)
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamSupervisor(t *testing.T) {
+	tests := map[string]struct {
+		policy   string
+		command  string
+		runs     int
+		exitCode int
+	}{
+		"never restarts a failure":      {RestartPolicyNever, "false", 1, 1},
+		"on-failure restarts a failure": {RestartPolicyOnFailure, "false", 3, 1},
+		"on-failure leaves a success":   {RestartPolicyOnFailure, "true", 1, 0},
+		"always restarts a success":     {RestartPolicyAlways, "true", 3, 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			starts, exits := 0, 0
+
+			s := NewUpstreamSupervisor(tc.policy, tc.command)
+			s.backoff = time.Millisecond
+			s.maxRestarts = 2
+			s.window = time.Minute
+			s.processStarting = func() { starts++ }
+			s.processExited = func() { exits++ }
+
+			exitCode, err := s.Run()
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.exitCode, exitCode)
+			assert.Equal(t, tc.runs, starts)
+			assert.Equal(t, tc.runs, exits)
+		})
+	}
+}
+
+func TestUpstreamSupervisor_returns_error_when_process_cannot_start(t *testing.T) {
+	s := NewUpstreamSupervisor(RestartPolicyAlways, "/not/a/command")
+
+	_, err := s.Run()
+	assert.Error(t, err)
+}
+
+func TestUpstreamSupervisor_stop_prevents_restarts(t *testing.T) {
+	s := NewUpstreamSupervisor(RestartPolicyAlways, "sleep", "10")
+
+	starts := 0
+	s.processStarting = func() { starts++ }
+
+	var exitCode int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		exitCode, err = s.Run()
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.running) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+
+	assert.NoError(t, err)
+	assert.Equal(t, 128+int(syscall.SIGTERM), exitCode)
+	assert.Equal(t, 1, starts)
+}
+
+func TestUpstreamSupervisor_backoff_delay(t *testing.T) {
+	s := NewUpstreamSupervisor(RestartPolicyAlways, "true")
+	s.backoff = time.Second
+	s.maxBackoff = 5 * time.Second
+
+	assert.Equal(t, 1*time.Second, s.backoffDelay(0))
+	assert.Equal(t, 2*time.Second, s.backoffDelay(1))
+	assert.Equal(t, 4*time.Second, s.backoffDelay(2))
+	assert.Equal(t, 5*time.Second, s.backoffDelay(3))
+	assert.Equal(t, 5*time.Second, s.backoffDelay(100))
+}
+
+func TestUpstreamSupervisor_only_counts_restarts_in_window(t *testing.T) {
+	s := NewUpstreamSupervisor(RestartPolicyAlways, "true")
+	s.window = time.Minute
+
+	now := time.Now()
+	restarts := []time.Time{now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), now.Add(-30 * time.Second)}
+
+	assert.Equal(t, restarts[2:], s.recentRestarts(restarts, now))
+}
+
+func TestUpstreamSupervisor_reload(t *testing.T) {
+	t.Setenv("THRUSTER_TEST_UPSTREAM", "1")
+
+	primary := NewUpstreamEndpoint(freePort(t), "")
+	spare := NewUpstreamEndpoint(freePort(t), "")
+	target := NewUpstreamTarget(primary)
+
+	s := NewUpstreamSupervisor(RestartPolicyNever, os.Args[0], "-test.run=^TestUpstreamSupervisor_helper_server$")
+	s.target = target
+	s.reloadEndpoint = spare
+	s.reloadTimeout = 10 * time.Second
+
+	var exitCode int
+	var err error
+	done := make(chan struct{})
+	go func() {
+		exitCode, err = s.Run()
+		close(done)
+	}()
+
+	firstPid := waitForHelperServer(t, primary)
+
+	s.Reload()
+	require.Eventually(t, func() bool { return target.Endpoint() == spare }, 10*time.Second, 10*time.Millisecond)
+
+	secondPid := waitForHelperServer(t, spare)
+	assert.NotEqual(t, firstPid, secondPid)
+	assert.Eventually(t, func() bool {
+		return NewUpstreamCheck(primary, "")(t.Context()) != nil
+	}, 10*time.Second, 10*time.Millisecond, "the old process should have stopped")
+
+	// Reloading again switches back to the primary endpoint
+	s.Reload()
+	require.Eventually(t, func() bool { return target.Endpoint() == primary }, 10*time.Second, 10*time.Millisecond)
+
+	_, _ = http.Get(primary.url.JoinPath("exit").String())
+	<-done
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, exitCode)
+}
+
+// TestUpstreamSupervisor_helper_server is run as the upstream process by the
+// reload test. It answers requests with its PID, and exits when asked to.
+func TestUpstreamSupervisor_helper_server(t *testing.T) {
+	if os.Getenv("THRUSTER_TEST_UPSTREAM") != "1" {
+		t.Skip("only run as an upstream process")
+	}
+
+	exit := make(chan struct{})
+	listener, err := net.Listen("tcp", "localhost:"+os.Getenv("PORT"))
+	require.NoError(t, err)
+
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, os.Getpid())
+			if r.URL.Path == "/exit" {
+				close(exit)
+			}
+		}))
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+
+	select {
+	case <-signals:
+	case <-exit:
+	}
+	os.Exit(0)
+}
+
+// Helpers
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func waitForHelperServer(t *testing.T, endpoint *UpstreamEndpoint) int {
+	var pid int
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(endpoint.url.String())
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		pid, err = strconv.Atoi(string(body))
+		return err == nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	return pid
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// UpstreamEndpoint is an address that an instance of the upstream listens
+// on: either a port on localhost, or a Unix socket. Each endpoint has its own
+// transport, so that connections to one are never reused for another.
+type UpstreamEndpoint struct {
+	url        *url.URL
+	port       int
+	socketPath string
+	transport  *http.Transport
+}
+
+func NewUpstreamEndpoint(port int, socketPath string) *UpstreamEndpoint {
+	url, _ := url.Parse(fmt.Sprintf("http://localhost:%d", port))
+	return newUpstreamEndpointForURL(url, port, socketPath)
+}
+
+// Environment returns the variables that tell the upstream where to listen.
+func (e *UpstreamEndpoint) Environment() []string {
+	env := []string{fmt.Sprintf("PORT=%d", e.port)}
+	if e.socketPath != "" {
+		env = append(env, "SOCKET_PATH="+e.socketPath)
+	}
+	return env
+}
+
+// Prepare makes sure the upstream will be able to create its socket, removing
+// any that was left behind by a previous process.
+func (e *UpstreamEndpoint) Prepare() error {
+	if e.socketPath == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(e.socketPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(e.socketPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (e *UpstreamEndpoint) String() string {
+	if e.socketPath != "" {
+		return "unix://" + e.socketPath
+	}
+	return e.url.String()
+}
+
+// UpstreamTarget holds the endpoint that requests are currently proxied to.
+// It can be switched to another endpoint at any time; requests that have
+// already started carry on using the endpoint they started with.
+type UpstreamTarget struct {
+	endpoint atomic.Pointer[UpstreamEndpoint]
+}
+
+func NewUpstreamTarget(endpoint *UpstreamEndpoint) *UpstreamTarget {
+	t := &UpstreamTarget{}
+	t.endpoint.Store(endpoint)
+	return t
+}
+
+func (t *UpstreamTarget) Endpoint() *UpstreamEndpoint {
+	return t.endpoint.Load()
+}
+
+// Switch sends new requests to endpoint, and returns the endpoint that was
+// in use before.
+func (t *UpstreamTarget) Switch(endpoint *UpstreamEndpoint) *UpstreamEndpoint {
+	return t.endpoint.Swap(endpoint)
+}
+
+// RoundTrip sends the request using the transport of the endpoint that it
+// was addressed to.
+func (t *UpstreamTarget) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, ok := req.Context().Value(upstreamEndpointContextKey{}).(*UpstreamEndpoint)
+	if !ok {
+		endpoint = t.Endpoint()
+	}
+
+	return endpoint.transport.RoundTrip(req)
+}
+
+// Private
+
+type upstreamEndpointContextKey struct{}
+
+func newUpstreamEndpointForURL(url *url.URL, port int, socketPath string) *UpstreamEndpoint {
+	return &UpstreamEndpoint{
+		url:        url,
+		port:       port,
+		socketPath: socketPath,
+		transport:  createProxyTransport(socketPath),
+	}
+}
+
+func withUpstreamEndpoint(ctx context.Context, endpoint *UpstreamEndpoint) context.Context {
+	return context.WithValue(ctx, upstreamEndpointContextKey{}, endpoint)
+}
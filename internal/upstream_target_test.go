@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamEndpoint_environment(t *testing.T) {
+	assert.Equal(t, []string{"PORT=3000"}, NewUpstreamEndpoint(3000, "").Environment())
+	assert.Equal(t, []string{"PORT=3000", "SOCKET_PATH=/tmp/upstream.sock"}, NewUpstreamEndpoint(3000, "/tmp/upstream.sock").Environment())
+}
+
+func TestUpstreamEndpoint_prepare_removes_stale_socket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "thruster", "upstream.sock")
+	endpoint := NewUpstreamEndpoint(3000, socketPath)
+
+	require.NoError(t, endpoint.Prepare())
+	assert.DirExists(t, filepath.Dir(socketPath))
+
+	require.NoError(t, os.WriteFile(socketPath, []byte{}, 0644))
+	require.NoError(t, endpoint.Prepare())
+	assert.NoFileExists(t, socketPath)
+}
+
+func TestUpstreamTarget_switch(t *testing.T) {
+	first := NewUpstreamEndpoint(3000, "")
+	second := NewUpstreamEndpoint(3001, "")
+
+	target := NewUpstreamTarget(first)
+	assert.Equal(t, first, target.Endpoint())
+
+	assert.Equal(t, first, target.Switch(second))
+	assert.Equal(t, second, target.Endpoint())
+}
@@ -1,37 +1,99 @@
 package internal
 
 import (
-	"hash/fnv"
+	"crypto/sha256"
+	"encoding/binary"
 	"net/http"
+	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 )
 
+// CacheKeyRules control which parts of a request are used to identify its
+// cached response. With the zero value, the key is made from the method, the
+// path, the query and the host.
+type CacheKeyRules struct {
+	// IgnoreQueryParams are left out of the key, so that requests differing
+	// only in those parameters share a response. A name ending in * matches
+	// every parameter that starts with the rest of the name, like utm_*.
+	IgnoreQueryParams []string
+
+	// QueryParams, when not empty, are the only parameters included in the key.
+	QueryParams []string
+
+	// IgnoreHost shares responses between all the hosts an app is served on.
+	IgnoreHost bool
+
+	// Headers and Cookies are request values that are always included in the
+	// key, in addition to any headers the response varies on.
+	Headers []string
+	Cookies []string
+}
+
 type Variant struct {
 	r           *http.Request
+	rules       CacheKeyRules
 	headerNames []string
+	primaryKey  string
 }
 
 func NewVariant(r *http.Request) *Variant {
-	return &Variant{r: r}
+	return NewVariantWithKeyRules(r, CacheKeyRules{})
+}
+
+func NewVariantWithKeyRules(r *http.Request, rules CacheKeyRules) *Variant {
+	return &Variant{r: r, rules: rules}
 }
 
 func (v *Variant) SetResponseHeader(header http.Header) {
 	v.headerNames = v.parseVaryHeader(header)
 }
 
+// CacheKey is a hash of the primary key, along with the values of any headers
+// the response varies on.
 func (v *Variant) CacheKey() CacheKey {
-	hash := fnv.New64()
-	hash.Write([]byte(v.r.Method))
-	hash.Write([]byte(v.r.URL.Path))
-	hash.Write([]byte(v.r.URL.Query().Encode()))
-	hash.Write([]byte(v.r.Host))
-
+	fields := []string{v.PrimaryKey()}
 	for _, name := range v.headerNames {
-		hash.Write([]byte(name + "=" + v.r.Header.Get(name)))
+		fields = append(fields, name+"="+v.r.Header.Get(name))
 	}
 
-	return CacheKey(hash.Sum64())
+	sum := sha256.Sum256(encodeKeyFields(fields))
+	return CacheKey(binary.BigEndian.Uint64(sum[:]))
+}
+
+// PrimaryKey identifies the resource a request is for, from the parts of the
+// request chosen by the cache key rules. It is stored with each cached
+// response, so that a hit can be checked against the request in case two
+// different keys hash to the same CacheKey.
+func (v *Variant) PrimaryKey() string {
+	if v.primaryKey != "" {
+		return v.primaryKey
+	}
+
+	host := ""
+	if !v.rules.IgnoreHost {
+		host = strings.ToLower(v.r.Host)
+	}
+
+	fields := []string{v.r.Method, host, v.r.URL.Path, v.rules.query(v.r.URL)}
+
+	for _, name := range v.rules.Headers {
+		fields = append(fields, "header:"+http.CanonicalHeaderKey(name)+"="+v.r.Header.Get(name))
+	}
+
+	for _, name := range v.rules.Cookies {
+		fields = append(fields, "cookie:"+name+"="+v.cookieValue(name))
+	}
+
+	v.primaryKey = string(encodeKeyFields(fields))
+	return v.primaryKey
+}
+
+// URL is the request URL with its query normalized in the same way as for the
+// cache key, so that it identifies the cached response.
+func (v *Variant) URL() *url.URL {
+	return v.rules.normalizeURL(v.r.URL)
 }
 
 func (v *Variant) Matches(responseHeader http.Header) bool {
@@ -67,3 +129,69 @@ func (v *Variant) parseVaryHeader(responseHeader http.Header) []string {
 
 	return names
 }
+
+func (v *Variant) cookieValue(name string) string {
+	cookie, err := v.r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// encodeKeyFields quotes each field, so that the boundaries between them are
+// unambiguous, whatever they contain.
+func encodeKeyFields(fields []string) []byte {
+	var b []byte
+	for i, field := range fields {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = strconv.AppendQuote(b, field)
+	}
+
+	return b
+}
+
+// query returns the parameters of u that belong in the cache key, encoded in
+// a consistent order.
+//
+// A malformed query can't be split into parameters without losing the parts
+// that don't parse, which would let different queries share a key. So it is
+// kept exactly as it was given instead.
+func (rules CacheKeyRules) query(u *url.URL) string {
+	params, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.RawQuery
+	}
+
+	for name := range params {
+		if !rules.includesQueryParam(name) {
+			delete(params, name)
+		}
+	}
+
+	return params.Encode()
+}
+
+func (rules CacheKeyRules) includesQueryParam(name string) bool {
+	if len(rules.QueryParams) > 0 && !slices.Contains(rules.QueryParams, name) {
+		return false
+	}
+
+	for _, pattern := range rules.IgnoreQueryParams {
+		prefix, wildcard := strings.CutSuffix(pattern, "*")
+		if name == pattern || (wildcard && strings.HasPrefix(name, prefix)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (rules CacheKeyRules) normalizeURL(u *url.URL) *url.URL {
+	normalized := *u
+	normalized.RawQuery = rules.query(u)
+
+	return &normalized
+}
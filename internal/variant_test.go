@@ -35,6 +35,132 @@ func TestVariantCacheKey_includes_variant_header_fields(t *testing.T) {
 	assert.NotEqual(t, v1.CacheKey(), v2.CacheKey())
 }
 
+func TestVariantCacheKey_normalizes_query_order(t *testing.T) {
+	key1 := NewVariant(httptest.NewRequest("GET", "/home?a=1&b=2", nil)).CacheKey()
+	key2 := NewVariant(httptest.NewRequest("GET", "/home?b=2&a=1", nil)).CacheKey()
+
+	assert.Equal(t, key1, key2)
+}
+
+func TestVariantCacheKey_keeps_malformed_queries(t *testing.T) {
+	key := func(target string) CacheKey {
+		return NewVariant(httptest.NewRequest("GET", target, nil)).CacheKey()
+	}
+
+	assert.NotEqual(t, key("/p"), key("/p?id=1;x"))
+	assert.NotEqual(t, key("/p"), key("/p?q=%zz"))
+	assert.NotEqual(t, key("/p?id=1"), key("/p?id=1;x"))
+	assert.NotEqual(t, key("/p?id=1;x"), key("/p?q=%zz"))
+	assert.Equal(t, key("/p?q=%zz"), key("/p?q=%zz"))
+}
+
+func TestVariantCacheKey_with_ignored_query_params(t *testing.T) {
+	rules := CacheKeyRules{IgnoreQueryParams: []string{"utm_*", "fbclid"}}
+	key := func(target string) CacheKey {
+		return NewVariantWithKeyRules(httptest.NewRequest("GET", target, nil), rules).CacheKey()
+	}
+
+	assert.Equal(t, key("/home?page=2"), key("/home?page=2&utm_source=news&utm_medium=email"))
+	assert.Equal(t, key("/home?page=2"), key("/home?fbclid=abc&page=2"))
+	assert.Equal(t, key("/home"), key("/home?utm_campaign=launch"))
+	assert.NotEqual(t, key("/home?page=2"), key("/home?page=3&utm_source=news"))
+	assert.NotEqual(t, key("/home"), key("/home?fbclid_extra=1"))
+}
+
+func TestVariantCacheKey_with_allowed_query_params(t *testing.T) {
+	rules := CacheKeyRules{QueryParams: []string{"page", "q"}}
+	key := func(target string) CacheKey {
+		return NewVariantWithKeyRules(httptest.NewRequest("GET", target, nil), rules).CacheKey()
+	}
+
+	assert.Equal(t, key("/search?q=go&page=2"), key("/search?page=2&q=go&_=1700000000"))
+	assert.NotEqual(t, key("/search?q=go"), key("/search?q=rust"))
+}
+
+func TestVariantCacheKey_with_allowed_and_ignored_query_params(t *testing.T) {
+	rules := CacheKeyRules{QueryParams: []string{"page", "debug"}, IgnoreQueryParams: []string{"debug"}}
+	key := func(target string) CacheKey {
+		return NewVariantWithKeyRules(httptest.NewRequest("GET", target, nil), rules).CacheKey()
+	}
+
+	assert.Equal(t, key("/home?page=1"), key("/home?page=1&debug=1"))
+}
+
+func TestVariantCacheKey_host(t *testing.T) {
+	request := func(host string) *http.Request {
+		r := httptest.NewRequest("GET", "/home", nil)
+		r.Host = host
+		return r
+	}
+
+	assert.NotEqual(t, NewVariant(request("one.example.com")).CacheKey(), NewVariant(request("two.example.com")).CacheKey())
+	assert.Equal(t, NewVariant(request("example.com")).CacheKey(), NewVariant(request("EXAMPLE.com")).CacheKey())
+
+	rules := CacheKeyRules{IgnoreHost: true}
+	assert.Equal(t,
+		NewVariantWithKeyRules(request("one.example.com"), rules).CacheKey(),
+		NewVariantWithKeyRules(request("two.example.com"), rules).CacheKey())
+}
+
+func TestVariantCacheKey_with_headers_and_cookies(t *testing.T) {
+	rules := CacheKeyRules{Headers: []string{"x-tenant"}, Cookies: []string{"locale"}}
+	key := func(tenant string, cookies ...*http.Cookie) CacheKey {
+		r := httptest.NewRequest("GET", "/home", nil)
+		r.Header.Set("X-Tenant", tenant)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		return NewVariantWithKeyRules(r, rules).CacheKey()
+	}
+
+	assert.NotEqual(t, key("a"), key("b"))
+	assert.NotEqual(t, key("a", &http.Cookie{Name: "locale", Value: "en"}), key("a", &http.Cookie{Name: "locale", Value: "fr"}))
+	assert.NotEqual(t, key("a"), key("a", &http.Cookie{Name: "locale", Value: "en"}))
+	assert.Equal(t,
+		key("a", &http.Cookie{Name: "locale", Value: "en"}),
+		key("a", &http.Cookie{Name: "locale", Value: "en"}, &http.Cookie{Name: "session", Value: "123"}))
+}
+
+func TestVariantURL_is_normalized_with_the_key_rules(t *testing.T) {
+	r := httptest.NewRequest("GET", "/home?utm_source=news&b=2&a=1", nil)
+	v := NewVariantWithKeyRules(r, CacheKeyRules{IgnoreQueryParams: []string{"utm_*"}})
+
+	assert.Equal(t, "/home?a=1&b=2", v.URL().String())
+	assert.Equal(t, "utm_source=news&b=2&a=1", r.URL.RawQuery)
+}
+
+func TestVariantPrimaryKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://Example.com/home?b=2&a=1", nil)
+
+	assert.Equal(t, `"GET" "example.com" "/home" "a=1&b=2"`, NewVariant(r).PrimaryKey())
+	assert.Equal(t, `"GET" "" "/home" "a=1&b=2"`, NewVariantWithKeyRules(r, CacheKeyRules{IgnoreHost: true}).PrimaryKey())
+
+	r.Header.Set("X-Tenant", "acme")
+	r.AddCookie(&http.Cookie{Name: "locale", Value: "en"})
+	rules := CacheKeyRules{Headers: []string{"x-tenant"}, Cookies: []string{"locale"}}
+
+	assert.Equal(t, `"GET" "example.com" "/home" "a=1&b=2" "header:X-Tenant=acme" "cookie:locale=en"`,
+		NewVariantWithKeyRules(r, rules).PrimaryKey())
+}
+
+func TestVariantPrimaryKey_fields_cannot_run_together(t *testing.T) {
+	r1 := httptest.NewRequest("GET", "/a", nil)
+	r1.Host = "example.com"
+	r2 := httptest.NewRequest("GET", "/a", nil)
+	r2.Host = `example.com" "`
+
+	assert.NotEqual(t, NewVariant(r1).PrimaryKey(), NewVariant(r2).PrimaryKey())
+	assert.NotEqual(t, NewVariant(r1).CacheKey(), NewVariant(r2).CacheKey())
+}
+
+func TestVariantCacheKey_is_stable(t *testing.T) {
+	// Keys name the files in the disk cache, so they must not change between
+	// runs.
+	r := httptest.NewRequest("GET", "http://example.com/home?a=1", nil)
+
+	assert.Equal(t, CacheKey(0x9a70d84c4fe4ba99), NewVariant(r).CacheKey())
+}
+
 func TestVariantMatches(t *testing.T) {
 	r := httptest.NewRequest("GET", "/home", nil)
 	r.Header.Set("Accept-Encoding", "gzip")